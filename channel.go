@@ -0,0 +1,99 @@
+package gocomet
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var errChannelPrefix = errors.New("Channel must start with '/'.")
+var errEmptySegment = errors.New("Channel has an empty segment.")
+var errWildcardPosition = errors.New("Wildcard is only allowed as the last segment.")
+var errWildcardPublish = errors.New("Cannot publish to a wildcard channel.")
+var errMetaPublish = errors.New("Cannot publish to a meta channel.")
+var errNoService = errors.New("No such service.")
+
+/*
+Validate the channel name, which consists of '/' prefixed segments of
+letters, digits, '_' and '-'. A wildcard "*" or "**" is only allowed
+as the last segment. Unlike the lower-case [a-z0-9_-] segments of the
+Bayeux conventions, upper-case letters are allowed, since channels are
+case-sensitive unless folded by Instance.SetCaseInsensitiveChannels,
+e.g. /Chat/Room1 distinct from /chat/room1.
+*/
+func validateChannel(name string) error {
+	if !strings.HasPrefix(name, "/") {
+		return errChannelPrefix
+	}
+	segments := strings.Split(name[1:], "/")
+	for i, segment := range segments {
+		if segment == "" {
+			return errEmptySegment
+		}
+		if segment == "*" || segment == "**" {
+			if i != len(segments)-1 {
+				return errWildcardPosition
+			}
+			continue
+		}
+		for _, c := range segment {
+			if !isChannelChar(c) {
+				if c == '*' {
+					return errWildcardPosition
+				}
+				return fmt.Errorf("Invalid character '%c' in channel.", c)
+			}
+		}
+	}
+	return nil
+}
+
+/*
+Validate the channel a client publishes to, which can't be a wildcard
+or a meta channel. A service channel is only published to by calling
+its handler, which is looked up beforehand, so it's rejected here.
+*/
+func validatePublish(channel string) error {
+	if err := validateChannel(channel); err != nil {
+		return err
+	}
+	switch {
+	case isWildcard(channel):
+		return errWildcardPublish
+	case strings.HasPrefix(channel, "/meta/"):
+		return errMetaPublish
+	case strings.HasPrefix(channel, "/service/"):
+		return errNoService
+	}
+	return nil
+}
+
+func isChannelChar(c rune) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c == '-'
+}
+
+/*
+The outcome of subscribing to, or unsubscribing from, one of several
+channels in a request like {"subscription":"/foo,/bar"}, which is told
+to the client in the ext of
+the response like {"subscriptions":[{"subscription":"/foo",
+"successful":true},{"subscription":"/bar","successful":false,
+"error":"403:/bar:Unauthorized"}]} in the order requested. The
+response itself is successful only if all of them are, with the error
+of the first failed one otherwise, but those succeeded are subscribed,
+or unsubscribed, anyway.
+*/
+type subscriptionResult struct {
+	Subscription string `json:"subscription"`
+	Successful   bool   `json:"successful"`
+	Error        string `json:"error,omitempty"`
+}
+
+// the channels of a subscription, which may be separated by commas
+func splitSubscription(subscription string) []string {
+	channels := strings.Split(subscription, ",")
+	for i, channel := range channels {
+		channels[i] = strings.TrimSpace(channel)
+	}
+	return channels
+}
@@ -0,0 +1,34 @@
+package gocomet
+
+import (
+	"testing"
+)
+
+func TestValidateChannel(t *testing.T) {
+	for _, c := range []struct {
+		name string
+		err  bool
+	}{
+		{"/foo", false},
+		{"/foo/bar", false},
+		{"/Foo/bar_baz-1", false},
+		{"/CHAT/Room1", false}, // upper case is allowed for case-sensitive channels
+		{"/foo/*", false},
+		{"/foo/**", false},
+		{"/**", false},
+		{"", true},
+		{"foo/bar", true},
+		{"/", true},
+		{"/foo/", true},
+		{"/foo//bar", true},
+		{"/*/bar", true},
+		{"/foo/**/bar", true},
+		{"/foo/ba*", true},
+		{"/foo/b r", true},
+		{"/foo/bar.baz", true},
+		{"/foo,/bar", true},
+	} {
+		err := validateChannel(c.name)
+		assert((err != nil) == c.err, t, "unexpected validation of '%v': %v", c.name, err)
+	}
+}
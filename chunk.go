@@ -0,0 +1,237 @@
+package gocomet
+
+import (
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+)
+
+// Maximum size of a reassembled message from chunks.
+const MAX_CHUNKED_BYTES = 16 * 1024 * 1024
+
+// Maximum number of chunks of a message.
+const MAX_CHUNKS = 4096
+
+// Maximum size of the pending chunks of a client, and of all the clients.
+const (
+	MAX_CLIENT_CHUNKED_BYTES = 2 * MAX_CHUNKED_BYTES
+	MAX_TOTAL_CHUNKED_BYTES  = 256 * 1024 * 1024
+)
+
+// Maximum time to wait for all the chunks of a message.
+const MAX_CHUNK_WAIT = 1 * time.Minute
+
+/*
+The chunk info of a publish, carried in the message extension like
+{"chunk":{"id":"abc","seq":0,"total":3}}. The data of each chunk must
+be a JSON string, and the contents are concatenated in the order of
+sequence numbers and delivered as a single JSON string. Binary data
+should be encoded, e.g. in base64, before split.
+*/
+type chunkInfo struct {
+	Id    string `json:"id"`
+	Seq   int    `json:"seq"`
+	Total int    `json:"total"`
+}
+
+var errInvalidChunk = errors.New("Invalid chunk.")
+var errChunkedTooLarge = errors.New("Chunked message is too large.")
+var errTooManyChunks = errors.New("Too many pending chunks.")
+
+func parseChunk(ext interface{}) (chunk chunkInfo, ok bool) {
+	fields, ok := ext.(map[string]interface{})
+	if !ok || fields["chunk"] == nil {
+		return chunk, false
+	}
+	data, _ := json.Marshal(fields["chunk"])
+	return chunk, json.Unmarshal(data, &chunk) == nil
+}
+
+type chunkKey struct {
+	clientId string
+	id       string
+}
+
+type chunkedMessage struct {
+	channel  string
+	parts    []*string
+	received int
+	size     int
+	expire   time.Time
+}
+
+/*
+Reassemble the chunked messages. Incomplete messages are dropped once
+they exceed the size or time bound, and new ones are rejected once the
+pending chunks of the client, or of all the clients, are too large.
+*/
+type chunkAssembler struct {
+	sync.Locker
+	maxBytes       int // of a message
+	maxClientBytes int
+	maxTotalBytes  int
+	maxWait        time.Duration
+	messages       map[chunkKey]*chunkedMessage
+	pending        map[string]int // size of the pending chunks by client
+	total          int            // size of all the pending chunks
+	sweeper        *time.Timer    // drop the expired messages, if any pending
+}
+
+func newChunkAssembler(maxBytes int, maxWait time.Duration) *chunkAssembler {
+	return &chunkAssembler{
+		Locker:         &sync.Mutex{},
+		maxBytes:       maxBytes,
+		maxClientBytes: MAX_CLIENT_CHUNKED_BYTES,
+		maxTotalBytes:  MAX_TOTAL_CHUNKED_BYTES,
+		maxWait:        maxWait,
+		messages:       make(map[chunkKey]*chunkedMessage),
+		pending:        make(map[string]int),
+	}
+}
+
+/*
+Add a chunk of the client's message. It returns the reassembled data
+once all the chunks are received.
+*/
+func (a *chunkAssembler) add(clientId, channel string, chunk chunkInfo, data json.RawMessage) (result json.RawMessage, complete bool, err error) {
+	var part string
+	if chunk.Id == "" || chunk.Total <= 0 || chunk.Total > MAX_CHUNKS || chunk.Seq < 0 ||
+		chunk.Seq >= chunk.Total || json.Unmarshal(data, &part) != nil {
+		return nil, false, errInvalidChunk
+	}
+
+	a.Lock()
+	defer a.Unlock()
+
+	now := time.Now()
+	key := chunkKey{clientId, chunk.Id}
+	msg, ok := a.messages[key]
+	if ok && now.After(msg.expire) { // not swept yet
+		a.drop(key)
+		ok = false
+	}
+	if !ok {
+		msg = &chunkedMessage{
+			channel: channel,
+			parts:   make([]*string, chunk.Total),
+			expire:  now.Add(a.maxWait),
+		}
+		a.messages[key] = msg
+		if a.sweeper == nil {
+			a.sweeper = time.AfterFunc(a.maxWait, a.sweep)
+		}
+	}
+	if msg.channel != channel || len(msg.parts) != chunk.Total {
+		a.drop(key)
+		return nil, false, errInvalidChunk
+	}
+	if msg.parts[chunk.Seq] == nil {
+		if msg.size+len(part) > a.maxBytes {
+			a.drop(key)
+			return nil, false, errChunkedTooLarge
+		}
+		if a.pending[clientId]+len(part) > a.maxClientBytes || a.total+len(part) > a.maxTotalBytes {
+			a.drop(key)
+			return nil, false, errTooManyChunks
+		}
+		msg.received++
+		msg.size += len(part)
+		msg.parts[chunk.Seq] = &part
+		a.pending[clientId] += len(part)
+		a.total += len(part)
+	}
+	if msg.received < len(msg.parts) {
+		return nil, false, nil
+	}
+
+	a.drop(key)
+	buf := make([]byte, 0, msg.size)
+	for _, p := range msg.parts {
+		buf = append(buf, *p...)
+	}
+	result, _ = json.Marshal(string(buf))
+	return result, true, nil
+}
+
+/*
+Check whether the client has started sending the message.
+*/
+func (a *chunkAssembler) started(clientId string, id string) bool {
+	a.Lock()
+	defer a.Unlock()
+	_, ok := a.messages[chunkKey{clientId, id}]
+	return ok
+}
+
+/*
+Drop the pending messages of the client, e.g. once it's gone.
+*/
+func (a *chunkAssembler) removeClient(clientId string) {
+	a.Lock()
+	defer a.Unlock()
+	for key := range a.messages {
+		if key.clientId == clientId {
+			a.drop(key)
+		}
+	}
+}
+
+// drop the message with the lock held
+func (a *chunkAssembler) drop(key chunkKey) {
+	if msg, ok := a.messages[key]; ok {
+		delete(a.messages, key)
+		if a.pending[key.clientId] -= msg.size; a.pending[key.clientId] <= 0 {
+			delete(a.pending, key.clientId)
+		}
+		a.total -= msg.size
+	}
+}
+
+/*
+Drop the messages never completed in time. It runs periodically while
+there are pending messages, instead of on every chunk.
+*/
+func (a *chunkAssembler) sweep() {
+	a.Lock()
+	defer a.Unlock()
+	now := time.Now()
+	for key, msg := range a.messages {
+		if now.After(msg.expire) {
+			a.drop(key)
+		}
+	}
+	if len(a.messages) > 0 {
+		a.sweeper.Reset(a.maxWait)
+	} else {
+		a.sweeper = nil
+	}
+}
+
+/*
+Publish a chunk of message. The reassembled message is broadcasted as
+a single one once all the chunks are received.
+*/
+func (c *Server) publishChunk(clientId, channel string, chunk chunkInfo, data json.RawMessage, options ...PublishOptions) (ch chan *Message, err error) {
+	if !c.names.touch(clientId) {
+		return nil, errUnknownClient
+	}
+	if !c.chunks.started(clientId, chunk.Id) { // so nothing is buffered if denied
+		if err = validatePublish(channel); err != nil {
+			return
+		}
+		if !c.authorize(clientId, channel, AUTH_PUBLISH) {
+			c.logger.Infof("[%8.8v]Publish to '%v' is denied.", clientId, channel)
+			return nil, errUnauthorized
+		}
+	}
+	result, complete, err := c.chunks.add(clientId, channel, chunk, data)
+	if err != nil {
+		c.logger.Infof("[%8.8v]Chunk %v of '%v': %v", clientId, chunk.Seq, chunk.Id, err)
+		return nil, err
+	}
+	if complete {
+		return c.publish(clientId, channel, result, options...)
+	}
+	return c.pendingChannelOf(clientId)
+}
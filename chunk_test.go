@@ -0,0 +1,78 @@
+package gocomet
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestChunkedPublish(t *testing.T) {
+	inst := New().SetConnectFastPath(true)
+	subscriber := handshake(t, inst)
+	post(t, inst, `[{"channel":"/meta/subscribe","clientId":"`+subscriber+`","subscription":"/foo/bar"}]`)
+	publisher := handshake(t, inst)
+	for _, seq := range []string{"2", "0", "1"} { // out of order
+		_, resp := post(t, inst, `[{"channel":"/foo/bar","clientId":"`+publisher+
+			`","data":"part`+seq+`;","ext":{"chunk":{"id":"m1","seq":`+seq+`,"total":3}}}]`)
+		assert(len(resp) == 1 && resp[0].Successful, t, "chunk %v should be accepted: %v", seq, resp)
+	}
+
+	_, resp := post(t, inst, `[{"channel":"/meta/connect","clientId":"`+subscriber+`","connectionType":"long-polling"}]`)
+	assert(len(resp) == 2, t, "subscriber should receive one reassembled event: %v", resp)
+	var data string
+	json.Unmarshal(resp[0].Data, &data)
+	assert(data == "part0;part1;part2;", t, "unexpected reassembled data: %v", data)
+}
+
+func TestChunkAssemblerBounds(t *testing.T) {
+	a := newChunkAssembler(8, 10*time.Millisecond)
+	_, complete, err := a.add("c1", "/foo", chunkInfo{"m1", 0, 2}, json.RawMessage(`"12345"`))
+	assert(!complete && err == nil, t, "first chunk should be pending")
+	_, _, err = a.add("c1", "/foo", chunkInfo{"m1", 1, 2}, json.RawMessage(`"67890"`))
+	assert(err == errChunkedTooLarge, t, "oversized message should fail, got %v", err)
+	assert(len(a.messages) == 0, t, "failed message should be released")
+
+	a.add("c1", "/foo", chunkInfo{"m2", 0, 2}, json.RawMessage(`"1"`))
+	time.Sleep(20 * time.Millisecond)
+	a.add("c1", "/foo", chunkInfo{"m3", 0, 2}, json.RawMessage(`"1"`))
+	a.sweep() // in case the timer hasn't fired yet
+	a.Lock()
+	_, ok := a.messages[chunkKey{"c1", "m2"}]
+	assert(!ok && len(a.messages) == 1 && a.total == 1, t, "expired message should be cleaned up")
+	a.Unlock()
+	_, _, err = a.add("c1", "/foo", chunkInfo{"m4", 0, 1}, json.RawMessage(`{"a":1}`))
+	assert(err == errInvalidChunk, t, "non-string chunk should be rejected")
+}
+
+func TestChunkAssemblerPendingLimit(t *testing.T) {
+	a := newChunkAssembler(8, time.Minute)
+	a.maxClientBytes, a.maxTotalBytes = 10, 15
+	_, _, err := a.add("c1", "/foo", chunkInfo{"m1", 0, 2}, json.RawMessage(`"1234567"`))
+	assert(err == nil, t, "first message should be pending: %v", err)
+	_, _, err = a.add("c1", "/foo", chunkInfo{"m2", 0, 2}, json.RawMessage(`"1234"`))
+	assert(err == errTooManyChunks, t, "client should be limited, got %v", err)
+	_, _, err = a.add("c2", "/foo", chunkInfo{"m1", 0, 2}, json.RawMessage(`"1234567"`))
+	assert(err == nil, t, "other client should be accepted: %v", err)
+	_, _, err = a.add("c3", "/foo", chunkInfo{"m1", 0, 2}, json.RawMessage(`"12"`))
+	assert(err == errTooManyChunks, t, "all the clients should be limited, got %v", err)
+
+	a.removeClient("c1")
+	_, _, err = a.add("c3", "/foo", chunkInfo{"m1", 0, 2}, json.RawMessage(`"12"`))
+	assert(err == nil, t, "released chunks should be available again: %v", err)
+	_, _, err = a.add("c3", "/foo", chunkInfo{"m2", 0, MAX_CHUNKS + 1}, json.RawMessage(`"1"`))
+	assert(err == errInvalidChunk, t, "too many chunks should be rejected, got %v", err)
+}
+
+type readOnlyPolicy struct{}
+
+func (readOnlyPolicy) CanSubscribe(clientId, channel string) bool { return true }
+func (readOnlyPolicy) CanPublish(clientId, channel string) bool   { return false }
+
+func TestChunkedPublishUnauthorized(t *testing.T) {
+	s := newServer()
+	s.policy = readOnlyPolicy{}
+	publisher, _ := s.handshake()
+	_, err := s.publishChunk(publisher, "/foo/bar", chunkInfo{"m1", 0, 2}, json.RawMessage(`"part0;"`))
+	assert(err == errUnauthorized, t, "first chunk should be denied, got %v", err)
+	assert(!s.chunks.started(publisher, "m1"), t, "denied chunk should not be buffered")
+}
@@ -0,0 +1,308 @@
+package gocomet
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// Capacity of the channel of the events received by a Client.
+const CLIENT_EVENT_BUFFER = 100
+
+// Time to wait before polling again once a connect fails transiently.
+const CLIENT_RETRY_INTERVAL = 100 * time.Millisecond
+
+var errNotHandshaken = errors.New("Client is not handshaken.")
+
+/*
+An in-process client which talks to the Server of an Instance directly
+without HTTP, e.g. for integration tests, or for other Go services
+embedding gocomet. It mirrors the Bayeux lifecycle: it handshakes, keeps
+polling by connects in the background, and handshakes again restoring
+its subscriptions once the server reports it unknown, e.g. after its
+session expired.
+*/
+type Client struct {
+	sync.Mutex
+	inst          *Instance
+	clientId      string
+	subscriptions map[string]bool
+	events        chan EventMessage
+	closing       chan bool // closed to stop polling
+	done          chan bool // closed once polling stops
+}
+
+func NewClient(inst *Instance) *Client {
+	return &Client{
+		inst:          inst,
+		subscriptions: make(map[string]bool),
+	}
+}
+
+/*
+Handshake the server and start polling for the events. It does nothing
+if the client is handshaken already.
+*/
+func (c *Client) Handshake() error {
+	c.Lock()
+	defer c.Unlock()
+	if c.clientId != "" {
+		return nil
+	}
+	clientId, err := c.inst.handshake()
+	if err != nil {
+		return err
+	}
+	c.clientId = clientId
+	c.events = make(chan EventMessage, CLIENT_EVENT_BUFFER)
+	c.closing, c.done = make(chan bool), make(chan bool)
+	go c.poll(c.events, c.closing, c.done)
+	return nil
+}
+
+/*
+The current client ID, which changes once the client handshakes again.
+It's empty if the client is not handshaken.
+*/
+func (c *Client) ClientId() string {
+	c.Lock()
+	defer c.Unlock()
+	return c.clientId
+}
+
+/*
+The events received since the handshake, which is closed once the
+client disconnects.
+*/
+func (c *Client) Receive() <-chan EventMessage {
+	c.Lock()
+	defer c.Unlock()
+	return c.events
+}
+
+func (c *Client) Subscribe(channel string) error {
+	return c.call(func(clientId string) (chan *Message, error) {
+		ch, err := c.inst.subscribe(clientId, channel)
+		if err == nil {
+			c.subscriptions[channel] = true
+		}
+		return ch, err
+	})
+}
+
+func (c *Client) Unsubscribe(channel string) error {
+	return c.call(func(clientId string) (chan *Message, error) {
+		ch, err := c.inst.unsubscribe(clientId, channel)
+		if err == nil {
+			delete(c.subscriptions, channel)
+		}
+		return ch, err
+	})
+}
+
+/*
+Publish the data, which is marshalled to JSON unless it's a
+json.RawMessage already. A message to a service channel is passed to
+its handler as well.
+*/
+func (c *Client) Publish(channel string, data interface{}) error {
+	raw, err := c.inst.marshalData(data)
+	if err != nil {
+		return err
+	}
+	return c.call(func(clientId string) (chan *Message, error) {
+		if handler, params, named, ok := c.inst.service(channel); ok {
+			message := &MetaMessage{Channel: channel, ClientId: clientId, Data: raw, Params: params, NamedParams: named}
+			return c.inst.callService(handler, message)
+		}
+		return c.inst.publish(clientId, channel, raw)
+	})
+}
+
+/*
+Stop polling and disconnect from the server. The client may handshake
+again afterwards, with its subscriptions forgotten.
+*/
+func (c *Client) Disconnect() error {
+	c.Lock()
+	if c.clientId == "" {
+		c.Unlock()
+		return errNotHandshaken
+	}
+	clientId, done := c.clientId, c.done
+	c.clientId = ""
+	c.subscriptions = make(map[string]bool)
+	close(c.closing)
+	c.Unlock()
+
+	<-done
+	if ch, ok := c.inst.disconnect(clientId); ok {
+		c.inst.discard(clientId, ch)
+	}
+	return nil
+}
+
+/*
+Run the operation with the client ID, and once more after handshaking
+again if the client is unknown. The messages piggybacked on it are put
+back into the session, so that they're received by polling in order.
+*/
+func (c *Client) call(operation func(clientId string) (chan *Message, error)) error {
+	c.Lock()
+	defer c.Unlock()
+	if c.clientId == "" {
+		return errNotHandshaken
+	}
+	ch, err := operation(c.clientId)
+	if err == errUnknownClient {
+		if err = c.rehandshake(c.clientId); err != nil {
+			return err
+		}
+		ch, err = operation(c.clientId)
+	}
+	if err != nil || ch == nil {
+		return err
+	}
+	var msgs []*Message
+	for msg := range ch {
+		msgs = append(msgs, msg)
+	}
+	if len(msgs) > 0 {
+		c.inst.closeAndReturn(c.clientId, msgs)
+	}
+	return nil
+}
+
+/*
+Handshake again and restore the subscriptions, unless the client has
+handshaken again or disconnected since the given client ID. It must be
+called with the lock held.
+*/
+func (c *Client) rehandshake(clientId string) error {
+	if c.clientId == "" || c.clientId != clientId {
+		return nil
+	}
+	c.inst.logger.Infof("[%8.8v]Client is unknown, handshaking again...", clientId)
+	clientId, err := c.inst.handshake()
+	if err != nil {
+		return err
+	}
+	c.clientId = clientId
+	for channel := range c.subscriptions {
+		if _, err := c.inst.subscribe(clientId, channel); err != nil {
+			c.inst.logger.Infof("[%8.8v]Failed to restore subscription to '%v': %v", clientId, channel, err)
+			delete(c.subscriptions, channel)
+		}
+	}
+	return nil
+}
+
+/*
+Deliver the message unless the events are not received fast enough,
+so that the session is never blocked by the client.
+*/
+func (c *Client) deliver(events chan EventMessage, msg *Message) bool {
+	select {
+	case events <- EventMessage{
+		Channel:   msg.channel,
+		Data:      msg.data,
+		ClientId:  msg.clientId,
+		Timestamp: formatTimestamp(msg.timestamp),
+		Extension: traceExtension(msg.trace),
+	}:
+		return true
+	default:
+		return false
+	}
+}
+
+/*
+Deliver the rest of the stopped connect, and return those undelivered
+once the events are full, in order.
+*/
+func (c *Client) deliverAll(events chan EventMessage, undelivered []*Message, ch chan *Message) []*Message {
+	for msg := range ch {
+		if len(undelivered) > 0 || !c.deliver(events, msg) {
+			undelivered = append(undelivered, msg)
+		}
+	}
+	return undelivered
+}
+
+/*
+Keep polling by connects, each of which is held no longer than half of
+the session timeout so that the session is kept alive, until the client
+disconnects or fails to handshake again. Once the events are full, the
+connect ends and the undelivered messages are put back into the session
+until the events are received.
+*/
+func (c *Client) poll(events chan EventMessage, closing, done chan bool) {
+	defer close(done)
+	defer close(events)
+	for {
+		select {
+		case <-closing:
+			return
+		default:
+		}
+		c.Lock()
+		clientId := c.clientId
+		c.Unlock()
+
+		ch, stop, err := c.inst.connect(clientId)
+		if err == errUnknownClient {
+			c.Lock()
+			err = c.rehandshake(clientId)
+			c.Unlock()
+			if err != nil {
+				c.inst.logger.Infof("[%8.8v]Failed to handshake again: %v", clientId, err)
+				return
+			}
+			continue
+		} else if err != nil { // transient
+			select {
+			case <-time.After(CLIENT_RETRY_INTERVAL):
+				continue
+			case <-closing:
+				return
+			}
+		}
+
+		c.inst.RLock()
+		hold := c.inst.options.timeout / 2
+		c.inst.RUnlock()
+		timer := time.NewTimer(hold)
+		var undelivered []*Message
+	receive:
+		for {
+			select {
+			case msg, ok := <-ch:
+				if !ok { // closed by the session
+					break receive
+				}
+				if !c.deliver(events, msg) {
+					stop <- true
+					undelivered = c.deliverAll(events, []*Message{msg}, ch)
+					break receive
+				}
+			case <-timer.C:
+				stop <- true
+				undelivered = c.deliverAll(events, nil, ch)
+				break receive
+			case <-closing: // the undelivered are lost along with the session
+				stop <- true
+				c.deliverAll(events, nil, ch)
+				break receive
+			}
+		}
+		timer.Stop()
+		if len(undelivered) > 0 {
+			c.inst.closeAndReturn(clientId, undelivered)
+			select {
+			case <-time.After(CLIENT_RETRY_INTERVAL):
+			case <-closing:
+				return
+			}
+		}
+	}
+}
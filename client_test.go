@@ -0,0 +1,136 @@
+package gocomet
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+func receive(t *testing.T, c *Client) EventMessage {
+	select {
+	case event := <-c.Receive():
+		return event
+	case <-time.After(time.Second):
+		t.Fatal("no event received")
+	}
+	return EventMessage{}
+}
+
+func TestClient(t *testing.T) {
+	inst := New()
+	subscriber, publisher := NewClient(inst), NewClient(inst)
+	assert(subscriber.Subscribe("/foo") == errNotHandshaken, t, "client should handshake first")
+	for _, c := range []*Client{subscriber, publisher} {
+		if err := c.Handshake(); err != nil {
+			t.Fatal(err)
+		}
+		defer c.Disconnect()
+	}
+	if err := subscriber.Subscribe("/foo"); err != nil {
+		t.Fatal(err)
+	}
+	publisher.Publish("/foo", "ping")
+	event := receive(t, subscriber)
+	assert(event.Channel == "/foo" && string(event.Data) == `"ping"`, t, "unexpected event %+v", event)
+
+	inst.AddService("/service/echo", func(session *Session, message *MetaMessage) {
+		message.Reply(message.Data)
+	})
+	publisher.Publish("/service/echo", 42)
+	event = receive(t, publisher)
+	assert(event.Channel == "/service/echo" && string(event.Data) == "42", t, "unexpected reply %+v", event)
+}
+
+func TestClientRehandshake(t *testing.T) {
+	inst := New()
+	subscriber, publisher := NewClient(inst), NewClient(inst)
+	subscriber.Handshake()
+	publisher.Handshake()
+	defer publisher.Disconnect()
+	subscriber.Subscribe("/foo")
+	clientId := subscriber.ClientId()
+
+	inst.Disconnect(clientId)
+	time.Sleep(50 * time.Millisecond)
+	assert(subscriber.ClientId() != clientId, t, "client should handshake again")
+	publisher.Publish("/foo", "ping")
+	event := receive(t, subscriber)
+	assert(event.Channel == "/foo", t, "subscription should be restored (got %+v)", event)
+
+	subscriber.Disconnect()
+	_, ok := <-subscriber.Receive()
+	assert(!ok, t, "events should be closed once disconnected")
+	assert(inst.ClientCount() == 1, t, "subscriber should be gone (got %v clients)", inst.ClientCount())
+}
+
+func TestClientErrors(t *testing.T) {
+	c := NewClient(New())
+	c.Handshake()
+	defer c.Disconnect()
+	failed := make(chan bool)
+	go func() {
+		failed <- c.Subscribe("no-slash") != nil && c.Unsubscribe("/foo") != nil
+	}()
+	select {
+	case ok := <-failed:
+		assert(ok, t, "invalid operations should fail")
+	case <-time.After(time.Second):
+		t.Fatal("failed operation should not block the client")
+	}
+}
+
+func TestClientSlowReceiver(t *testing.T) {
+	inst := New()
+	c := NewClient(inst)
+	c.Handshake()
+	c.Subscribe("/foo")
+	n := CLIENT_EVENT_BUFFER + 20
+	for i := 0; i < n; i++ {
+		inst.Publish("/foo", i)
+		time.Sleep(time.Millisecond) // not to overflow the broker
+	}
+	for i := 0; i < n; i++ {
+		event := receive(t, c)
+		assert(string(event.Data) == strconv.Itoa(i), t, "events should be received in order (got %v for %v)", event, i)
+	}
+
+	inst.Publish("/foo", "unread")
+	time.Sleep(50 * time.Millisecond)
+	for i := 0; i < n; i++ {
+		inst.Publish("/foo", i)
+		time.Sleep(time.Millisecond)
+	}
+	disconnected := make(chan bool)
+	go func() { disconnected <- inst.Disconnect(c.ClientId()) }()
+	select {
+	case <-disconnected:
+	case <-time.After(time.Second):
+		t.Fatal("slow receiver should not block the session")
+	}
+}
+
+func TestClientFailedUnsubscribe(t *testing.T) {
+	inst := New().SetMaxClients(1)
+	c := NewClient(inst)
+	c.Handshake()
+	c.Subscribe("/foo")
+
+	// the session is taken over before the client handshakes again
+	c.Lock()
+	inst.Disconnect(c.clientId)
+	other, _ := inst.handshake()
+	c.Unlock()
+	assert(c.Unsubscribe("/foo") == errTooManyClients, t, "unsubscribe should fail without a session")
+	c.Lock()
+	kept := c.subscriptions["/foo"]
+	c.Unlock()
+	assert(kept, t, "failed unsubscribe should keep the subscription to be restored")
+
+	inst.Disconnect(other)
+	assert(c.Unsubscribe("/foo") == nil, t, "subscription should be restored by handshaking again")
+	c.Lock()
+	kept = c.subscriptions["/foo"]
+	c.Unlock()
+	assert(!kept, t, "subscription should be forgotten once unsubscribed")
+	c.Disconnect()
+}
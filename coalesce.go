@@ -0,0 +1,48 @@
+package gocomet
+
+import (
+	"sync"
+)
+
+/*
+A set of channels shared by the server and sessions, which can be
+changed at any time.
+*/
+type channelSet struct {
+	sync.RWMutex
+	channels map[string]bool
+}
+
+func newChannelSet() *channelSet {
+	return &channelSet{channels: make(map[string]bool)}
+}
+
+func (s *channelSet) contains(channel string) bool {
+	if s == nil {
+		return false
+	}
+	s.RLock()
+	defer s.RUnlock()
+	return s.channels[channel]
+}
+
+func (s *channelSet) set(channel string, enabled bool) {
+	s.Lock()
+	defer s.Unlock()
+	if enabled {
+		s.channels[channel] = true
+	} else {
+		delete(s.channels, channel)
+	}
+}
+
+/*
+Set whether to coalesce the messages of the channel. For a coalescing
+channel, e.g. one carrying a cursor position, the mailbox of a session
+keeps only the latest message of the channel, so a subscriber that's
+behind only gets the latest value instead of every update.
+*/
+func (inst *Instance) SetCoalescing(channel string, enabled bool) *Instance {
+	inst.options.coalesce.set(channel, enabled)
+	return inst
+}
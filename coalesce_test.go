@@ -0,0 +1,52 @@
+package gocomet
+
+import (
+	"encoding/json"
+	"strconv"
+	"testing"
+)
+
+func TestCoalescing(t *testing.T) {
+	inst := New().SetCoalescing("/cursor", true)
+	subscriber, _ := inst.handshake()
+	inst.subscribe(subscriber, "/cursor")
+	inst.subscribe(subscriber, "/chat")
+	publisher, _ := inst.handshake()
+	for i := 1; i <= 10; i++ {
+		inst.publish(publisher, "/cursor", json.RawMessage(strconv.Itoa(i)))
+	}
+	inst.publish(publisher, "/chat", json.RawMessage(`"hi"`))
+	inst.publish(publisher, "/chat", json.RawMessage(`"there"`))
+
+	ch, _, _ := inst.connect(subscriber)
+	var received []string
+	for len(ch) > 0 {
+		msg := <-ch
+		received = append(received, msg.channel+":"+string(msg.data))
+	}
+	assert(len(received) == 3 && received[0] == "/cursor:10", t, "only the latest cursor should be kept (got %v)", received)
+	assert(received[1] == "/chat:\"hi\"" && received[2] == "/chat:\"there\"", t, "other channels should not coalesce (got %v)", received)
+}
+
+func TestCoalescingOverflow(t *testing.T) {
+	input := make(chan *Message)
+	options := defaultSessionOptions
+	options.mailbox = 2
+	options.coalesce = newChannelSet()
+	options.coalesce.set("/cursor", true)
+	ss := newSession("client", "", input, options, func(CloseReason, []*Message) {})
+	for _, msg := range []*Message{
+		{channel: "/cursor", data: json.RawMessage(`1`)},
+		{channel: "/chat", data: json.RawMessage(`2`)},
+		{channel: "/chat", data: json.RawMessage(`3`)}, // drops the cursor
+		{channel: "/cursor", data: json.RawMessage(`4`)},
+	} {
+		input <- msg
+	}
+	ch, _, _ := ss.obtainChannel(false)
+	var received []string
+	for msg := range ch {
+		received = append(received, string(msg.data))
+	}
+	assert(len(received) == 2 && received[0] == "3" && received[1] == "4", t, "unexpected mailbox %v", received)
+}
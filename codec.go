@@ -0,0 +1,59 @@
+package gocomet
+
+import (
+	"bytes"
+	"encoding/json"
+)
+
+/*
+The JSON codec of an Instance, e.g. jsoniter.ConfigFastest.Marshal and
+jsoniter.ConfigFastest.Unmarshal, so that a faster library may be
+plugged in without the package depending on it. Both must behave like
+encoding/json, which is the default.
+*/
+type Marshaler func(v interface{}) ([]byte, error)
+type Unmarshaler func(data []byte, v interface{}) error
+
+/*
+Encode and decode the requests, the responses and the published data by
+the codec instead of encoding/json. Either of them is reset to
+encoding/json if nil.
+*/
+func (inst *Instance) SetCodec(marshal Marshaler, unmarshal Unmarshaler) *Instance {
+	inst.Lock()
+	defer inst.Unlock()
+	inst.marshal, inst.unmarshal = marshal, unmarshal
+	return inst
+}
+
+func (inst *Instance) codec() (Marshaler, Unmarshaler) {
+	inst.RLock()
+	defer inst.RUnlock()
+	marshal, unmarshal := inst.marshal, inst.unmarshal
+	if marshal == nil {
+		marshal = json.Marshal
+	}
+	if unmarshal == nil {
+		unmarshal = json.Unmarshal
+	}
+	return marshal, unmarshal
+}
+
+/*
+Create the encoder appending the values to the buffer without newlines.
+The default one reuses a json.Encoder on the buffer, while a plugged one
+copies what's marshalled.
+*/
+func newBufferEncoder(buf *bytes.Buffer, marshal Marshaler) func(v interface{}) {
+	if marshal == nil {
+		encoder := json.NewEncoder(buf)
+		return func(v interface{}) {
+			encoder.Encode(v)
+			buf.Truncate(buf.Len() - 1) // the trailing newline
+		}
+	}
+	return func(v interface{}) {
+		data, _ := marshal(v)
+		buf.Write(data)
+	}
+}
@@ -0,0 +1,73 @@
+package gocomet
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+func TestSetCodec(t *testing.T) {
+	var marshalled, unmarshalled int64
+	inst := New().SetCodec(func(v interface{}) ([]byte, error) {
+		atomic.AddInt64(&marshalled, 1)
+		return json.Marshal(v)
+	}, func(data []byte, v interface{}) error {
+		atomic.AddInt64(&unmarshalled, 1)
+		return json.Unmarshal(data, v)
+	})
+	clientId := handshake(t, inst)
+	assert(atomic.LoadInt64(&unmarshalled) == 1 && atomic.LoadInt64(&marshalled) == 1, t,
+		"request and response should be coded by the codec (got %v, %v)", unmarshalled, marshalled)
+
+	post(t, inst, `[{"channel":"/meta/subscribe","clientId":"`+clientId+`","subscription":"/foo/bar"}]`)
+	inst.Publish("/foo/bar", map[string]int{"n": 1})
+	_, resp := post(t, inst, `[{"channel":"/meta/connect","clientId":"`+clientId+`","connectionType":"long-polling"}]`)
+	assert(len(resp) == 2 && string(resp[0].Data) == `{"n":1}`, t, "plugged codec should deliver the same events (got %v)", resp)
+
+	marshalled = 0
+	inst.SetCodec(nil, nil)
+	handshake(t, inst)
+	assert(atomic.LoadInt64(&marshalled) == 0, t, "codec should be reset to encoding/json")
+}
+
+func BenchmarkCodec(b *testing.B) {
+	codecs := []struct {
+		name      string
+		marshal   Marshaler
+		unmarshal Unmarshaler
+	}{
+		{"default", nil, nil},
+		{"plugged", json.Marshal, json.Unmarshal},
+	}
+	data := json.RawMessage(`{"user":"someone","text":"hello, world"}`)
+	for _, codec := range codecs {
+		b.Run(codec.name, func(b *testing.B) {
+			inst := New().SetConnectFastPath(true).SetMailbox(2000, DropOldest).SetCodec(codec.marshal, codec.unmarshal)
+			r, _ := http.NewRequest("POST", "/cometd", bytes.NewBufferString(`[{"channel":"/meta/handshake","version":"1.0"}]`))
+			w := httptest.NewRecorder()
+			inst.ServeHTTP(w, r)
+			var resp []*MetaMessage
+			json.Unmarshal(w.Body.Bytes(), &resp)
+			clientId := resp[0].ClientId
+			connect := `[{"channel":"/meta/connect","clientId":"` + clientId + `","connectionType":"long-polling"}]`
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				for j := 0; j < 1000; j++ {
+					inst.Send(clientId, "/foo/bar", data)
+				}
+				inst.Touch(clientId) // wait until the events are saved
+				r, _ := http.NewRequest("POST", "/cometd", bytes.NewBufferString(connect))
+				w := httptest.NewRecorder()
+				b.StartTimer()
+
+				inst.ServeHTTP(w, r)
+			}
+		})
+	}
+}
@@ -1,12 +1,15 @@
 package gocomet
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
-	"log"
 	"net/http"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -25,15 +28,24 @@ type MetaMessage struct {
 	Subscription             string          `json:"subscription,omitempty"`
 	Error                    string          `json:"error,omitempty"`
 	Extension                interface{}     `json:"ext,omitempty"`
+
+	// segments matched by wildcards and parameters of a service channel
+	Params []string `json:"-"`
+	// segments matched by parameters like {id} of a service channel
+	NamedParams map[string]string `json:"-"`
+	// reply to the calling client only on the service channel, which
+	// returns false if the client is gone
+	Reply func(data json.RawMessage) bool `json:"-"`
 }
 
 type EventMessage struct {
-	Channel   string      `json:"channel"`
-	Data      string      `json:"data"`
-	Id        string      `json:"id,omitempty"`
-	ClientId  string      `json:"clientId,omitempty"`
-	Extension interface{} `json:"ext,omitempty"`
-	Advice    *Advice     `json:"advice,omitempty"`
+	Channel   string          `json:"channel"`
+	Data      json.RawMessage `json:"data"`
+	Id        string          `json:"id,omitempty"`
+	ClientId  string          `json:"clientId,omitempty"`
+	Timestamp string          `json:"timestamp,omitempty"` // when published
+	Extension interface{}     `json:"ext,omitempty"`
+	Advice    *Advice         `json:"advice,omitempty"`
 }
 
 func (mm *MetaMessage) String() string {
@@ -53,117 +65,360 @@ func (mm *MetaMessage) String() string {
 		case mm.Data != nil:
 			return fmt.Sprintf("%v:%v:%v", mm.Channel, mm.ClientId, string(mm.Data))
 		default:
-			return fmt.Sprintf("Invalid:%v", mm)
+			return fmt.Sprintf("Invalid:%v", mm.Channel)
 		}
 	}
 }
 
+/*
+Return the data as a string. A JSON string is unquoted while any other
+JSON value is returned as its raw text.
+*/
+func (mm *MetaMessage) DataString() string {
+	return dataString(mm.Data)
+}
+
+/*
+Return the data as a string. A JSON string is unquoted while any other
+JSON value is returned as its raw text.
+*/
+func (em *EventMessage) DataString() string {
+	return dataString(em.Data)
+}
+
+func dataString(data json.RawMessage) string {
+	var s string
+	if err := json.Unmarshal(data, &s); err == nil {
+		return s
+	}
+	return string(data)
+}
+
 type Advice struct {
-	Reconnect string `json:"reconnect,omitempty"`
-	Timeout   int64  `json:"timeout,omitempty"`
-	Interval  int    `json:"interval,omitempty"`
+	Reconnect      string `json:"reconnect,omitempty"`
+	Timeout        int64  `json:"timeout,omitempty"`
+	Interval       int    `json:"interval,omitempty"`
+	ConnectionType string `json:"connectionType,omitempty"` // preferred on handshaking again
 }
 
+// Number of failed connects in a row before another connection type is
+// advised.
+const DOWNGRADE_THRESHOLD = 3
+
 const (
 	VERSION          = "1.0"
 	MINIMUM_VERSION  = "1.0"
 	DEFAULT_INTERVAL = 0
 )
 
+var errNoMessage = errors.New("Found no message.")
+
+// Maximum capacity of a response buffer kept for reuse.
+const MAX_POOLED_BUFFER = 1024 * 1024
+
+var bufferPool = sync.Pool{New: func() interface{} { return &bytes.Buffer{} }}
+
+// Size of the encoded events to flush to the client while more are
+// still being written.
+const FLUSH_THRESHOLD = 64 * 1024
+
+// Format of the message timestamps, in UTC as suggested by Bayeux, with
+// milliseconds.
+const TIMESTAMP_FORMAT = "2006-01-02T15:04:05.000"
+
+// Maximum time to wait for more events once a connect gets the first
+// one, so that the events coming together are batched in a response.
+const BATCH_WINDOW = 1 * time.Second
+
+// Time advised to wait before handshaking again once the clients are
+// at the limit.
+const HANDSHAKE_RETRY_INTERVAL = 5 * time.Second
+
 type Instance struct {
 	*Server
-	services map[string]func(session *Session, message *MetaMessage)
+	services        map[string]func(session *Session, message *MetaMessage)
+	servicePatterns *Router           // wildcard and parameter service channels
+	listeners       *UniqueStringPool // IDs of the in-process listeners
+
+	corsOrigins     []string
+	corsCredentials bool
+	streaming       bool
+	fastPath        bool
+	envelope        bool
+	fastAdvice      *Advice       // advice of a connect returned with events
+	timeoutAdvice   *Advice       // advice of a connect returned after an empty hold
+	subscribeAdvice *Advice       // advice of a successful subscribe, none if nil
+	advice          Advice        // default advice of handshakes and connects
+	maxRequestBytes int64         // max size of a request body, or unlimited if 0
+	maxBatchSize    int           // max number of messages in a request, or unlimited if 0
+	maxMessageBytes int           // max size of the data of a publish, or unlimited if 0
+	strict          bool          // reject a malformed request with 400 instead of a Bayeux error
+	pollTimeout     time.Duration // max time to hold a connect, or half of the session timeout if 0
+	connectionTypes []string      // enabled connection types
+	downgradeAfter  int           // failed connects before advising another connection type, or never if 0
+	marshal         Marshaler     // or encoding/json if nil
+	compress        bool          // the responses by gzip if accepted
+	compressMin     int           // min size of a compressed response
+	unmarshal       Unmarshaler   // or encoding/json if nil
+
+	started      time.Time
+	inflight     sync.Mutex     // guard the requests and shuttingDown only
+	requests     sync.WaitGroup // in-flight requests
+	shuttingDown bool
 }
 
 /*
-Create a simple cometd instace.
+Create a simple cometd instace, configured by the options in order.
+It may be configured by the setters afterwards as well.
 */
-func New() *Instance {
-	return &Instance{
-		Server:   newServer(),
-		services: make(map[string]func(session *Session, message *MetaMessage)),
+func New(options ...Option) *Instance {
+	inst := &Instance{
+		Server:          newServer(),
+		services:        make(map[string]func(session *Session, message *MetaMessage)),
+		servicePatterns: newRouter(),
+		listeners:       newUniqueStringPool(newListenerId),
+		connectionTypes: knownConnectionTypes,
+		downgradeAfter:  DOWNGRADE_THRESHOLD,
+		started:         time.Now(),
 	}
+	for _, option := range options {
+		option(inst)
+	}
+	return inst
 }
 
 func (inst *Instance) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	start := time.Now()
+	inst.inflight.Lock()
+	if inst.shuttingDown {
+		inst.inflight.Unlock()
+		http.Error(w, errServerClosed.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	inst.requests.Add(1)
+	inst.inflight.Unlock()
+	defer inst.requests.Done()
+
+	inst.RLock()
+	maxBytes, maxBatch, strict := inst.maxRequestBytes, inst.maxBatchSize, inst.strict
+	connectionTypes, downgradeAfter := inst.connectionTypes, inst.downgradeAfter
+	plugged := inst.marshal // or the default encoder of the responses if nil
+	compress, compressMin := inst.compress, inst.compressMin
+	inst.RUnlock()
+	marshal, unmarshal := inst.codec()
+
+	if inst.handleCORS(w, r) {
+		return
+	}
+	if !hasConnectionType(connectionTypes, "long-polling") {
+		http.Error(w, "Long-Polling is disabled.", http.StatusBadRequest)
+		return
+	}
 	if r.Method != "POST" {
 		http.Error(w, "Long-Polling only supports POST method.", http.StatusBadRequest)
 		return
 	}
 
+	if maxBytes > 0 {
+		r.Body = http.MaxBytesReader(w, r.Body, maxBytes)
+	}
 	data, err := ioutil.ReadAll(r.Body)
-	if err != nil {
+	if err != nil && maxBytes > 0 && int64(len(data)) >= maxBytes {
+		http.Error(w, "Request is too large.", http.StatusRequestEntityTooLarge)
+		return
+	} else if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
 	var messages []*MetaMessage
-	err = json.Unmarshal(data, &messages)
-	if err != nil {
+	if err = unmarshal(data, &messages); err == nil && len(messages) == 0 {
+		err = errNoMessage
+	}
+	if err != nil && strict {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
+	} else if err != nil { // answered in the way Bayeux clients understand
+		inst.logger.Infof("Bad request: %v", err)
+		w.Header().Set("Content-Type", "application/json;charset=UTF-8")
+		data, _ = marshal([]*MetaMessage{{
+			Channel: "/meta/unknown",
+			Error:   (&Error{400, nil, err.Error()}).String(),
+		}})
+		w.Write(data)
+		return
 	}
-	if len(messages) == 0 {
-		http.Error(w, "Found no message.", http.StatusBadRequest)
+	if maxBatch > 0 && len(messages) > maxBatch {
+		http.Error(w, "Too many messages in a batch.", http.StatusBadRequest)
 		return
 	}
 	data = nil
-	// log.Printf("Received requests: %v", messages)
+	// inst.logger.Debugf("Received requests: %v", messages)
+
+	inst.RLock()
+	idle, streaming, fastPath := inst.options.timeout, inst.streaming, inst.fastPath
+	envelope := inst.envelope
+	fastAdvice, timeoutAdvice := inst.fastAdvice, inst.timeoutAdvice
+	subscribeAdvice := inst.subscribeAdvice
+	maxMessage := inst.maxMessageBytes
+	advice := defaultAdvice(inst.advice, idle)
+	hold, early := idle/2, false // early if the hold is cut by the poll timeout
+	if inst.pollTimeout > 0 && inst.pollTimeout < hold {
+		hold, early = inst.pollTimeout, true
+	}
+	inst.RUnlock()
+	// a copy of the default advice, which may be overridden per response
+	adviceWith := func(reconnect string) *Advice {
+		a := advice
+		if reconnect != "" {
+			a.Reconnect = reconnect
+		}
+		return &a
+	}
+	// a failed client-scoped operation, where an unknown client is
+	// advised to handshake again instead of retrying forever
+	fail := func(response *MetaMessage, clientId, channel string, err error) {
+		response.Error = errorOf(clientId, channel, err).String()
+		if err == errUnknownClient {
+			response.Advice = adviceWith("handshake")
+		}
+	}
+	// (un)subscribe each channel of a subscription like "/foo,/bar",
+	// whose results are told in the ext if there're more than one, and
+	// the response is successful only if all of them are. It returns the
+	// messages piggybacked on them.
+	eachChannel := func(response, message *MetaMessage, operation func(clientId, channel string) (chan *Message, error)) (all []chan *Message, ok bool) {
+		channels := splitSubscription(message.Subscription)
+		results := make([]*subscriptionResult, len(channels))
+		var failed error
+		var failedChannel string
+		for i, channel := range channels {
+			results[i] = &subscriptionResult{Subscription: channel}
+			if events, err := operation(message.ClientId, channel); err == nil {
+				inst.logger.Debugf("[%8.8v]success.", message.ClientId)
+				all = append(all, events)
+				results[i].Successful = true
+			} else {
+				inst.logger.Infof("[%8.8v]fail: %v", message.ClientId, err)
+				results[i].Error = errorOf(message.ClientId, channel, err).String()
+				if failed == nil {
+					failed, failedChannel = err, channel
+				}
+			}
+		}
+		if len(channels) > 1 {
+			response.Extension = map[string]interface{}{"subscriptions": results}
+		}
+		if failed != nil {
+			fail(response, message.ClientId, failedChannel, failed)
+			return all, false
+		}
+		response.Successful = true
+		return all, true
+	}
+	// a client failing to connect repeatedly by a connection type is
+	// advised to handshake again for another one, if any
+	downgrade := func(response *MetaMessage, failures int, failing string) {
+		if downgradeAfter <= 0 || failures < downgradeAfter {
+			return
+		}
+		if fallback := fallbackConnectionType(connectionTypes, failing); fallback != "" {
+			inst.logger.Infof("[%8.8v]%v connects failed, downgrading to %v.", response.ClientId, failures, fallback)
+			response.Advice = adviceWith("handshake")
+			response.Advice.ConnectionType = fallback
+		}
+	}
 
 	w.Header().Set("Content-Type", "application/json;charset=UTF-8")
-	w.WriteHeader(http.StatusOK)
+	if compress {
+		w.Header().Add("Vary", "Accept-Encoding")
+	}
+	out := &responseWriter{
+		w:        w,
+		accepted: compress && acceptsGzip(r.Header.Get("Accept-Encoding")),
+		minBytes: compressMin,
+	}
+	defer out.Close()
 
 	var responses []*MetaMessage
 	var allEvents []chan *Message
 	var waiting chan *Message
 	var timeout chan bool // notify uptream chanel to stop
 	var clientId string   // client ID for connect message
+	var connectResponse *MetaMessage
 	for _, message := range messages {
 		var events chan *Message
 		var ok bool
 		var response = &MetaMessage{}
 		switch message.Channel {
 		case "/meta/handshake":
-			log.Println("Handshaking...")
+			inst.logger.Debugf("Handshaking...")
 			response.Channel = "/meta/handshake"
 			response.Id = message.Id
-			response.Advice = &Advice{
-				Reconnect: "retry",
-				Interval:  DEFAULT_INTERVAL,
-				Timeout:   1000 * int64(MAX_SESSION_IDEL.Seconds()),
-			}
-			if clientId, err := inst.handshake(); err == nil {
+			response.Advice = adviceWith("")
+			resume, resuming := parseResume(message.Extension)
+			types := negotiateConnectionTypes(connectionTypes, message.SupportedConnectionTypes)
+			if len(types) == 0 {
+				inst.logger.Infof("Unsupported connection types: %v", message.SupportedConnectionTypes)
+				response.Version = VERSION
+				response.SupportedConnectionTypes = connectionTypes
+				response.Error = UnsupportedConnectionTypesError(message.SupportedConnectionTypes).String()
+				response.Advice = adviceWith("none")
+			} else if resuming && inst.resume(resume.ClientId, resume.Token) {
+				inst.logger.Infof("[%8.8v]Session resumed.", resume.ClientId)
 				response.Version = VERSION
-				response.SupportedConnectionTypes = []string{"long-polling"}
+				response.SupportedConnectionTypes = types
+				response.ClientId = resume.ClientId
+				response.Successful = true
+				response.Extension = map[string]interface{}{
+					"resume": &resumeInfo{Token: resume.Token, Resumed: true},
+				}
+			} else if clientId, err := inst.handshakeWithToken(resume.Token, parseNoReplay(message.Extension)); err == nil {
+				response.Version = VERSION
+				response.SupportedConnectionTypes = types
 				response.ClientId = clientId
 				response.Successful = true
+				response.Extension = map[string]interface{}{
+					"resume": &resumeInfo{Token: inst.resumeToken(clientId)},
+				}
 			} else {
-				response.Error = err.Error()
+				response.Error = UnavailableError(err).String()
+				if err == errTooManyClients {
+					inst.logger.Infof("Handshake is rejected: %v", err)
+					response.Advice = adviceWith("handshake")
+					response.Advice.Interval = int(HANDSHAKE_RETRY_INTERVAL / time.Millisecond)
+				}
 			}
 		case "/meta/connect":
-			log.Printf("[%8.8v]Connecting...", message.ClientId)
+			inst.logger.Debugf("[%8.8v]Connecting...", message.ClientId)
 			response.Channel = "/meta/connect"
 			response.ClientId = message.ClientId
 			response.Id = message.Id
 			var ch chan bool
-			if events, ch, ok = inst.connect(message.ClientId); ok && waiting == nil {
-				// only one connect message is allowed
+			if message.ConnectionType != "" && message.ConnectionType != "long-polling" {
+				// negotiated for another transport
+				response.Error = UnsupportedConnectionTypesError([]string{message.ConnectionType}).String()
+				response.Advice = adviceWith("handshake")
+				downgrade(response, inst.countConnect(message.ClientId, false), message.ConnectionType)
+			} else if connectResponse != nil {
+				// only one connect message is allowed, the others are
+				// answered without touching the held one
+				inst.logger.Infof("[%8.8v]Duplicate connect.", message.ClientId)
+				response.Error = DuplicateConnectError(message.ClientId).String()
+				response.Advice = adviceWith("retry")
+			} else if events, ch, err = inst.connect(message.ClientId); err == nil {
 				clientId = message.ClientId
 				waiting, timeout = events, ch
+				connectResponse = response
 				response.Successful = true
-				response.Advice = &Advice{
-					Reconnect: "retry",
-					Interval:  DEFAULT_INTERVAL,
-					Timeout:   1000 * int64(MAX_SESSION_IDEL.Seconds()),
-				}
+				response.Advice = adviceWith("")
+			} else if err == errChannelTimeout {
+				inst.logger.Infof("[%8.8v]%v", message.ClientId, err)
+				response.Error = UnavailableError(err).String()
+				response.Advice = adviceWith("retry")
 			} else {
-				log.Printf("[%8.8v]Client ID not found.", message.ClientId)
-				response.Advice = &Advice{
-					Reconnect: "handshake",
-					Interval:  DEFAULT_INTERVAL,
-					Timeout:   1000 * int64(MAX_SESSION_IDEL.Seconds()),
-				}
+				inst.logger.Infof("[%8.8v]Client ID not found.", message.ClientId)
+				fail(response, message.ClientId, message.Channel, errUnknownClient)
 			}
 		case "/meta/disconnect":
 			response.Channel = "/meta/disconnect"
@@ -172,57 +427,151 @@ func (inst *Instance) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			if events, ok = inst.disconnect(message.ClientId); ok {
 				allEvents = append(allEvents, events)
 				response.Successful = true
+			} else {
+				fail(response, message.ClientId, message.Channel, errUnknownClient)
 			}
 		case "/meta/subscribe":
-			log.Printf("[%8.8v]Subscribing to %v...", message.ClientId, message.Subscription)
+			inst.logger.Debugf("[%8.8v]Subscribing to %v...", message.ClientId, message.Subscription)
 			response.Channel = "/meta/subscribe"
 			response.ClientId = message.ClientId
 			response.Subscription = message.Subscription
 			response.Id = message.Id
-			if events, ok = inst.subscribe(message.ClientId, message.Subscription); ok {
-				log.Printf("[%8.8v]success.", message.ClientId)
-				allEvents = append(allEvents, events)
-				response.Successful = true
-			} else {
-				log.Printf("[%8.8v]fail.", message.ClientId)
+			events, ok := eachChannel(response, message, inst.subscribe)
+			allEvents = append(allEvents, events...)
+			if ok && subscribeAdvice != nil {
+				response.Advice = connectAdvice(advice, subscribeAdvice)
 			}
 		case "/meta/unsubscribe":
 			response.Channel = "/meta/unsubscribe"
 			response.ClientId = message.ClientId
 			response.Subscription = message.Subscription
 			response.Id = message.Id
-			if events, ok = inst.unsubscribe(message.ClientId, message.Subscription); ok {
-				allEvents = append(allEvents, events)
-				response.Successful = true
-			}
+			events, _ := eachChannel(response, message, inst.unsubscribe)
+			allEvents = append(allEvents, events...)
 		default:
 			if message.Data != nil { // publish
 				response.Channel = message.Channel
 				response.Id = message.Id
-				if message.ClientId == "" { // whisper
-					log.Printf("Whispering '%v' to '%v'...", message.Data, message.Channel)
-					inst.whisper(message.Channel, string(message.Data))
-					response.Successful = true
-				} else if events, ok = inst.publish(message.ClientId, message.Channel, string(message.Data)); ok {
-					allEvents = append(allEvents, events)
-					response.Successful = true
+				if err := validateChannel(message.Channel); err != nil {
+					response.Error = InvalidChannelError(message.Channel, err).String()
+				} else if isWildcard(message.Channel) {
+					response.Error = InvalidChannelError(message.Channel, errWildcardPublish).String()
+				} else if strings.HasPrefix(message.Channel, "/meta/") {
+					response.Error = InvalidChannelError(message.Channel, errMetaPublish).String()
+				} else if maxMessage > 0 && len(message.Data) > maxMessage {
+					inst.logger.Infof("[%8.8v]Publish of %v bytes to '%v' is too large.", message.ClientId, len(message.Data), message.Channel)
+					response.Error = MessageTooLargeError(message.Channel).String()
+				} else if message.ClientId == "" { // whisper
+					inst.logger.Debugf("Whispering '%s' to '%v'...", message.Data, message.Channel)
+					if wait, err := inst.publishAnonymous(message.Channel, message.Data); err == nil {
+						response.Successful = true
+					} else {
+						fail(response, "", message.Channel, err)
+						if err == errRateLimited {
+							response.Advice = adviceWith("retry")
+							response.Advice.Interval = int(wait / time.Millisecond)
+						}
+					}
+				} else if allowed, wait := inst.limiter.allow(message.ClientId); !allowed {
+					inst.logger.Infof("[%8.8v]Publish to '%v' is throttled.", message.ClientId, message.Channel)
+					response.Error = TooManyRequestsError(message.Channel).String()
+					response.Advice = adviceWith("retry")
+					response.Advice.Interval = int(wait / time.Millisecond)
+				} else {
+					var err error
+					options := parsePublishOptions(message.Extension)
+					if handler, params, named, isService := inst.service(message.Channel); isService {
+						message.Params, message.NamedParams = params, named
+						events, err = inst.callService(handler, message)
+					} else if chunk, isChunk := parseChunk(message.Extension); isChunk {
+						events, err = inst.publishChunk(message.ClientId, message.Channel, chunk, message.Data, options)
+					} else {
+						events, err = inst.publish(message.ClientId, message.Channel, message.Data, options)
+					}
+					if err == nil {
+						allEvents = append(allEvents, events)
+						response.Successful = true
+					} else {
+						fail(response, message.ClientId, message.Channel, err)
+					}
 				}
 			} else { // invalid requests
 				response.Channel = message.Channel
 				response.Id = message.Id
 				response.Successful = false
-				response.Error = fmt.Sprintf("400:%v:Bad request", message.Channel)
+				response.Error = BadRequestError(message.Channel).String()
 			}
 		}
 		responses = append(responses, response)
 	}
 	messages = nil
 
+	var opening, closing = "[", "]"
+	if envelope {
+		opening = `{"messages":[`
+	}
+
+	// the output is encoded in a pooled buffer, and written once the
+	// events are collected, or once it grows over FLUSH_THRESHOLD
+	buf := bufferPool.Get().(*bytes.Buffer)
+	buf.Reset()
+	defer func() {
+		if buf.Cap() <= MAX_POOLED_BUFFER { // don't keep a huge one
+			bufferPool.Put(buf)
+		}
+	}()
+	encode := newBufferEncoder(buf, plugged)
+	var isFirst = true
+	write := func(v interface{}) {
+		if isFirst {
+			buf.WriteString(opening)
+			isFirst = false
+		} else {
+			buf.WriteByte(',')
+		}
+		encode(v)
+	}
+	// the response is always chunked once flushed, without Content-Length
+	flush := func() {
+		out.Write(buf.Bytes())
+		buf.Reset()
+		out.Flush()
+	}
+
+	if streaming && waiting != nil {
+		// flush other responses before holding the connect
+		for _, resp := range responses {
+			if resp != connectResponse {
+				write(resp)
+			}
+		}
+		responses = []*MetaMessage{connectResponse}
+		flush()
+	}
+
+	// the messages piggybacked on the other responses are older than
+	// those of the connect
 	var events []*Message
-	if waiting != nil { // it's a connect message
+	for _, ch := range allEvents {
+		for event := range ch {
+			events = append(events, event)
+		}
+	}
+	if waiting != nil && (len(events) > 0 || fastPath && len(waiting) > 0) {
+		// the backlog is returned right away without holding
+		inst.logger.Debugf("[%8.8v]Returning %v pending events...", clientId, len(waiting))
+		for backlog := len(waiting); backlog > 0; backlog-- {
+			events = append(events, <-waiting)
+		}
+		timeout <- true
+		for event := range waiting {
+			events = append(events, event)
+		}
+	} else if waiting != nil { // it's a connect message
+		var gone = r.Context().Done() // the client is gone
 		var event *Message
-		var remaining = start.Add(MAX_SESSION_IDEL / 2).Sub(time.Now())
-		log.Printf("[%8.8v]Listening for %v seconds...", clientId, remaining.Seconds())
+		var remaining = start.Add(hold).Sub(time.Now())
+		inst.logger.Debugf("[%8.8v]Listening for %v seconds...", clientId, remaining.Seconds())
 		var isDone = false
 		// wait for at least one event first
 		select {
@@ -234,56 +583,695 @@ func (inst *Instance) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			// timeout and should return immediately
 			timeout <- true
 			isDone = true
+		case <-gone:
+			timeout <- true
+			isDone = true
 		}
 
-		// wait for another second to see if other events come
-		// otherwise, notify the upstream channel to stop sending more
-		// but no more than half of the max idle time
-		var renew = make(chan bool)
-		go func(isWaiting bool) {
-			for isWaiting {
-				remaining := start.Add(MAX_SESSION_IDEL / 2).Sub(time.Now())
-				log.Printf("[%8.8v]Wait for %v more seconds...", clientId, remaining.Seconds())
+		// wait for another second to see if other events come, but no
+		// more than the hold time, then notify the upstream channel to
+		// stop sending more
+		if !isDone {
+			deadline := start.Add(hold)
+			if window := time.Now().Add(BATCH_WINDOW); window.Before(deadline) {
+				deadline = window
+			}
+			timer := time.NewTimer(deadline.Sub(time.Now()))
+		collect:
+			for {
 				select {
-				case <-time.After(remaining):
+				case event, ok := <-waiting:
+					if !ok { // closed by the session
+						break collect
+					}
+					events = append(events, event)
+				case <-timer.C:
 					timeout <- true
-					isWaiting = false
-				case <-time.After(1 * time.Second):
+					break collect
+				case <-gone:
 					timeout <- true
-					isWaiting = false
-				case <-renew:
-					// do nothing
+					break collect
 				}
 			}
-		}(!isDone)
+			timer.Stop()
+		}
 
 		for event := range waiting {
 			events = append(events, event)
-			if !isDone {
-				renew <- true
-			}
 		}
-		log.Printf("[%8.8v]%v events collected.", clientId, len(events))
+		inst.logger.Debugf("[%8.8v]%v events collected.", clientId, len(events))
+
+		if r.Context().Err() != nil {
+			inst.logger.Infof("[%8.8v]Client is gone, returning %v events.", clientId, len(events))
+			inst.closeAndReturn(clientId, events)
+			inst.countConnect(clientId, false)
+			return
+		}
+	}
+	if connectResponse != nil && connectResponse.Successful {
+		if len(events) > 0 {
+			connectResponse.Advice = connectAdvice(advice, fastAdvice)
+		} else if early { // reconnect right away to keep polling
+			connectResponse.Advice = connectAdvice(advice, &Advice{Interval: 0})
+		} else {
+			connectResponse.Advice = connectAdvice(advice, timeoutAdvice)
+		}
+		if reconnect := inst.takeAdvice(clientId); reconnect != "" {
+			inst.logger.Infof("[%8.8v]Advised to %v.", clientId, reconnect)
+			connectResponse.Advice.Reconnect = reconnect
+		}
+		inst.countConnect(clientId, true)
 	}
 
-	fmt.Fprintf(w, "[")
 	if len(events) > 0 {
-		log.Printf("[%8.8v]Collected %v event messages.", clientId, len(events))
+		inst.logger.Debugf("[%8.8v]Collected %v event messages.", clientId, len(events))
+		var em EventMessage // reused for all the events
 		for _, event := range events {
-			data, _ = json.Marshal(&EventMessage{
-				Channel: event.channel,
-				Data:    event.data,
-			})
-			fmt.Fprintf(w, "%s,", data)
+			em = EventMessage{
+				Channel:   event.channel,
+				Data:      event.data,
+				ClientId:  event.clientId,
+				Timestamp: formatTimestamp(event.timestamp),
+				Extension: traceExtension(event.trace),
+			}
+			write(&em)
+			if buf.Len() >= FLUSH_THRESHOLD {
+				flush()
+			}
+		}
+		// a big batch is seen by the client before the responses
+		flush()
+	}
+	if envelope {
+		closing = "]}"
+		if advice := hoistAdvice(responses); advice != nil {
+			data, _ := marshal(advice)
+			closing = fmt.Sprintf(`],"advice":%s}`, data)
 		}
 	}
-	for _, resp := range responses[:len(responses)-1] {
-		data, _ = json.Marshal(resp)
-		fmt.Fprintf(w, "%s,", data)
+	for _, resp := range responses {
+		write(resp)
 	}
-	data, _ = json.Marshal(responses[len(responses)-1])
-	fmt.Fprintf(w, "%s]", data)
-	log.Printf("[%8.8v]Request is processd.", clientId)
+	buf.WriteString(closing)
+	out.Write(buf.Bytes())
+	inst.logger.Debugf("[%8.8v]Request is processd.", clientId)
+}
+
+/*
+Shutdown the instance gracefully. It stops accepting new requests,
+closes all the sessions, and then waits for the in-flight requests to
+return until the context is done.
+*/
+func (inst *Instance) Shutdown(ctx context.Context) error {
+	inst.inflight.Lock()
+	inst.shuttingDown = true
+	inst.inflight.Unlock()
+
+	inst.shutdown()
+
+	done := make(chan bool)
+	go func() {
+		inst.requests.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+/*
+Move the advice shared by all the advised responses out of them, and
+return it. Those advising differently keep their own.
+*/
+func hoistAdvice(responses []*MetaMessage) (advice *Advice) {
+	for _, resp := range responses {
+		if resp.Advice != nil {
+			if advice == nil {
+				advice = resp.Advice
+			}
+			if *resp.Advice == *advice {
+				resp.Advice = nil
+			}
+		}
+	}
+	return
+}
+
+/*
+Set the maximum time to wait for a busy session to hand over its
+channel. It only affects sessions created afterwards.
+*/
+func (inst *Instance) SetChannelWait(d time.Duration) *Instance {
+	inst.Lock()
+	defer inst.Unlock()
+	inst.options.wait = d
+	return inst
+}
+
+/*
+Set the generator of client IDs, e.g. for shorter IDs than the default
+UUIDs. A generated ID conflicting with a live one is retried up to
+MAX_ID_GEN_RETRY times before the handshake fails.
+*/
+func (inst *Instance) SetIdGenerator(f func() string) *Instance {
+	inst.names.setGenerator(f)
+	return inst
+}
+
+/*
+Set how long a client ID is kept from being reused since the client's
+last activity. It should be longer than the session timeout, so that a
+live client never loses its ID. Default is MAX_ID_KEPT_TIME.
+*/
+func (inst *Instance) SetIdRetention(d time.Duration) *Instance {
+	inst.names.setRetention(d)
+	return inst
+}
+
+/*
+Set the maximum idle time of a session, after which the session is
+considered as disconnected. A long-polling connect is held for at most
+half of it. It only affects sessions created afterwards.
+*/
+func (inst *Instance) SetSessionTimeout(d time.Duration) *Instance {
+	inst.Lock()
+	defer inst.Unlock()
+	inst.options.timeout = d
+	return inst
+}
+
+/*
+Set the maximum lifetime of a session regardless of its activity, after
+which the client is advised to handshake again. Zero means unlimited.
+It only affects sessions created afterwards.
+*/
+func (inst *Instance) SetSessionLifetime(d time.Duration) *Instance {
+	inst.Lock()
+	defer inst.Unlock()
+	inst.options.lifetime = d
+	return inst
+}
+
+/*
+Set the number of messages buffered between the broker and each
+session, CLIENT_BUFFER by default, so that broadcast doesn't wait for
+a session momentarily busy. Once the buffer is full, the message is
+dropped, or broadcast waits under the Block policy of SetMailbox. It
+only affects sessions created afterwards.
+*/
+func (inst *Instance) SetClientBuffer(n int) *Instance {
+	inst.Lock()
+	defer inst.Unlock()
+	if n < 0 {
+		n = 0
+	}
+	inst.broker.local().setClientBuffer(n)
+	return inst
+}
+
+/*
+Set the maximum number of clients, as a guard against a handshake flood
+exhausting the memory. Beyond it, handshake fails with advice to retry
+later. The existing sessions are kept if it's lowered. It's unlimited if
+0, the default.
+*/
+func (inst *Instance) SetMaxClients(n int) *Instance {
+	inst.Lock()
+	defer inst.Unlock()
+	inst.maxClients = n
+	return inst
+}
+
+/*
+Match the channels case-insensitively, e.g. a subscription to /Foo
+matches a publish to /foo, which are both taken as /foo. By default,
+they're case-sensitive as Bayeux specifies. It only affects the
+subscriptions made afterwards, so it should be set before any client
+subscribes.
+*/
+func (inst *Instance) SetCaseInsensitiveChannels(fold bool) *Instance {
+	b := inst.broker.local()
+	b.Lock()
+	b.foldCase = fold
+	b.Unlock()
+	b.router.setFoldCase(fold)
+	return inst
+}
+
+/*
+Set the maximum number of channels a client may subscribe to, as a
+guard against a client blowing up the router. Beyond it, subscribe
+fails with an error. It's unlimited if 0, the default.
+*/
+func (inst *Instance) SetMaxSubscriptionsPerClient(n int) *Instance {
+	inst.Lock()
+	defer inst.Unlock()
+	inst.broker.local().setMaxSubscriptions(n)
+	return inst
+}
+
+/*
+Set the maximum number of unsent messages kept in a session's mailbox,
+and what to do with new messages once it's full. The Block policy
+also makes broadcast wait for slow clients instead of dropping
+messages. It only affects sessions created afterwards.
+*/
+func (inst *Instance) SetMailbox(size int, policy OverflowPolicy) *Instance {
+	inst.Lock()
+	defer inst.Unlock()
+	inst.options.mailbox = size
+	inst.options.overflow = policy
+	inst.broker.local().setBlocking(policy == Block)
+	return inst
+}
+
+/*
+Set the maximum time to keep an unsent message in a session's mailbox.
+The messages older than that are dropped instead of replayed when the
+client reconnects. Zero means unlimited. It only affects sessions
+created afterwards.
+*/
+func (inst *Instance) SetMessageTTL(d time.Duration) *Instance {
+	inst.Lock()
+	defer inst.Unlock()
+	inst.options.ttl = d
+	return inst
+}
+
+/*
+Enable the streaming mode, in which the responses other than connect
+are flushed to the client before the connect is held for events. It
+relies on the transport to deliver a partial response, e.g. chunked
+encoding.
+*/
+func (inst *Instance) SetStreaming(enabled bool) *Instance {
+	inst.Lock()
+	defer inst.Unlock()
+	inst.streaming = enabled
+	return inst
+}
+
+/*
+Set the logger, which discards everything by default.
+*/
+func (inst *Instance) SetLogger(logger Logger) *Instance {
+	inst.logger.set(logger)
+	return inst
+}
+
+/*
+Enable the envelope mode, in which the response is a single JSON object
+like {"messages":[...],"advice":{...}} instead of a bare array. The
+advice common to the responses is hoisted to the envelope.
+*/
+func (inst *Instance) SetEnvelope(enabled bool) *Instance {
+	inst.Lock()
+	defer inst.Unlock()
+	inst.envelope = enabled
+	return inst
+}
+
+/*
+Enable the fast path of connect, which returns the pending messages
+right away if there is any, instead of holding for more messages.
+*/
+func (inst *Instance) SetConnectFastPath(enabled bool) *Instance {
+	inst.Lock()
+	defer inst.Unlock()
+	inst.fastPath = enabled
+	return inst
+}
+
+/*
+Fan out the messages to other nodes through Redis pub/sub, so that the
+clients connected to different nodes can talk to each other. It should
+be called before serving any request.
+*/
+func (inst *Instance) UseRedis(config RedisConfig) *Instance {
+	inst.Lock()
+	defer inst.Unlock()
+	inst.broker.close()
+	inst.broker = newRedisBroker(config, inst.broker.local())
+	return inst
+}
+
+/*
+Set the security policy consulted on every subscribe and publish.
+*/
+func (inst *Instance) SetSecurityPolicy(policy SecurityPolicy) *Instance {
+	inst.Lock()
+	defer inst.Unlock()
+	inst.policy = policy
+	return inst
+}
+
+/*
+Cache the last size results of the security policy for ttl, so that
+an expensive policy isn't consulted on every subscribe and publish.
+The cached results of a client are dropped once it disconnects, or
+explicitly via InvalidateAuth.
+*/
+func (inst *Instance) SetAuthCache(size int, ttl time.Duration) *Instance {
+	inst.Lock()
+	defer inst.Unlock()
+	inst.authCache = newAuthCache(size, ttl)
+	return inst
+}
+
+/*
+Publish the data to the subscribers of the channel from the server
+side. The data is encoded as JSON unless it's a json.RawMessage
+already. It's safe to be called concurrently at any time.
+
+The channel may also be a wildcard like /foo/*, which publishes to all
+the matching channels at once. See Broker.broadcastPattern for how the
+copies are delivered. Clients can't publish to wildcard channels.
+
+The options may exclude some clients from the delivery. There's no
+sender to exclude for a publish from the server side.
+*/
+func (inst *Instance) Publish(channel string, data interface{}, options ...PublishOptions) error {
+	raw, err := inst.marshalData(data)
+	if err != nil {
+		return err
+	}
+	return inst.whisper(channel, raw, options...)
+}
+
+/*
+Publish the items to the channel from the server side, each delivered
+as a separate event in order. The subscribers are resolved only once
+for the whole batch, which is cheaper than publishing them one by one.
+Nothing is published if any item fails to be marshalled.
+*/
+func (inst *Instance) PublishBatch(channel string, items []interface{}, options ...PublishOptions) error {
+	data := make([]json.RawMessage, len(items))
+	for i, item := range items {
+		var err error
+		if data[i], err = inst.marshalData(item); err != nil {
+			return err
+		}
+	}
+	return inst.whisperBatch(channel, data, options...)
+}
+
+// marshal the data to JSON by the codec unless it's a json.RawMessage
+// already
+func (inst *Instance) marshalData(data interface{}) (json.RawMessage, error) {
+	if raw, ok := data.(json.RawMessage); ok {
+		return raw, nil
+	}
+	marshal, _ := inst.codec()
+	return marshal(data)
+}
+
+func formatTimestamp(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format(TIMESTAMP_FORMAT)
+}
+
+/*
+Replace the source of the message timestamps, e.g. with a fake clock
+in tests.
+*/
+func (inst *Instance) SetTimestampSource(now func() time.Time) *Instance {
+	b := inst.broker.local()
+	b.Lock()
+	defer b.Unlock()
+	b.now = now
+	return inst
+}
+
+/*
+Add a filter to redact or enrich the messages centrally before they're
+delivered to the subscribers, or drop them by returning false. The
+filters run once per broadcast in the order they're added.
+*/
+func (inst *Instance) AddMessageFilter(filter func(channel string, data string) (string, bool)) *Instance {
+	inst.broker.local().addFilter(filter)
+	return inst
+}
+
+/*
+Set the maximum time to hold a connect waiting for events, so that the
+poll completes before the idle connections are cut by proxies. A
+connect returned empty because of it advises the client to reconnect
+right away. It's half of the session timeout if 0, which is the
+default, and can't exceed that.
+*/
+func (inst *Instance) SetPollTimeout(d time.Duration) *Instance {
+	inst.Lock()
+	defer inst.Unlock()
+	inst.pollTimeout = d
+	return inst
+}
+
+/*
+Set whether to reject a malformed request, e.g. of invalid JSON or no
+message, with HTTP status 400. By default it's answered with status
+200 and a single unsuccessful message on /meta/unknown carrying the
+error, since Bayeux clients treat a non-200 status as a transport
+failure.
+*/
+func (inst *Instance) SetStrict(enabled bool) *Instance {
+	inst.Lock()
+	defer inst.Unlock()
+	inst.strict = enabled
+	return inst
+}
+
+/*
+Limit the size of a request body, so that a huge request can't exhaust
+the memory. The exceeding requests are rejected with 413. It's
+unlimited if n is 0, which is the default.
+*/
+func (inst *Instance) SetMaxRequestBytes(n int64) *Instance {
+	inst.Lock()
+	defer inst.Unlock()
+	inst.maxRequestBytes = n
+	return inst
+}
+
+/*
+Advise a client to handshake again for another connection type once n
+of its connects fail in a row, e.g. by an unsupported transport, or by
+the client gone before a connect returns. The advice is like
+{"reconnect":"handshake","connectionType":"long-polling"}, naming the
+first enabled connection type other than the failing one, and it's not
+given if there's none. It's 3 by default, and never if n is 0.
+*/
+func (inst *Instance) SetDowngradeThreshold(n int) *Instance {
+	inst.Lock()
+	defer inst.Unlock()
+	inst.downgradeAfter = n
+	return inst
+}
+
+/*
+Limit the size of the data of a published message, so that a huge one
+isn't copied into every subscriber's mailbox, even in a small request.
+The exceeding messages are rejected with a 413 error and not broadcast,
+while a chunked message is limited by each of its chunks. It's
+unlimited if n is 0, which is the default.
+*/
+func (inst *Instance) SetMaxMessageBytes(n int) *Instance {
+	inst.Lock()
+	defer inst.Unlock()
+	inst.maxMessageBytes = n
+	return inst
+}
+
+/*
+Limit the number of messages in a request. The exceeding requests are
+rejected with 400. It's unlimited if n is 0, which is the default.
+*/
+func (inst *Instance) SetMaxBatchSize(n int) *Instance {
+	inst.Lock()
+	defer inst.Unlock()
+	inst.maxBatchSize = n
+	return inst
+}
+
+/*
+Set the advice of the connects returned with events, e.g. by the fast
+path, and those returned after an empty hold respectively, so that the
+clients reconnect promptly when there's a backlog but back off
+otherwise. An empty reconnect or timeout falls back to the default, and
+a nil advice restores the default one.
+*/
+func (inst *Instance) SetConnectAdvice(fast, timeout *Advice) *Instance {
+	inst.Lock()
+	defer inst.Unlock()
+	inst.fastAdvice, inst.timeoutAdvice = fast, timeout
+	return inst
+}
+
+/*
+Set the advice of the successful subscribes, e.g. to steer the clients
+to another interval once they're subscribed. An empty reconnect or
+timeout falls back to the default, and a nil advice, the default,
+attaches none.
+*/
+func (inst *Instance) SetSubscribeAdvice(advice *Advice) *Instance {
+	inst.Lock()
+	defer inst.Unlock()
+	inst.subscribeAdvice = advice
+	return inst
+}
+
+/*
+Set the default advice of the handshake and connect responses, e.g. a
+positive interval to throttle reconnect storms, or "none" to stop the
+clients from reconnecting. An empty reconnect falls back to "retry",
+and a zero timeout falls back to the session timeout. The
+advice specific to a response, e.g. to handshake again for an unknown
+client, still overrides it.
+*/
+func (inst *Instance) SetAdvice(advice Advice) *Instance {
+	inst.Lock()
+	defer inst.Unlock()
+	inst.advice = advice
+	return inst
+}
+
+func defaultAdvice(configured Advice, idle time.Duration) Advice {
+	advice := Advice{
+		Reconnect: "retry",
+		Interval:  DEFAULT_INTERVAL,
+		Timeout:   1000 * int64(idle.Seconds()),
+	}
+	if configured.Interval > 0 {
+		advice.Interval = configured.Interval
+	}
+	if configured.Reconnect != "" {
+		advice.Reconnect = configured.Reconnect
+	}
+	if configured.Timeout > 0 {
+		advice.Timeout = configured.Timeout
+	}
+	return advice
+}
+
+func connectAdvice(defaults Advice, custom *Advice) *Advice {
+	advice := &defaults
+	if custom != nil {
+		advice.Interval = custom.Interval
+		if custom.Reconnect != "" {
+			advice.Reconnect = custom.Reconnect
+		}
+		if custom.Timeout > 0 {
+			advice.Timeout = custom.Timeout
+		}
+	}
+	return advice
+}
+
+/*
+Disconnect the client from the server side, e.g. to kick a misbehaving
+one. Its pending messages are discarded, reported as undelivered, and
+the next connect of the client is advised to handshake again. It
+returns false if the client doesn't exist.
+*/
+func (inst *Instance) Disconnect(clientId string) bool {
+	ch, ok := inst.disconnect(clientId)
+	if ok {
+		inst.logger.Infof("[%8.8v]Disconnected by the server.", clientId)
+		inst.discard(clientId, ch)
+	}
+	return ok
+}
+
+/*
+Advise the client to reconnect by "retry", "handshake" or "none" in its
+next connect response, e.g. to handshake again after a config reload.
+The advice is sent only once, by the held connect if any once it
+returns, overriding the default one. It returns false if the client
+doesn't exist, or the advice is unknown.
+*/
+func (inst *Instance) AdviseReconnect(clientId, reconnect string) bool {
+	switch reconnect {
+	case "retry", "handshake", "none":
+	default:
+		inst.logger.Errorf("[%8.8v]Unknown reconnect advice: %v", clientId, reconnect)
+		return false
+	}
+	inst.RLock()
+	ss, ok := inst.sessions[clientId]
+	inst.RUnlock()
+	if ok {
+		ss.setAdvice(reconnect)
+	}
+	return ok
+}
+
+/*
+Call the callback once a session is closed, e.g. to release the external
+resources tied to the client. It's called on its own goroutine, after
+the session has ended, for any reason including the server shutdown.
+*/
+func (inst *Instance) OnSessionClosed(callback func(clientId string, reason CloseReason)) *Instance {
+	inst.Lock()
+	defer inst.Unlock()
+	inst.onClosed = callback
+	return inst
+}
+
+/*
+Call the callback with the messages never delivered to a client, e.g.
+to forward them to a dead-letter queue. It's called with those left in
+the mailbox once the session times out, expires or is disconnected by
+the server, and with those returned by a poll after the session is
+gone. It's never called on the goroutine of a session, but it should
+return promptly. The messages kept for resuming after a shutdown are
+not reported.
+*/
+func (inst *Instance) OnUndelivered(callback func(clientId string, msgs []*Message)) *Instance {
+	inst.Lock()
+	defer inst.Unlock()
+	inst.onUndelivered = callback
+	return inst
+}
+
+/*
+Call the callback once the mailbox of a client holds as many messages as
+the high-water mark, e.g. to disconnect the slow consumer instead of
+dropping its messages silently. It's called at most once per
+SLOW_CONSUMER_INTERVAL for each client staying over the mark, never on
+the goroutine of a session.
+*/
+func (inst *Instance) OnSlowConsumer(callback func(clientId string, mailboxDepth int)) *Instance {
+	inst.Lock()
+	defer inst.Unlock()
+	inst.onSlow = callback
+	return inst
+}
+
+/*
+Set the mailbox depth of a slow consumer reported to OnSlowConsumer,
+which is the mailbox size by default, i.e. once the mailbox is full. It
+only affects sessions created afterwards.
+*/
+func (inst *Instance) SetSlowConsumerMark(n int) *Instance {
+	inst.Lock()
+	defer inst.Unlock()
+	inst.options.highMark = n
+	return inst
+}
+
+/*
+Look up the live session of the client, e.g. for a security policy to
+read the state kept in it by Session.Set.
+*/
+func (inst *Instance) Session(clientId string) (*Session, bool) {
+	inst.RLock()
+	defer inst.RUnlock()
+	ss, ok := inst.sessions[clientId]
+	return ss, ok
 }
 
 /*
@@ -291,8 +1279,27 @@ Add new handler to listen and process messages sent to /service/**
 channel. It doesn't check for conflict and will override existing one
 with the same name. The returned Instance object allows flow style
 configuration.
+
+The channel may contain wildcard segments, where "*" matches exactly
+one segment and a trailing "**" matches the rest, and named parameter
+segments like /service/users/{id}/inbox, each of which matches exactly
+one segment. The segments matched by them are passed to the handler as
+message.Params in order, and those by the parameters as
+message.NamedParams by name too.
+
+A message published to the channel is passed to the handler instead of
+being broadcast to the subscribers. The handler replies to the calling
+client only by message.Reply. The reply is queued in the session once
+Reply returns, after the messages queued earlier, so it's carried by
+the connect following the call in the same request, or by the next
+poll of the client.
 */
 func (c *Instance) AddService(channel string, handler func(session *Session, message *MetaMessage)) *Instance {
+	c.Lock()
+	defer c.Unlock()
+	if _, exists := c.services[channel]; !exists && strings.ContainsAny(channel, "*{") {
+		c.servicePatterns.add(channel, channel)
+	}
 	c.services[channel] = handler
 	return c
 }
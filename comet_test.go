@@ -0,0 +1,738 @@
+package gocomet
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+func post(t *testing.T, inst *Instance, body string) (code int, messages []*MetaMessage) {
+	r, _ := http.NewRequest("POST", "/cometd", bytes.NewBufferString(body))
+	w := httptest.NewRecorder()
+	inst.ServeHTTP(w, r)
+	if w.Code == http.StatusOK {
+		if err := json.Unmarshal(w.Body.Bytes(), &messages); err != nil {
+			t.Fatalf("invalid response '%v': %v", w.Body.String(), err)
+		}
+	}
+	return w.Code, messages
+}
+
+func handshake(t *testing.T, inst *Instance) string {
+	_, resp := post(t, inst, `[{"channel":"/meta/handshake","version":"1.0","supportedConnectionTypes":["long-polling"]}]`)
+	if len(resp) != 1 || !resp[0].Successful {
+		t.Fatalf("failed to handshake: %v", resp)
+	}
+	return resp[0].ClientId
+}
+
+func TestStructuredData(t *testing.T) {
+	inst := New()
+	subscriber := handshake(t, inst)
+	post(t, inst, `[{"channel":"/meta/subscribe","clientId":"`+subscriber+`","subscription":"/foo/bar"}]`)
+	publisher := handshake(t, inst)
+	data := `{"n":1.5,"s":"text","a":{"b":[1,2,{"c":null}]}}`
+	post(t, inst, `[{"channel":"/foo/bar","clientId":"`+publisher+`","data":`+data+`}]`)
+
+	_, resp := post(t, inst, `[{"channel":"/meta/connect","clientId":"`+subscriber+`","connectionType":"long-polling"}]`)
+	if len(resp) != 2 {
+		t.Fatalf("expect one event and one response (got %v)", resp)
+	}
+	assert(resp[0].Channel == "/foo/bar", t, "first message should be the event (got %v)", resp[0])
+	assert(string(resp[0].Data) == data, t, "data should round-trip (got %s)", resp[0].Data)
+	assert(resp[0].ClientId == publisher, t, "event should carry the publisher (got %v)", resp[0].ClientId)
+}
+
+func TestEventTimestamp(t *testing.T) {
+	inst := New()
+	published := time.Date(2015, 3, 14, 9, 26, 53, 589000000, time.FixedZone("", 3600))
+	inst.SetTimestampSource(func() time.Time { return published })
+	subscriber := handshake(t, inst)
+	post(t, inst, `[{"channel":"/meta/subscribe","clientId":"`+subscriber+`","subscription":"/foo/bar"}]`)
+	inst.Publish("/foo/bar", "ping")
+
+	_, resp := post(t, inst, `[{"channel":"/meta/connect","clientId":"`+subscriber+`","connectionType":"long-polling"}]`)
+	if len(resp) != 2 {
+		t.Fatalf("expect one event and one response (got %v)", resp)
+	}
+	assert(resp[0].Timestamp == "2015-03-14T08:26:53.589", t, "event should carry the publish time in UTC (got %v)", resp[0].Timestamp)
+}
+
+func TestDataString(t *testing.T) {
+	em := &EventMessage{Data: json.RawMessage(`"hello"`)}
+	assert(em.DataString() == "hello", t, "JSON string should be unquoted (got %v)", em.DataString())
+	em.Data = json.RawMessage(`{"a":1}`)
+	assert(em.DataString() == `{"a":1}`, t, "JSON object should be kept as is (got %v)", em.DataString())
+}
+
+func TestCORS(t *testing.T) {
+	inst := New()
+	r, _ := http.NewRequest("OPTIONS", "/cometd", nil)
+	r.Header.Set("Origin", "http://example.com")
+	w := httptest.NewRecorder()
+	inst.ServeHTTP(w, r)
+	assert(w.Code == http.StatusNoContent, t, "preflight should be accepted (got %v)", w.Code)
+	assert(w.Header().Get("Access-Control-Allow-Origin") == "", t, "origin should not be allowed by default")
+
+	inst.SetCORS([]string{"http://example.com"})
+	w = httptest.NewRecorder()
+	inst.ServeHTTP(w, r)
+	assert(w.Code == http.StatusNoContent, t, "preflight should be accepted (got %v)", w.Code)
+	assert(w.Header().Get("Access-Control-Allow-Origin") == "http://example.com", t, "origin should be allowed")
+	assert(w.Header().Get("Access-Control-Allow-Methods") != "", t, "preflight should allow methods")
+
+	r.Header.Set("Origin", "http://other.com")
+	w = httptest.NewRecorder()
+	inst.ServeHTTP(w, r)
+	assert(w.Header().Get("Access-Control-Allow-Origin") == "", t, "other origin should not be allowed")
+
+	inst.SetCORS([]string{"*"})
+	w = httptest.NewRecorder()
+	inst.ServeHTTP(w, r)
+	assert(w.Header().Get("Access-Control-Allow-Origin") == "*", t, "wildcard origin should be allowed")
+
+	inst.SetCORSCredentials(true)
+	w = httptest.NewRecorder()
+	inst.ServeHTTP(w, r)
+	assert(w.Header().Get("Access-Control-Allow-Origin") == "http://other.com", t, "origin should be echoed for credentials")
+	assert(w.Header().Get("Access-Control-Allow-Credentials") == "true", t, "credentials should be allowed")
+}
+
+func TestSessionTimeoutAdvice(t *testing.T) {
+	inst := New().SetSessionTimeout(2 * time.Second)
+	_, resp := post(t, inst, `[{"channel":"/meta/handshake","version":"1.0"}]`)
+	assert(resp[0].Advice.Timeout == 2000, t, "advice should reflect the session timeout (got %v)", resp[0].Advice)
+}
+
+func TestStreamingAcks(t *testing.T) {
+	inst := New().SetSessionTimeout(2 * time.Second).SetStreaming(true)
+	server := httptest.NewServer(inst)
+	defer server.Close()
+	clientId := handshake(t, inst)
+
+	start := time.Now()
+	resp, err := http.Post(server.URL, "application/json", bytes.NewBufferString(
+		`[{"channel":"/meta/subscribe","clientId":"`+clientId+`","subscription":"/foo/bar"},`+
+			`{"channel":"/meta/connect","clientId":"`+clientId+`","connectionType":"long-polling"}]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	var received []byte
+	buf := make([]byte, 1024)
+	for !strings.Contains(string(received), "/meta/subscribe") {
+		n, err := resp.Body.Read(buf)
+		received = append(received, buf[:n]...)
+		if err != nil {
+			t.Fatalf("subscribe ack not found (got %s)", received)
+		}
+	}
+	elapsed := time.Since(start)
+	assert(elapsed < 500*time.Millisecond, t, "subscribe ack should arrive before connect hold completes (took %v)", elapsed)
+	assert(!strings.Contains(string(received), "/meta/connect"), t, "connect should still be held (got %s)", received)
+
+	for err == nil {
+		var n int
+		n, err = resp.Body.Read(buf)
+		received = append(received, buf[:n]...)
+	}
+	var messages []*MetaMessage
+	err = json.Unmarshal(received, &messages)
+	assert(err == nil && len(messages) == 2, t, "response should be a valid array (got %s)", received)
+}
+
+func TestShutdown(t *testing.T) {
+	inst := New()
+	clientId := handshake(t, inst)
+	done := make(chan bool)
+	go func() {
+		post(t, inst, `[{"channel":"/meta/connect","clientId":"`+clientId+`","connectionType":"long-polling"}]`)
+		close(done)
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	err := inst.Shutdown(ctx)
+	assert(err == nil, t, "shutdown should complete in time (got %v)", err)
+	select {
+	case <-done:
+	default:
+		t.Error("in-flight connect should return before shutdown completes")
+	}
+	code, _ := post(t, inst, `[{"channel":"/meta/handshake","version":"1.0"}]`)
+	assert(code == http.StatusServiceUnavailable, t, "new request should be rejected after shutdown (got %v)", code)
+	_, err = inst.handshake()
+	assert(err == errServerClosed, t, "new handshake should be rejected after shutdown (got %v)", err)
+}
+
+func TestRequestsNotSerialized(t *testing.T) {
+	inst := New()
+	inst.RLock() // e.g. held by a connect waiting for a busy session
+	defer inst.RUnlock()
+	done := make(chan bool)
+	go func() {
+		post(t, inst, `[{"channel":"/foo","data":1}]`)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("request should not wait for the server lock")
+	}
+}
+
+func TestConnectFastPath(t *testing.T) {
+	inst := New().SetConnectFastPath(true)
+	subscriber := handshake(t, inst)
+	post(t, inst, `[{"channel":"/meta/subscribe","clientId":"`+subscriber+`","subscription":"/foo/bar"}]`)
+	publisher := handshake(t, inst)
+	for i := 0; i < 3; i++ {
+		post(t, inst, `[{"channel":"/foo/bar","clientId":"`+publisher+`","data":"ping"}]`)
+	}
+
+	start := time.Now()
+	_, resp := post(t, inst, `[{"channel":"/meta/connect","clientId":"`+subscriber+`","connectionType":"long-polling"}]`)
+	elapsed := time.Since(start)
+	assert(elapsed < 500*time.Millisecond, t, "connect should return the backlog immediately (took %v)", elapsed)
+	assert(len(resp) == 4, t, "connect should return the full backlog (got %v)", resp)
+}
+
+func TestEnvelope(t *testing.T) {
+	inst := New().SetEnvelope(true)
+	r, _ := http.NewRequest("POST", "/cometd", bytes.NewBufferString(
+		`[{"channel":"/meta/handshake","version":"1.0"},{"channel":"/foo/bar"}]`))
+	w := httptest.NewRecorder()
+	inst.ServeHTTP(w, r)
+
+	var envelope struct {
+		Messages []*MetaMessage `json:"messages"`
+		Advice   *Advice        `json:"advice"`
+	}
+	err := json.Unmarshal(w.Body.Bytes(), &envelope)
+	assert(err == nil, t, "response should be an envelope object (got %s)", w.Body.Bytes())
+	assert(len(envelope.Messages) == 2, t, "envelope should carry the messages (got %v)", envelope.Messages)
+	assert(envelope.Advice != nil && envelope.Advice.Reconnect == "retry", t, "advice should be at the envelope level")
+	assert(envelope.Messages[0].Advice == nil, t, "common advice should be hoisted")
+}
+
+func TestDisconnectByServer(t *testing.T) {
+	inst := New()
+	clientId := handshake(t, inst)
+	post(t, inst, `[{"channel":"/meta/subscribe","clientId":"`+clientId+`","subscription":"/foo/bar"}]`)
+	assert(inst.Disconnect(clientId), t, "existing client should be disconnected")
+	assert(!inst.Disconnect(clientId), t, "client should not be disconnected twice")
+	assert(!inst.broker.local().hasClient(clientId), t, "broker should release the client")
+	assert(len(inst.Subscribers("/foo/bar")) == 0, t, "subscriptions should be released")
+
+	_, resp := post(t, inst, `[{"channel":"/meta/connect","clientId":"`+clientId+`","connectionType":"long-polling"}]`)
+	assert(len(resp) == 1 && !resp[0].Successful && resp[0].Advice != nil && resp[0].Advice.Reconnect == "handshake",
+		t, "next connect should be advised to handshake (got %v)", resp)
+}
+
+func TestConnectAdvice(t *testing.T) {
+	inst := New().SetConnectFastPath(true).SetSessionTimeout(200*time.Millisecond).
+		SetConnectAdvice(&Advice{Interval: 0}, &Advice{Interval: 5000})
+	subscriber := handshake(t, inst)
+	post(t, inst, `[{"channel":"/meta/subscribe","clientId":"`+subscriber+`","subscription":"/foo/bar"}]`)
+	inst.Publish("/foo/bar", "ping")
+
+	connect := `[{"channel":"/meta/connect","clientId":"` + subscriber + `","connectionType":"long-polling"}]`
+	_, resp := post(t, inst, connect)
+	assert(len(resp) == 2 && resp[1].Advice != nil, t, "fast connect should carry advice (got %v)", resp)
+	assert(resp[1].Advice.Reconnect == "retry" && resp[1].Advice.Interval == 0, t, "fast advice expected (got %+v)", resp[1].Advice)
+
+	_, resp = post(t, inst, connect)
+	assert(len(resp) == 1 && resp[0].Advice != nil, t, "empty connect should carry advice (got %v)", resp)
+	assert(resp[0].Advice.Reconnect == "retry" && resp[0].Advice.Interval == 5000, t, "timeout advice expected (got %+v)", resp[0].Advice)
+}
+
+func TestDefaultAdvice(t *testing.T) {
+	inst := New().SetAdvice(Advice{Interval: 2000, Timeout: 30000})
+	_, resp := post(t, inst, `[{"channel":"/meta/handshake","version":"1.0","supportedConnectionTypes":["long-polling"]}]`)
+	advice := resp[0].Advice
+	assert(advice != nil && advice.Reconnect == "retry" && advice.Interval == 2000 && advice.Timeout == 30000, t,
+		"handshake should carry the configured advice (got %+v)", advice)
+
+	_, resp = post(t, inst, `[{"channel":"/meta/connect","clientId":"unknown","connectionType":"long-polling"}]`)
+	advice = resp[0].Advice
+	assert(advice != nil && advice.Reconnect == "handshake" && advice.Interval == 2000, t,
+		"unknown client should be advised to handshake on top of the defaults (got %+v)", advice)
+}
+
+func TestDuplicateConnect(t *testing.T) {
+	inst := New().SetSessionTimeout(100 * time.Millisecond)
+	clientId := handshake(t, inst)
+	connect := `{"channel":"/meta/connect","clientId":"` + clientId + `","connectionType":"long-polling","id":"%v"}`
+	_, resp := post(t, inst, "["+fmt.Sprintf(connect, 1)+","+fmt.Sprintf(connect, 2)+"]")
+	assert(len(resp) == 2, t, "every connect should be answered (got %v)", resp)
+	assert(resp[0].Id == "1" && resp[0].Successful && resp[0].Advice != nil, t, "first connect should be held (got %+v)", resp[0])
+	assert(resp[1].Id == "2" && resp[1].Channel == "/meta/connect" && resp[1].ClientId == clientId, t, "duplicate connect should be answered (got %+v)", resp[1])
+	assert(!resp[1].Successful && strings.HasPrefix(resp[1].Error, "409:") && resp[1].Advice != nil && resp[1].Advice.Reconnect == "retry", t,
+		"duplicate connect should be rejected with advice (got %+v)", resp[1])
+	assert(inst.Touch(clientId), t, "client should be kept")
+}
+
+func TestMalformedRequest(t *testing.T) {
+	inst := New()
+	for _, body := range []string{`[{"channel":`, `[]`, ``} {
+		code, resp := post(t, inst, body)
+		assert(code == http.StatusOK && len(resp) == 1, t, "malformed request should be answered (got %v, %v)", code, resp)
+		assert(resp[0].Channel == "/meta/unknown" && !resp[0].Successful && strings.HasPrefix(resp[0].Error, "400::"), t,
+			"error should be in Bayeux form (got %+v)", resp[0])
+	}
+	inst.SetStrict(true)
+	code, _ := post(t, inst, `[{"channel":`)
+	assert(code == http.StatusBadRequest, t, "malformed request should be rejected in strict mode (got %v)", code)
+}
+
+func TestOperationErrors(t *testing.T) {
+	inst := New().SetSecurityPolicy(&countingPolicy{make(map[string]int)})
+	clientId := handshake(t, inst)
+	for body, expected := range map[string]string{
+		`{"channel":"/meta/subscribe","clientId":"unknown","subscription":"/foo"}`:             "402:unknown:",
+		`{"channel":"/meta/subscribe","clientId":"` + clientId + `","subscription":"/secret"}`: "403:/secret:",
+		`{"channel":"/meta/unsubscribe","clientId":"` + clientId + `","subscription":"/foo"}`:  "404:/foo:",
+		`{"channel":"/foo","clientId":"unknown","data":1}`:                                     "402:unknown:",
+		`{"channel":"/meta/disconnect","clientId":"unknown"}`:                                  "402:unknown:",
+		`{"channel":"/foo/*","clientId":"` + clientId + `","data":1}`:                          "400:/foo/*:",
+	} {
+		_, resp := post(t, inst, "["+body+"]")
+		assert(len(resp) == 1 && !resp[0].Successful && strings.HasPrefix(resp[0].Error, expected), t,
+			"%v should fail with %v (got %+v)", body, expected, resp)
+		if strings.HasPrefix(expected, "402:") {
+			assert(resp[0].Advice != nil && resp[0].Advice.Reconnect == "handshake", t,
+				"unknown client should be advised to handshake (got %+v)", resp[0].Advice)
+		}
+	}
+}
+
+func TestSubscribeAdvice(t *testing.T) {
+	inst := New()
+	clientId := handshake(t, inst)
+	subscribe := `[{"channel":"/meta/subscribe","clientId":"` + clientId + `","subscription":"/foo"}]`
+	_, resp := post(t, inst, subscribe)
+	assert(len(resp) == 1 && resp[0].Successful && resp[0].Advice == nil, t, "no advice by default (got %+v)", resp)
+
+	inst.SetSubscribeAdvice(&Advice{Interval: 2000})
+	_, resp = post(t, inst, subscribe)
+	assert(len(resp) == 1 && resp[0].Successful && resp[0].Advice != nil, t, "subscribe should be advised (got %+v)", resp)
+	assert(resp[0].Advice.Interval == 2000 && resp[0].Advice.Reconnect == "retry", t, "unexpected advice %+v", resp[0].Advice)
+}
+
+func TestPollTimeout(t *testing.T) {
+	inst := New().SetPollTimeout(50*time.Millisecond).SetConnectAdvice(nil, &Advice{Interval: 5000})
+	clientId := handshake(t, inst)
+	start := time.Now()
+	_, resp := post(t, inst, `[{"channel":"/meta/connect","clientId":"`+clientId+`","connectionType":"long-polling"}]`)
+	assert(time.Since(start) < time.Second, t, "connect should return once the poll times out (took %v)", time.Since(start))
+	assert(len(resp) == 1 && resp[0].Successful && resp[0].Advice != nil, t, "empty connect expected (got %v)", resp)
+	assert(resp[0].Advice.Reconnect == "retry" && resp[0].Advice.Interval == 0, t, "client should reconnect right away (got %+v)", resp[0].Advice)
+}
+
+func TestRequestLimits(t *testing.T) {
+	body := `[{"channel":"/meta/handshake","version":"1.0"}]`
+	inst := New().SetMaxRequestBytes(int64(len(body)))
+	code, _ := post(t, inst, body)
+	assert(code == http.StatusOK, t, "request just under the limit should be accepted (got %v)", code)
+	code, _ = post(t, inst, body+" ")
+	assert(code == http.StatusRequestEntityTooLarge, t, "request just over the limit should be rejected (got %v)", code)
+
+	inst = New().SetMaxBatchSize(2)
+	code, _ = post(t, inst, `[{"channel":"/foo"},{"channel":"/foo"}]`)
+	assert(code == http.StatusOK, t, "batch within the limit should be accepted (got %v)", code)
+	code, _ = post(t, inst, `[{"channel":"/foo"},{"channel":"/foo"},{"channel":"/foo"}]`)
+	assert(code == http.StatusBadRequest, t, "batch over the limit should be rejected (got %v)", code)
+}
+
+func TestMaxMessageBytes(t *testing.T) {
+	inst := New().SetMaxMessageBytes(len(`"12345678"`)).SetConnectFastPath(true)
+	subscriber := handshake(t, inst)
+	post(t, inst, `[{"channel":"/meta/subscribe","clientId":"`+subscriber+`","subscription":"/foo"}]`)
+	publisher := handshake(t, inst)
+	_, resp := post(t, inst, `[{"channel":"/foo","clientId":"`+publisher+`","data":"12345678"}]`)
+	assert(len(resp) == 1 && resp[0].Successful, t, "message at the limit should be published (got %v)", resp)
+	_, resp = post(t, inst, `[{"channel":"/foo","clientId":"`+publisher+`","data":"123456789"}]`)
+	assert(len(resp) == 1 && !resp[0].Successful && strings.HasPrefix(resp[0].Error, "413:"), t,
+		"message over the limit should be rejected (got %v)", resp)
+	_, resp = post(t, inst, `[{"channel":"/foo","data":"123456789"}]`)
+	assert(len(resp) == 1 && strings.HasPrefix(resp[0].Error, "413:"), t, "anonymous publish over the limit should be rejected (got %v)", resp)
+
+	_, resp = post(t, inst, `[{"channel":"/meta/connect","clientId":"`+subscriber+`","connectionType":"long-polling"}]`)
+	assert(len(resp) == 2 && string(resp[0].Data) == `"12345678"`, t, "only the message at the limit should be broadcast (got %v)", resp)
+}
+
+func TestConnectCancelled(t *testing.T) {
+	inst := New()
+	subscriber := handshake(t, inst)
+	post(t, inst, `[{"channel":"/meta/subscribe","clientId":"`+subscriber+`","subscription":"/foo/bar"}]`)
+	connect := `[{"channel":"/meta/connect","clientId":"` + subscriber + `","connectionType":"long-polling"}]`
+
+	ctx, cancel := context.WithCancel(context.Background())
+	r, _ := http.NewRequest("POST", "/cometd", bytes.NewBufferString(connect))
+	done := make(chan bool)
+	go func() {
+		inst.ServeHTTP(httptest.NewRecorder(), r.WithContext(ctx))
+		close(done)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	inst.Publish("/foo/bar", "ping") // collected by the abandoned poll
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(500 * time.Millisecond):
+		t.Fatal("abandoned poll should return promptly")
+	}
+
+	_, resp := post(t, inst.SetConnectFastPath(true), connect)
+	assert(len(resp) == 2 && resp[0].Channel == "/foo/bar", t, "undelivered event should be returned to the session (got %v)", resp)
+}
+
+func TestAbandonedConnects(t *testing.T) {
+	inst := New().SetPollTimeout(200 * time.Millisecond)
+	time.Sleep(10 * time.Millisecond)
+	baseline := runtime.NumGoroutine()
+
+	for round := 0; round < 10; round++ {
+		subscriber := handshake(t, inst)
+		post(t, inst, `[{"channel":"/meta/subscribe","clientId":"`+subscriber+`","subscription":"/foo/bar"}]`)
+		connect := `[{"channel":"/meta/connect","clientId":"` + subscriber + `","connectionType":"long-polling"}]`
+		// piggybacked on a subscribe, so that it's returned without holding
+		piggybacked := `[{"channel":"/meta/subscribe","clientId":"` + subscriber + `","subscription":"/foo/baz"},` + connect[1:]
+
+		done := make(chan bool)
+		for i := 0; i < 10; i++ {
+			body := connect
+			if i%2 == 1 {
+				body = piggybacked
+			}
+			ctx, cancel := context.WithCancel(context.Background())
+			r, _ := http.NewRequest("POST", "/cometd", bytes.NewBufferString(body))
+			go func() {
+				inst.ServeHTTP(httptest.NewRecorder(), r.WithContext(ctx))
+				done <- true
+			}()
+			inst.Publish("/foo/bar", i)
+			cancel() // abandoned by the client
+		}
+		inst.Disconnect(subscriber)
+		for i := 0; i < 10; i++ {
+			select {
+			case <-done:
+			case <-time.After(5 * time.Second):
+				t.Fatalf("%v abandoned connects never return", 10-i)
+			}
+		}
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for runtime.NumGoroutine() > baseline && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert(runtime.NumGoroutine() <= baseline, t, "goroutines should return to %v (got %v)", baseline, runtime.NumGoroutine())
+}
+
+func TestSubscribeAndConnect(t *testing.T) {
+	inst := New().SetConnectFastPath(true).SetPollTimeout(100 * time.Millisecond)
+	subscriber := handshake(t, inst)
+	connect := `{"channel":"/meta/connect","clientId":"` + subscriber + `","connectionType":"long-polling"}`
+
+	stop, done := make(chan bool), make(chan int)
+	go func() { // keeps publishing during the batch
+		n := 0
+		for {
+			select {
+			case <-stop:
+				done <- n
+				return
+			default:
+				n++
+				inst.Publish("/foo", n)
+				time.Sleep(100 * time.Microsecond) // within the mailbox size
+			}
+		}
+	}()
+	time.Sleep(10 * time.Millisecond)
+	_, resp := post(t, inst, `[{"channel":"/meta/subscribe","clientId":"`+subscriber+`","subscription":"/foo"},`+connect+`]`)
+	close(stop)
+	last := <-done
+	for {
+		_, more := post(t, inst, `[`+connect+`]`)
+		if len(more) == 1 { // nothing but the connect response
+			break
+		}
+		resp = append(resp, more...)
+	}
+
+	var received []int
+	for _, msg := range resp {
+		if msg.Channel == "/foo" {
+			var n int
+			json.Unmarshal(msg.Data, &n)
+			received = append(received, n)
+		}
+	}
+	if len(received) == 0 {
+		t.Fatal("messages published after the subscribe should be received")
+	}
+	for i, n := range received {
+		if n != received[0]+i {
+			t.Fatalf("message %v is lost after the subscribe (got %v)", received[0]+i, n)
+		}
+	}
+	assert(received[len(received)-1] == last, t, "all the messages should be received (got %v of %v)", received[len(received)-1], last)
+}
+
+func TestMaxClientsAdvice(t *testing.T) {
+	inst := New().SetMaxClients(1)
+	handshake(t, inst)
+	_, resp := post(t, inst, `[{"channel":"/meta/handshake","version":"1.0","supportedConnectionTypes":["long-polling"]}]`)
+	if len(resp) != 1 {
+		t.Fatalf("expect a handshake response (got %v)", resp)
+	}
+	assert(!resp[0].Successful && strings.HasPrefix(resp[0].Error, "503:"), t, "handshake should fail beyond the limit (got %v)", resp[0].Error)
+	assert(resp[0].Advice != nil && resp[0].Advice.Reconnect == "handshake" && resp[0].Advice.Interval == 5000, t,
+		"client should be advised to handshake later (got %v)", resp[0].Advice)
+}
+
+func TestCaseInsensitiveChannels(t *testing.T) {
+	for _, fold := range []bool{false, true} {
+		inst := New().SetConnectFastPath(true).SetPollTimeout(50 * time.Millisecond)
+		if fold {
+			inst.SetCaseInsensitiveChannels(true)
+		}
+		subscriber := handshake(t, inst)
+		post(t, inst, `[{"channel":"/meta/subscribe","clientId":"`+subscriber+`","subscription":"/Foo"}]`)
+		publisher := handshake(t, inst)
+		post(t, inst, `[{"channel":"/foo","clientId":"`+publisher+`","data":"ping"}]`)
+
+		_, resp := post(t, inst, `[{"channel":"/meta/connect","clientId":"`+subscriber+`","connectionType":"long-polling"}]`)
+		if fold {
+			assert(len(resp) == 2 && resp[0].Channel == "/foo", t, "/Foo should match /foo once case-insensitive (got %v)", resp)
+			_, resp = post(t, inst, `[{"channel":"/meta/unsubscribe","clientId":"`+subscriber+`","subscription":"/FOO"}]`)
+			assert(len(resp) == 1 && resp[0].Successful, t, "unsubscribe should be case-insensitive too (got %v)", resp)
+		} else {
+			assert(len(resp) == 1, t, "/Foo should not match /foo by default (got %v)", resp)
+		}
+	}
+}
+
+func TestBatchingWindow(t *testing.T) {
+	inst := New()
+	subscriber := handshake(t, inst)
+	post(t, inst, `[{"channel":"/meta/subscribe","clientId":"`+subscriber+`","subscription":"/foo/bar"}]`)
+	go func() {
+		for i := 0; i < 3; i++ {
+			time.Sleep(200 * time.Millisecond)
+			inst.Publish("/foo/bar", i)
+		}
+	}()
+	start := time.Now()
+	_, resp := post(t, inst, `[{"channel":"/meta/connect","clientId":"`+subscriber+`","connectionType":"long-polling"}]`)
+	elapsed := time.Since(start)
+	assert(len(resp) == 4, t, "all three events should be batched (got %v)", resp)
+	assert(elapsed < 2*time.Second, t, "batching should not exceed its window (took %v)", elapsed)
+}
+
+func TestMalformedChannel(t *testing.T) {
+	inst := New()
+	clientId := handshake(t, inst)
+	_, resp := post(t, inst, `[{"channel":"/meta/subscribe","clientId":"`+clientId+`","subscription":"/foo/*/bar"},`+
+		`{"channel":"/meta/subscribe","clientId":"`+clientId+`","subscription":"/foo bar"},`+
+		`{"channel":"/foo//bar","clientId":"`+clientId+`","data":"ping"},`+
+		`{"channel":"/foo/*","clientId":"`+clientId+`","data":"ping"}]`)
+	assert(len(resp) == 4, t, "all the messages should be answered (got %v)", resp)
+	for _, r := range resp {
+		assert(!r.Successful && strings.HasPrefix(r.Error, "400:"), t, "malformed channel should be rejected (got %+v)", r)
+	}
+	assert(len(inst.Channels(clientId)) == 0, t, "no rule should be created")
+}
+
+func TestFlushEvents(t *testing.T) {
+	inst := New().SetConnectFastPath(true)
+	clientId := handshake(t, inst)
+	data := json.RawMessage(`"` + strings.Repeat("x", 100) + `"`)
+	for i := 0; i < 1000; i++ {
+		inst.Send(clientId, "/foo/bar", data)
+	}
+	inst.Touch(clientId) // wait until the events are saved
+	r, _ := http.NewRequest("POST", "/cometd", bytes.NewBufferString(
+		`[{"channel":"/meta/connect","clientId":"`+clientId+`","connectionType":"long-polling"}]`))
+	w := httptest.NewRecorder()
+	inst.ServeHTTP(w, r)
+	assert(w.Flushed && w.Header().Get("Content-Length") == "", t, "events should be flushed")
+	var messages []json.RawMessage
+	err := json.Unmarshal(w.Body.Bytes(), &messages)
+	assert(err == nil && len(messages) == 1001, t, "expect the events and the connect (got %v, %v)", len(messages), err)
+}
+
+func BenchmarkDeliverEvents(b *testing.B) {
+	inst := New().SetConnectFastPath(true).SetMailbox(20000, DropOldest)
+	r, _ := http.NewRequest("POST", "/cometd", bytes.NewBufferString(`[{"channel":"/meta/handshake","version":"1.0"}]`))
+	w := httptest.NewRecorder()
+	inst.ServeHTTP(w, r)
+	var resp []*MetaMessage
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	clientId := resp[0].ClientId
+	connect := `[{"channel":"/meta/connect","clientId":"` + clientId + `","connectionType":"long-polling"}]`
+	data := json.RawMessage(`{"user":"someone","text":"hello, world"}`)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		for j := 0; j < 10000; j++ {
+			inst.Send(clientId, "/foo/bar", data)
+		}
+		inst.Touch(clientId) // wait until the events are saved
+		r, _ := http.NewRequest("POST", "/cometd", bytes.NewBufferString(connect))
+		w := httptest.NewRecorder()
+		b.StartTimer()
+
+		inst.ServeHTTP(w, r)
+
+		b.StopTimer()
+		var messages []json.RawMessage
+		if err := json.Unmarshal(w.Body.Bytes(), &messages); err != nil || len(messages) != 10001 {
+			b.Fatalf("expect a single array of 10000 events and the connect (got %v, %v)", len(messages), err)
+		}
+		b.StartTimer()
+	}
+}
+
+func TestPublishAfterSubscribe(t *testing.T) {
+	inst := New()
+	clientId := handshake(t, inst)
+	_, resp := post(t, inst, `[{"channel":"/meta/subscribe","clientId":"`+clientId+`","subscription":"/foo/bar"}]`)
+	assert(len(resp) == 1 && resp[0].Successful, t, "subscribe should succeed: %v", resp)
+	inst.Publish("/foo/bar", "first")
+	_, resp = post(t, inst, `[{"channel":"/meta/connect","clientId":"`+clientId+`","connectionType":"long-polling"}]`)
+	assert(len(resp) == 2 && string(resp[0].Data) == `"first"`, t, "message should be delivered on connect: %v", resp)
+
+	// the pending messages are piggybacked on another subscribe
+	inst.Publish("/foo/bar", "second")
+	_, resp = post(t, inst, `[{"channel":"/meta/subscribe","clientId":"`+clientId+`","subscription":"/foo/baz"}]`)
+	assert(len(resp) == 2 && string(resp[0].Data) == `"second"`, t, "pending message should be piggybacked: %v", resp)
+}
+
+func TestAnonymousPublish(t *testing.T) {
+	inst := New()
+	_, resp := post(t, inst, `[{"channel":"/foo","data":1}]`)
+	assert(len(resp) == 1 && strings.HasPrefix(resp[0].Error, "403:"), t, "anonymous publish should be denied by default (got %+v)", resp)
+
+	inst.AllowAnonymousPublish(true).SetAnonymousPublishRate(1, 2)
+	subscriber := handshake(t, inst)
+	post(t, inst, `[{"channel":"/meta/subscribe","clientId":"`+subscriber+`","subscription":"/foo"}]`)
+	_, resp = post(t, inst, `[{"channel":"/foo","data":1}]`)
+	assert(len(resp) == 1 && resp[0].Successful, t, "anonymous publish should be allowed (got %+v)", resp)
+	_, resp = post(t, inst, `[{"channel":"/meta/foo","data":1}]`)
+	assert(len(resp) == 1 && strings.HasPrefix(resp[0].Error, "400:"), t, "meta channel should never be published anonymously (got %+v)", resp)
+	post(t, inst, `[{"channel":"/foo","data":2}]`)
+	_, resp = post(t, inst, `[{"channel":"/foo","data":3}]`)
+	assert(len(resp) == 1 && strings.HasPrefix(resp[0].Error, "429:") && resp[0].Advice.Reconnect == "retry", t,
+		"anonymous publish should be throttled (got %+v)", resp)
+	_, resp = post(t, inst, `[{"channel":"/meta/connect","clientId":"`+subscriber+`","connectionType":"long-polling"}]`)
+	assert(len(resp) == 3, t, "subscriber should receive the allowed ones (got %+v)", resp)
+
+	inst.SetSecurityPolicy(readOnlyPolicy{}).SetAnonymousPublishRate(0, 0)
+	_, resp = post(t, inst, `[{"channel":"/foo","data":1}]`)
+	assert(len(resp) == 1 && strings.HasPrefix(resp[0].Error, "403:"), t, "anonymous publish should be authorized (got %+v)", resp)
+}
+
+func TestPublishToReservedChannels(t *testing.T) {
+	inst := New()
+	inst.AddService("/service/echo", func(session *Session, message *MetaMessage) {})
+	clientId := handshake(t, inst)
+	post(t, inst, `[{"channel":"/meta/subscribe","clientId":"`+clientId+`","subscription":"/**"}]`)
+	for body, expected := range map[string]string{
+		`{"channel":"/meta/foo","clientId":"` + clientId + `","data":1}`:        "400:/meta/foo:",
+		`{"channel":"/service/unknown","clientId":"` + clientId + `","data":1}`: "400:/service/unknown:",
+		`{"channel":"/service/echo","clientId":"` + clientId + `","data":1}`:    "",
+		`{"channel":"/foo/bar","clientId":"` + clientId + `","data":1}`:         "",
+	} {
+		_, resp := post(t, inst, "["+body+"]")
+		assert(len(resp) >= 1 && resp[len(resp)-1].Successful == (expected == "") &&
+			strings.HasPrefix(resp[len(resp)-1].Error, expected), t, "%v should fail with '%v' (got %+v)", body, expected, resp)
+	}
+
+	// data on a meta message is ignored instead of published
+	_, resp := post(t, inst, `[{"channel":"/meta/handshake","version":"1.0","supportedConnectionTypes":["long-polling"],"data":1}]`)
+	assert(len(resp) == 1 && resp[0].Successful && resp[0].ClientId != "", t, "handshake should succeed (got %+v)", resp)
+	inst.Publish("/foo/bar", "last")
+	_, resp = post(t, inst, `[{"channel":"/meta/connect","clientId":"`+clientId+`","connectionType":"long-polling"}]`)
+	assert(len(resp) == 2 && string(resp[0].Data) == `"last"`, t, "only the last publish should be received (got %+v)", resp)
+}
+
+func TestConnectionTypes(t *testing.T) {
+	inst := New()
+	_, resp := post(t, inst, `[{"channel":"/meta/handshake","version":"1.0","supportedConnectionTypes":["websocket"]}]`)
+	assert(len(resp) == 1 && !resp[0].Successful && resp[0].ClientId == "", t, "handshake should fail (got %+v)", resp)
+	assert(strings.HasPrefix(resp[0].Error, "400:websocket:") && resp[0].Advice != nil && resp[0].Advice.Reconnect == "none", t,
+		"client should be told the failure without retrying (got %+v)", resp[0])
+	assert(len(resp[0].SupportedConnectionTypes) == 1 && resp[0].SupportedConnectionTypes[0] == "long-polling", t,
+		"server's connection types should be told (got %v)", resp[0].SupportedConnectionTypes)
+	assert(inst.ClientCount() == 0, t, "no session should be created")
+
+	_, resp = post(t, inst, `[{"channel":"/meta/handshake","version":"1.0","supportedConnectionTypes":["websocket","long-polling"]}]`)
+	assert(len(resp) == 1 && resp[0].Successful && len(resp[0].SupportedConnectionTypes) == 1 &&
+		resp[0].SupportedConnectionTypes[0] == "long-polling", t, "common connection type should be negotiated (got %+v)", resp)
+}
+
+func TestSetConnectionTypes(t *testing.T) {
+	inst := New().SetConnectionTypes([]string{"long-polling", "carrier-pigeon"})
+	clientId := handshake(t, inst)
+	_, resp := post(t, inst, `[{"channel":"/meta/connect","clientId":"`+clientId+`","connectionType":"websocket"}]`)
+	assert(len(resp) == 1 && strings.HasPrefix(resp[0].Error, "400:websocket:"), t, "connect of another transport should fail (got %+v)", resp)
+
+	inst.SetConnectionTypes(nil)
+	code, _ := post(t, inst, `[{"channel":"/meta/handshake","version":"1.0","supportedConnectionTypes":["long-polling"]}]`)
+	assert(code == http.StatusBadRequest, t, "disabled transport should reject requests (got %v)", code)
+}
+
+func TestDowngradeAdvice(t *testing.T) {
+	inst := New().SetDowngradeThreshold(2).SetPollTimeout(10 * time.Millisecond)
+	clientId := handshake(t, inst)
+	connect := func(connectionType string) *Advice {
+		_, resp := post(t, inst, `[{"channel":"/meta/connect","clientId":"`+clientId+`","connectionType":"`+connectionType+`"}]`)
+		return resp[0].Advice
+	}
+	advice := connect("websocket")
+	assert(advice.Reconnect == "handshake" && advice.ConnectionType == "", t, "single failure should not downgrade (got %+v)", advice)
+	advice = connect("websocket")
+	assert(advice.Reconnect == "handshake" && advice.ConnectionType == "long-polling", t, "repeated failures should downgrade (got %+v)", advice)
+
+	connect("long-polling")
+	advice = connect("websocket")
+	assert(advice.ConnectionType == "", t, "successful connect should reset the failures (got %+v)", advice)
+
+	inst.SetDowngradeThreshold(0)
+	advice = connect("websocket")
+	assert(advice.ConnectionType == "", t, "downgrade should be disabled (got %+v)", advice)
+}
+
+func TestAdviseReconnect(t *testing.T) {
+	inst := New().SetPollTimeout(10 * time.Millisecond)
+	clientId := handshake(t, inst)
+	connect := func() *Advice {
+		_, resp := post(t, inst, `[{"channel":"/meta/connect","clientId":"`+clientId+`","connectionType":"long-polling"}]`)
+		return resp[0].Advice
+	}
+	assert(inst.AdviseReconnect(clientId, "retry"), t, "advice should be kept")
+	assert(inst.AdviseReconnect(clientId, "handshake"), t, "advice should be replaced")
+	advice := connect()
+	assert(advice.Reconnect == "handshake", t, "next connect should be advised (got %+v)", advice)
+	advice = connect()
+	assert(advice.Reconnect == "retry", t, "advice should be sent only once (got %+v)", advice)
+
+	assert(!inst.AdviseReconnect(clientId, "later"), t, "unknown advice should be rejected")
+	assert(!inst.AdviseReconnect("nobody", "handshake"), t, "unknown client should be rejected")
+}
@@ -0,0 +1,96 @@
+package gocomet
+
+import (
+	"compress/gzip"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var gzipPool = sync.Pool{New: func() interface{} { return gzip.NewWriter(nil) }}
+
+/*
+The writer of a response, which decides on the first write whether it's
+compressed by gzip: only if the client accepts it, and the first part
+is no less than minBytes, so that a tiny response isn't wrapped. A
+response written in parts, e.g. flushed before a held connect in the
+streaming mode, is compressed as a whole or not at all.
+*/
+type responseWriter struct {
+	w        http.ResponseWriter
+	accepted bool // gzip by the client, and enabled
+	minBytes int
+	started  bool
+	gz       *gzip.Writer
+}
+
+func (rw *responseWriter) Write(p []byte) {
+	if !rw.started {
+		rw.started = true
+		if rw.accepted && len(p) >= rw.minBytes {
+			rw.w.Header().Set("Content-Encoding", "gzip")
+			rw.gz = gzipPool.Get().(*gzip.Writer)
+			rw.gz.Reset(rw.w)
+		}
+		rw.w.WriteHeader(http.StatusOK)
+	}
+	if rw.gz != nil {
+		rw.gz.Write(p)
+	} else {
+		rw.w.Write(p)
+	}
+}
+
+// send what's written so far to the client, compressed or not
+func (rw *responseWriter) Flush() {
+	if rw.gz != nil {
+		rw.gz.Flush()
+	}
+	if f, ok := rw.w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (rw *responseWriter) Close() {
+	if !rw.started { // nothing is written, e.g. the client is gone
+		rw.started = true
+		rw.w.WriteHeader(http.StatusOK)
+	}
+	if rw.gz != nil {
+		rw.gz.Close()
+		gzipPool.Put(rw.gz)
+		rw.gz = nil
+	}
+}
+
+// whether gzip is acceptable by the Accept-Encoding header
+func acceptsGzip(header string) bool {
+	for _, part := range strings.Split(header, ",") {
+		fields := strings.Split(part, ";")
+		if coding := strings.TrimSpace(fields[0]); coding != "gzip" && coding != "*" {
+			continue
+		}
+		for _, param := range fields[1:] {
+			if param = strings.TrimSpace(param); strings.HasPrefix(param, "q=") {
+				q, err := strconv.ParseFloat(param[2:], 64)
+				return err == nil && q > 0
+			}
+		}
+		return true
+	}
+	return false
+}
+
+/*
+Compress the responses by gzip for the clients accepting it, e.g. to
+drain a big mailbox faster over a mobile network. The responses smaller
+than minBytes are sent as they are, which are decided by the first part
+written in the streaming mode. It's disabled by default.
+*/
+func (inst *Instance) SetCompression(enabled bool, minBytes int) *Instance {
+	inst.Lock()
+	defer inst.Unlock()
+	inst.compress, inst.compressMin = enabled, minBytes
+	return inst
+}
@@ -0,0 +1,95 @@
+package gocomet
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAcceptsGzip(t *testing.T) {
+	for header, expected := range map[string]bool{
+		"":                      false,
+		"gzip":                  true,
+		"deflate, gzip;q=0.5":   true,
+		"br;q=1.0, gzip; q=0":   false,
+		"*":                     true,
+		"identity":              false,
+		"gzip;level=1":          true,
+		"deflate , gzip ; q=.8": true,
+	} {
+		assert(acceptsGzip(header) == expected, t, "gzip should be accepted by '%v': %v", header, expected)
+	}
+}
+
+func TestCompression(t *testing.T) {
+	inst := New().SetCompression(true, 1024)
+	clientId := handshake(t, inst)
+	post(t, inst, `[{"channel":"/meta/subscribe","clientId":"`+clientId+`","subscription":"/foo/bar"}]`)
+	request := func(body string) (*httptest.ResponseRecorder, []*MetaMessage) {
+		r, _ := http.NewRequest("POST", "/cometd", bytes.NewBufferString(body))
+		r.Header.Set("Accept-Encoding", "gzip")
+		w := httptest.NewRecorder()
+		inst.ServeHTTP(w, r)
+		var data []byte
+		if w.Header().Get("Content-Encoding") == "gzip" {
+			reader, err := gzip.NewReader(w.Body)
+			if err != nil {
+				t.Fatalf("invalid gzip: %v", err)
+			}
+			data, _ = ioutil.ReadAll(reader)
+		} else {
+			data = w.Body.Bytes()
+		}
+		var messages []*MetaMessage
+		if err := json.Unmarshal(data, &messages); err != nil {
+			t.Fatalf("invalid response '%s': %v", data, err)
+		}
+		return w, messages
+	}
+
+	w, _ := request(`[{"channel":"/meta/handshake","version":"1.0"}]`)
+	assert(w.Header().Get("Content-Encoding") == "" && w.Header().Get("Vary") == "Accept-Encoding", t,
+		"tiny response should not be compressed (got %v)", w.Header())
+
+	for i := 0; i < 50; i++ {
+		inst.Publish("/foo/bar", strings.Repeat("x", 100))
+	}
+	w, resp := request(`[{"channel":"/meta/connect","clientId":"` + clientId + `","connectionType":"long-polling"}]`)
+	assert(w.Header().Get("Content-Encoding") == "gzip" && w.Body.Len() < 1024, t,
+		"big response should be compressed (got %v bytes, %v)", w.Body.Len(), w.Header())
+	assert(len(resp) == 51 && resp[0].DataString() == strings.Repeat("x", 100), t, "events should be decompressed (got %v)", len(resp))
+
+	inst.SetCompression(false, 0)
+	for i := 0; i < 50; i++ {
+		inst.Publish("/foo/bar", strings.Repeat("x", 100))
+	}
+	w, _ = request(`[{"channel":"/meta/connect","clientId":"` + clientId + `","connectionType":"long-polling"}]`)
+	assert(w.Header().Get("Content-Encoding") == "" && w.Header().Get("Vary") == "", t, "compression should be disabled (got %v)", w.Header())
+}
+
+func TestStreamingCompression(t *testing.T) {
+	inst := New().SetCompression(true, 0).SetStreaming(true)
+	clientId := handshake(t, inst)
+	go func() {
+		inst.Publish("/foo/bar", "late")
+	}()
+	r, _ := http.NewRequest("POST", "/cometd", bytes.NewBufferString(`[{"channel":"/meta/subscribe","clientId":"`+clientId+`","subscription":"/foo/bar"},`+
+		`{"channel":"/meta/connect","clientId":"`+clientId+`","connectionType":"long-polling"}]`))
+	r.Header.Set("Accept-Encoding", "gzip")
+	w := httptest.NewRecorder()
+	inst.ServeHTTP(w, r)
+	assert(w.Header().Get("Content-Encoding") == "gzip" && w.Flushed, t, "streamed response should be compressed (got %v)", w.Header())
+	reader, err := gzip.NewReader(w.Body)
+	if err != nil {
+		t.Fatalf("invalid gzip: %v", err)
+	}
+	data, _ := ioutil.ReadAll(reader)
+	var messages []*MetaMessage
+	err = json.Unmarshal(data, &messages)
+	assert(err == nil && len(messages) >= 2, t, "streamed parts should be compressed as a whole (got '%s': %v)", data, err)
+}
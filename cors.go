@@ -0,0 +1,81 @@
+package gocomet
+
+import (
+	"net/http"
+	"strings"
+)
+
+/*
+Allow cross-origin requests from the given origins. An origin "*"
+allows any origin. Setting no origin disables CORS.
+*/
+func (inst *Instance) SetCORS(origins []string) *Instance {
+	inst.Lock()
+	defer inst.Unlock()
+	inst.corsOrigins = origins
+	return inst
+}
+
+/*
+Allow cross-origin requests to carry credentials like cookies. Since
+browsers don't accept a wildcard origin for credentialed requests, the
+request's origin is echoed back instead.
+*/
+func (inst *Instance) SetCORSCredentials(allow bool) *Instance {
+	inst.Lock()
+	defer inst.Unlock()
+	inst.corsCredentials = allow
+	return inst
+}
+
+/*
+Emit the CORS headers if the request's origin is allowed. It returns
+true if the request is a preflight and has been responded already.
+*/
+func (inst *Instance) handleCORS(w http.ResponseWriter, r *http.Request) bool {
+	inst.RLock()
+	origins, credentials := inst.corsOrigins, inst.corsCredentials
+	inst.RUnlock()
+
+	if origin := r.Header.Get("Origin"); origin != "" {
+		if allowed, wildcard := matchOrigin(origins, origin); allowed {
+			header := w.Header()
+			if wildcard && !credentials {
+				header.Set("Access-Control-Allow-Origin", "*")
+			} else {
+				header.Set("Access-Control-Allow-Origin", origin)
+				header.Add("Vary", "Origin")
+			}
+			if credentials {
+				header.Set("Access-Control-Allow-Credentials", "true")
+			}
+			if r.Method == "OPTIONS" {
+				header.Set("Access-Control-Allow-Methods", "POST, OPTIONS")
+				if headers := r.Header.Get("Access-Control-Request-Headers"); headers != "" {
+					header.Set("Access-Control-Allow-Headers", headers)
+				} else {
+					header.Set("Access-Control-Allow-Headers", "Content-Type")
+				}
+				header.Set("Access-Control-Max-Age", "86400")
+			}
+		}
+	}
+
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusNoContent)
+		return true
+	}
+	return false
+}
+
+func matchOrigin(origins []string, origin string) (allowed, wildcard bool) {
+	for _, o := range origins {
+		if o == "*" {
+			return true, true
+		}
+		if strings.EqualFold(o, origin) {
+			return true, false
+		}
+	}
+	return false, false
+}
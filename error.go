@@ -0,0 +1,176 @@
+package gocomet
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+/*
+The error of a Bayeux response in the form of <code>:<args>:<message>,
+where the args are separated by commas, e.g. "402:abc123:Unknown client".
+*/
+type Error struct {
+	Code    int
+	Args    []string
+	Message string
+}
+
+func (e *Error) String() string {
+	return fmt.Sprintf("%03d:%v:%v", e.Code, strings.Join(e.Args, ","), e.Message)
+}
+
+func (e *Error) Error() string {
+	return e.String()
+}
+
+/*
+Parse an error in the canonical form. The message may contain ':'.
+*/
+func ParseError(s string) (*Error, bool) {
+	parts := strings.SplitN(s, ":", 3)
+	if len(parts) != 3 {
+		return nil, false
+	}
+	code, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return nil, false
+	}
+	e := &Error{Code: code, Message: parts[2]}
+	if parts[1] != "" {
+		e.Args = strings.Split(parts[1], ",")
+	}
+	return e, true
+}
+
+/*
+The client ID is unknown or expired, so the client should handshake
+again.
+*/
+func UnknownClientError(clientId string) *Error {
+	return &Error{402, []string{clientId}, "Unknown client"}
+}
+
+/*
+The channel is malformed, or can't be used for the operation.
+*/
+func InvalidChannelError(channel string, reason error) *Error {
+	return &Error{400, []string{channel}, reason.Error()}
+}
+
+/*
+The operation on the channel is denied by the security policy.
+*/
+func UnauthorizedError(channel string) *Error {
+	return &Error{403, []string{channel}, "Unauthorized"}
+}
+
+/*
+The client has subscribed to as many channels as allowed.
+*/
+func TooManySubscriptionsError(channel string) *Error {
+	return &Error{409, []string{channel}, "Too many subscriptions"}
+}
+
+/*
+The client unsubscribes from a channel it's not subscribed to.
+*/
+func NotSubscribedError(channel string) *Error {
+	return &Error{404, []string{channel}, "Not subscribed"}
+}
+
+/*
+The chunk info of a publish is malformed, or inconsistent with the
+other chunks of the message.
+*/
+func InvalidChunkError(channel string) *Error {
+	return &Error{400, []string{channel}, "Invalid chunk"}
+}
+
+/*
+The data of the published message is too large.
+*/
+func MessageTooLargeError(channel string) *Error {
+	return &Error{413, []string{channel}, "Message too large"}
+}
+
+/*
+The message reassembled from the chunks would be too large.
+*/
+func ChunkedTooLargeError(channel string) *Error {
+	return &Error{413, []string{channel}, "Chunked message too large"}
+}
+
+/*
+The client, or all the clients, have too many chunks pending, and the
+client should retry later.
+*/
+func TooManyChunksError(channel string) *Error {
+	return &Error{429, []string{channel}, "Too many pending chunks"}
+}
+
+/*
+None of the connection types supported by the client is supported by
+the server.
+*/
+func UnsupportedConnectionTypesError(types []string) *Error {
+	return &Error{400, types, "Unsupported connection types"}
+}
+
+/*
+A request carries more than one connect, which are not allowed to be
+held together.
+*/
+func DuplicateConnectError(clientId string) *Error {
+	return &Error{409, []string{clientId}, "Duplicate connect"}
+}
+
+/*
+The message is neither a known meta message nor a publish.
+*/
+func BadRequestError(channel string) *Error {
+	return &Error{400, []string{channel}, "Bad request"}
+}
+
+/*
+The client sends too many messages and should retry later.
+*/
+func TooManyRequestsError(channel string) *Error {
+	return &Error{429, []string{channel}, "Too many requests"}
+}
+
+/*
+The server can't serve the request for now, and the client should
+retry later.
+*/
+func UnavailableError(reason error) *Error {
+	return &Error{503, nil, reason.Error()}
+}
+
+/*
+Convert the error of a client's operation on the channel.
+*/
+func errorOf(clientId, channel string, err error) *Error {
+	switch err {
+	case errUnknownClient:
+		return UnknownClientError(clientId)
+	case errUnauthorized, errAnonymousPublish:
+		return UnauthorizedError(channel)
+	case errRateLimited:
+		return TooManyRequestsError(channel)
+	case errTooManySubscriptions:
+		return TooManySubscriptionsError(channel)
+	case errNotSubscribed:
+		return NotSubscribedError(channel)
+	case errInvalidChunk:
+		return InvalidChunkError(channel)
+	case errChunkedTooLarge:
+		return ChunkedTooLargeError(channel)
+	case errTooManyChunks:
+		return TooManyChunksError(channel)
+	case errServerClosed, errChannelTimeout, errTooManyClients:
+		return UnavailableError(err)
+	default:
+		return InvalidChannelError(channel, err)
+	}
+}
@@ -0,0 +1,45 @@
+package gocomet
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestErrorFormat(t *testing.T) {
+	e := UnknownClientError("abc123")
+	assert(e.String() == "402:abc123:Unknown client", t, "unexpected error form %v", e)
+	e = &Error{Code: 400, Args: []string{"/foo", "bar"}, Message: "Bad: request"}
+	assert(e.String() == "400:/foo,bar:Bad: request", t, "args should be separated by commas (got %v)", e)
+	assert(UnavailableError(errors.New("Busy.")).String() == "503::Busy.", t, "args may be empty")
+
+	parsed, ok := ParseError(e.String())
+	assert(ok && parsed.Code == 400 && len(parsed.Args) == 2 && parsed.Message == "Bad: request", t, "failed to parse %v", parsed)
+	parsed, ok = ParseError("503::Busy.")
+	assert(ok && len(parsed.Args) == 0, t, "empty args should be parsed as none (got %v)", parsed)
+	_, ok = ParseError("Unknown client.")
+	assert(!ok, t, "non-canonical error should not be parsed")
+}
+
+func TestErrorOf(t *testing.T) {
+	for _, c := range []struct {
+		err  error
+		code int
+	}{
+		{errUnknownClient, 402},
+		{errUnauthorized, 403},
+		{errTooManySubscriptions, 409},
+		{errNotSubscribed, 404},
+		{errInvalidChunk, 400},
+		{errChunkedTooLarge, 413},
+		{errTooManyChunks, 429},
+		{errServerClosed, 503},
+		{errTooManyClients, 503},
+		{errEmptySegment, 400},
+		{errWildcardPublish, 400},
+	} {
+		e := errorOf("abc123", "/foo", c.err)
+		assert(e.Code == c.code, t, "'%v' should be mapped to %v (got %v)", c.err, c.code, e)
+	}
+	e := errorOf("abc123", "/foo", errEmptySegment)
+	assert(e.Message == errEmptySegment.Error(), t, "invalid channel should tell the reason (got %v)", e)
+}
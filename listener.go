@@ -0,0 +1,84 @@
+package gocomet
+
+import (
+	"encoding/json"
+	"github.com/serverhorror/uuid"
+	"sync"
+)
+
+// Prefix of the IDs of the listeners, apart from the client IDs.
+const LISTENER_ID_PREFIX = "listener/"
+
+/*
+Listen to the messages broadcasted to the channel, which may be a
+wildcard, without going through HTTP. The handler is invoked in its
+own goroutine in the order of messages. A slow handler doesn't lose
+messages, which are queued for it without bound meanwhile. Call the
+returned cancel function to stop listening, after which the queued
+messages are discarded.
+
+It fails if the channel is invalid, or can't be subscribed.
+*/
+func (inst *Instance) Listen(channel string, handler func(channel string, data json.RawMessage)) (cancel func(), err error) {
+	if err = validateChannel(channel); err != nil {
+		return nil, err
+	}
+	id, err := inst.listeners.get()
+	if err != nil {
+		return nil, err
+	}
+	ch := inst.broker.register(id)
+	inst.broker.local().setLossless(id) // the messages are queued below
+	if err = inst.broker.subscribe(id, channel); err != nil {
+		inst.broker.deregister(id)
+		inst.listeners.release(id)
+		return nil, err
+	}
+
+	stopped := make(chan bool)
+	queued := make(chan *Message)
+	go func() { // queue the messages between the broker and the handler
+		defer close(queued)
+		var queue []*Message
+		in := ch
+		for in != nil || len(queue) > 0 {
+			var out chan *Message
+			var next *Message
+			if len(queue) > 0 {
+				out, next = queued, queue[0]
+			}
+			select {
+			case msg, ok := <-in:
+				if !ok {
+					in = nil
+				} else {
+					queue = append(queue, msg)
+				}
+			case out <- next:
+				queue[0] = nil
+				queue = queue[1:]
+			case <-stopped:
+				return
+			}
+		}
+	}()
+	go func() {
+		for msg := range queued {
+			handler(msg.channel, msg.data)
+		}
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			close(stopped)
+			inst.broker.unsubscribe(id, channel)
+			inst.broker.deregister(id)
+			inst.listeners.release(id)
+		})
+	}, nil
+}
+
+func newListenerId() string {
+	return LISTENER_ID_PREFIX + uuid.UUID4()
+}
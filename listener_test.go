@@ -0,0 +1,108 @@
+package gocomet
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestListen(t *testing.T) {
+	inst := New()
+	var lock sync.Mutex
+	var received []string
+	cancel, _ := inst.Listen("/**", func(channel string, data json.RawMessage) {
+		lock.Lock()
+		defer lock.Unlock()
+		received = append(received, channel+":"+string(data))
+	})
+
+	inst.whisper("/foo/bar", json.RawMessage(`1`))
+	inst.whisper("/foo/bar/baz", json.RawMessage(`2`))
+	time.Sleep(10 * time.Millisecond)
+	cancel()
+	inst.whisper("/foo/bar", json.RawMessage(`3`))
+	time.Sleep(10 * time.Millisecond)
+	cancel() // cancel twice should be harmless
+
+	lock.Lock()
+	defer lock.Unlock()
+	assert(len(received) == 2 && received[0] == "/foo/bar:1" && received[1] == "/foo/bar/baz:2", t,
+		"listener should receive messages until cancelled (got %v)", received)
+}
+
+func TestPublishBatch(t *testing.T) {
+	inst := New()
+	var lock sync.Mutex
+	var received []string
+	cancel, _ := inst.Listen("/foo/*", func(channel string, data json.RawMessage) {
+		lock.Lock()
+		defer lock.Unlock()
+		received = append(received, string(data))
+	})
+	defer cancel()
+
+	err := inst.PublishBatch("/foo/bar", []interface{}{1, "two", json.RawMessage(`{"n":3}`)})
+	assert(err == nil, t, "failed to publish the batch: %v", err)
+	err = inst.PublishBatch("/foo/bar", []interface{}{4, func() {}})
+	assert(err != nil, t, "batch with an invalid item should fail")
+	time.Sleep(10 * time.Millisecond)
+
+	lock.Lock()
+	defer lock.Unlock()
+	assert(strings.Join(received, ",") == `1,"two",{"n":3}`, t, "items should be delivered in order (got %v)", received)
+}
+
+func TestServerPublish(t *testing.T) {
+	inst := New()
+	err := inst.Publish("/foo/bar", "nobody listens")
+	assert(err == nil, t, "publish without subscriber should not fail (got %v)", err)
+
+	received := make(chan string, 2)
+	cancel, _ := inst.Listen("/foo/*", func(channel string, data json.RawMessage) {
+		received <- string(data)
+	})
+	defer cancel()
+	inst.Publish("/foo/bar", map[string]int{"a": 1})
+	inst.Publish("/foo/baz", json.RawMessage(`[1,2]`))
+	assert(<-received == `{"a":1}`, t, "data should be encoded as JSON")
+	assert(<-received == `[1,2]`, t, "raw data should be published as is")
+
+	err = inst.Publish("/foo/bar", func(CloseReason, []*Message) {})
+	assert(err != nil, t, "unsupported data should fail")
+}
+
+func TestListenErrors(t *testing.T) {
+	inst := New().SetMaxSubscriptionsPerClient(1)
+	_, err := inst.Listen("foo", func(string, json.RawMessage) {})
+	assert(err == errChannelPrefix, t, "invalid channel should be rejected (got %v)", err)
+
+	cancel, err := inst.Listen("/foo", func(string, json.RawMessage) {})
+	assert(err == nil && strings.HasPrefix(inst.broker.local().subscribers("/foo")[0], LISTENER_ID_PREFIX), t,
+		"listener should have its own ID (got %v)", err)
+	cancel()
+	assert(len(inst.broker.local().subscribers("/foo")) == 0 && len(inst.listeners.values) == 0, t, "listener should be released")
+}
+
+func TestSlowListener(t *testing.T) {
+	inst := New()
+	received := make(chan string)
+	cancel, _ := inst.Listen("/foo", func(channel string, data json.RawMessage) {
+		received <- string(data) // blocked until read
+	})
+	defer cancel()
+	n := CLIENT_BUFFER * 3
+	for i := 0; i < n; i++ {
+		inst.whisper("/foo", json.RawMessage(strconv.Itoa(i)))
+	}
+	for i := 0; i < n; i++ {
+		select {
+		case data := <-received:
+			assert(data == strconv.Itoa(i), t, "expect message %v (got %v)", i, data)
+		case <-time.After(time.Second):
+			t.Fatalf("message %v is lost", i)
+		}
+	}
+}
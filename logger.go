@@ -0,0 +1,88 @@
+package gocomet
+
+import (
+	"fmt"
+	"log"
+	"sync/atomic"
+)
+
+/*
+A leveled logger. Client specific messages are prefixed with the
+client ID formatted by "[%8.8v]".
+*/
+type Logger interface {
+	Debugf(format string, args ...interface{})
+	Infof(format string, args ...interface{})
+	Errorf(format string, args ...interface{})
+}
+
+type nopLogger struct{}
+
+func (nopLogger) Debugf(format string, args ...interface{}) {}
+func (nopLogger) Infof(format string, args ...interface{})  {}
+func (nopLogger) Errorf(format string, args ...interface{}) {}
+
+type stdLogger struct {
+	*log.Logger
+}
+
+/*
+Create a logger writing everything to the standard logger, prefixed
+by the level.
+*/
+func NewStdLogger(l *log.Logger) Logger {
+	return stdLogger{l}
+}
+
+func (l stdLogger) Debugf(format string, args ...interface{}) {
+	l.Output(3, "DEBUG "+fmt.Sprintf(format, args...))
+}
+
+func (l stdLogger) Infof(format string, args ...interface{}) {
+	l.Output(3, "INFO "+fmt.Sprintf(format, args...))
+}
+
+func (l stdLogger) Errorf(format string, args ...interface{}) {
+	l.Output(3, "ERROR "+fmt.Sprintf(format, args...))
+}
+
+type loggerBox struct {
+	Logger
+}
+
+/*
+A logger shared by the server, broker and sessions, which can be
+replaced at any time without locking.
+*/
+type sharedLogger struct {
+	v atomic.Value
+}
+
+func newSharedLogger() *sharedLogger {
+	l := &sharedLogger{}
+	l.set(nopLogger{})
+	return l
+}
+
+func (l *sharedLogger) set(logger Logger) {
+	if logger == nil {
+		logger = nopLogger{}
+	}
+	l.v.Store(loggerBox{logger})
+}
+
+func (l *sharedLogger) get() Logger {
+	return l.v.Load().(loggerBox).Logger
+}
+
+func (l *sharedLogger) Debugf(format string, args ...interface{}) {
+	l.get().Debugf(format, args...)
+}
+
+func (l *sharedLogger) Infof(format string, args ...interface{}) {
+	l.get().Infof(format, args...)
+}
+
+func (l *sharedLogger) Errorf(format string, args ...interface{}) {
+	l.get().Errorf(format, args...)
+}
@@ -0,0 +1,33 @@
+package gocomet
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+)
+
+type recordingLogger struct {
+	sync.Mutex
+	lines []string
+}
+
+func (l *recordingLogger) record(format string, args ...interface{}) {
+	l.Lock()
+	defer l.Unlock()
+	l.lines = append(l.lines, fmt.Sprintf(format, args...))
+}
+
+func (l *recordingLogger) Debugf(format string, args ...interface{}) { l.record(format, args...) }
+func (l *recordingLogger) Infof(format string, args ...interface{})  { l.record(format, args...) }
+func (l *recordingLogger) Errorf(format string, args ...interface{}) { l.record(format, args...) }
+
+func TestSetLogger(t *testing.T) {
+	logger := &recordingLogger{}
+	inst := New().SetLogger(logger)
+	post(t, inst, `[{"channel":"/meta/subscribe","clientId":"0123456789abcdef","subscription":"/foo/bar"}]`)
+	logger.Lock()
+	defer logger.Unlock()
+	assert(len(logger.lines) > 0, t, "logger should receive messages")
+	assert(strings.HasPrefix(logger.lines[0], "[01234567]"), t, "client ID prefix should be preserved (got %v)", logger.lines[0])
+}
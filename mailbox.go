@@ -0,0 +1,297 @@
+package gocomet
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+/*
+The storage of a session's unsent messages. It's only accessed by the
+goroutine of the session, so it needs not be thread-safe.
+*/
+type MailboxStore interface {
+	Append(msg *Message) error                 // add the message to the end
+	Remove(drop func(msg *Message) bool) error // remove those dropped, called in order
+	Drain() ([]*Message, error)                // remove and return all the messages in order
+	Len() int                                  // number of messages kept
+	Close() error                              // release the store, keeping the messages
+	Discard() error                            // release the store once the session ends
+}
+
+/*
+Create the mailbox store of a session by its resume token, which the
+client presents again to resume after a restart.
+*/
+type MailboxFactory func(token string) (MailboxStore, error)
+
+/*
+The default in-memory mailbox, which is lost on process restart.
+*/
+type memoryMailbox struct {
+	msgs []*Message
+}
+
+func newMemoryMailbox() MailboxStore {
+	return &memoryMailbox{}
+}
+
+func (m *memoryMailbox) Append(msg *Message) error {
+	m.msgs = append(m.msgs, msg)
+	return nil
+}
+
+func (m *memoryMailbox) Remove(drop func(msg *Message) bool) error {
+	kept := m.msgs[:0]
+	for _, msg := range m.msgs {
+		if !drop(msg) {
+			kept = append(kept, msg)
+		}
+	}
+	for i := len(kept); i < len(m.msgs); i++ {
+		m.msgs[i] = nil
+	}
+	m.msgs = kept
+	return nil
+}
+
+func (m *memoryMailbox) Drain() ([]*Message, error) {
+	msgs := m.msgs
+	m.msgs = nil
+	return msgs, nil
+}
+
+func (m *memoryMailbox) Len() int {
+	return len(m.msgs)
+}
+
+func (m *memoryMailbox) Close() error {
+	m.msgs = nil
+	return nil
+}
+
+func (m *memoryMailbox) Discard() error {
+	return m.Close()
+}
+
+// Minimum number of obsolete records in a mailbox file to compact it.
+const MAILBOX_COMPACT_THRESHOLD = 256
+
+/*
+A record in the mailbox file, either a message with its sequence
+number, or the sequence numbers of the messages removed.
+*/
+type mailboxRecord struct {
+	Seq       int64           `json:"seq,omitempty"`
+	Channel   string          `json:"channel,omitempty"`
+	Data      json.RawMessage `json:"data,omitempty"`
+	ClientId  string          `json:"clientId,omitempty"`
+	Queued    time.Time       `json:"queued"`
+	Timestamp time.Time       `json:"timestamp"`
+	Trace     string          `json:"trace,omitempty"`
+	Drop      []int64         `json:"drop,omitempty"`
+}
+
+/*
+A mailbox kept in a file as an append-only log of JSON records, one per
+line, so that the unsent messages survive a process restart and are
+replayed, in order, to the session resumed by the same token. The
+messages are mirrored in memory, and the file is compacted once the
+removed ones outnumber those kept. The file is kept on shutdown, and
+removed once the session ends otherwise. Writes are not synced, so a
+machine crash may still lose the latest messages.
+*/
+type fileMailbox struct {
+	path     string
+	file     *os.File
+	msgs     []*Message
+	seqs     []int64
+	next     int64 // sequence number of the next message
+	obsolete int   // records of the removed messages
+}
+
+/*
+Keep the mailboxes as files in the directory, one per session. The
+file of a session never resumed after a restart is left in place, and
+should be cleaned up by the operator.
+*/
+func FileMailboxStore(dir string) MailboxFactory {
+	return func(token string) (MailboxStore, error) {
+		return openFileMailbox(filepath.Join(dir, url.PathEscape(token)+".mailbox"))
+	}
+}
+
+func openFileMailbox(path string) (*fileMailbox, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	m := &fileMailbox{path: path, file: file, next: 1}
+	if err = m.replay(); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return m, nil
+}
+
+func (m *fileMailbox) replay() error {
+	index := make(map[int64]int) // position of the message by sequence number
+	records := 0
+	scanner := bufio.NewScanner(m.file)
+	scanner.Buffer(nil, MAX_CHUNKED_BYTES+4096)
+	for scanner.Scan() {
+		var r mailboxRecord
+		if json.Unmarshal(scanner.Bytes(), &r) != nil {
+			continue // e.g. partially written before a crash
+		}
+		records++
+		if r.Seq > 0 {
+			index[r.Seq] = len(m.msgs)
+			m.msgs = append(m.msgs, &Message{r.Channel, r.Data, r.ClientId, r.Queued, r.Timestamp, r.Trace})
+			m.seqs = append(m.seqs, r.Seq)
+			if r.Seq >= m.next {
+				m.next = r.Seq + 1
+			}
+		}
+		for _, seq := range r.Drop {
+			if i, ok := index[seq]; ok {
+				m.msgs[i] = nil
+				delete(index, seq)
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	msgs, seqs := m.msgs[:0], m.seqs[:0]
+	for i, msg := range m.msgs {
+		if msg != nil {
+			msgs = append(msgs, msg)
+			seqs = append(seqs, m.seqs[i])
+		}
+	}
+	m.msgs, m.seqs = msgs, seqs
+	m.obsolete = records - len(msgs)
+	return nil
+}
+
+func (m *fileMailbox) write(r *mailboxRecord) error {
+	line, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	_, err = m.file.Write(append(line, '\n'))
+	return err
+}
+
+func (m *fileMailbox) Append(msg *Message) error {
+	r := &mailboxRecord{Seq: m.next, Channel: msg.channel, Data: msg.data, ClientId: msg.clientId,
+		Queued: msg.queued, Timestamp: msg.timestamp, Trace: msg.trace}
+	if err := m.write(r); err != nil {
+		return err
+	}
+	m.msgs = append(m.msgs, msg)
+	m.seqs = append(m.seqs, m.next)
+	m.next++
+	return nil
+}
+
+func (m *fileMailbox) Remove(drop func(msg *Message) bool) error {
+	var dropped []int64
+	msgs, seqs := m.msgs[:0], m.seqs[:0]
+	for i, msg := range m.msgs {
+		if drop(msg) {
+			dropped = append(dropped, m.seqs[i])
+		} else {
+			msgs = append(msgs, msg)
+			seqs = append(seqs, m.seqs[i])
+		}
+	}
+	for i := len(msgs); i < len(m.msgs); i++ {
+		m.msgs[i] = nil
+	}
+	m.msgs, m.seqs = msgs, seqs
+	if len(dropped) == 0 {
+		return nil
+	}
+	if err := m.write(&mailboxRecord{Drop: dropped}); err != nil {
+		return err
+	}
+	m.obsolete += len(dropped) + 1
+	if m.obsolete >= MAILBOX_COMPACT_THRESHOLD && m.obsolete > len(m.msgs) {
+		return m.compact()
+	}
+	return nil
+}
+
+/*
+Rewrite the file with only the messages kept, replacing it atomically
+so that a crash leaves either the old file or the new one.
+*/
+func (m *fileMailbox) compact() error {
+	tmp, err := os.OpenFile(m.path+".tmp", os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(tmp)
+	for i, msg := range m.msgs {
+		line, _ := json.Marshal(&mailboxRecord{Seq: m.seqs[i], Channel: msg.channel, Data: msg.data,
+			ClientId: msg.clientId, Queued: msg.queued, Timestamp: msg.timestamp, Trace: msg.trace})
+		w.Write(append(line, '\n'))
+	}
+	if err = w.Flush(); err == nil {
+		err = tmp.Close()
+	} else {
+		tmp.Close()
+	}
+	if err == nil {
+		err = os.Rename(m.path+".tmp", m.path)
+	}
+	if err != nil {
+		os.Remove(m.path + ".tmp")
+		return err
+	}
+	file, err := os.OpenFile(m.path, os.O_RDWR|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	m.file.Close()
+	m.file = file
+	m.obsolete = 0
+	return nil
+}
+
+func (m *fileMailbox) Drain() ([]*Message, error) {
+	msgs := m.msgs
+	m.msgs, m.seqs = nil, nil
+	m.obsolete = 0
+	return msgs, m.file.Truncate(0)
+}
+
+func (m *fileMailbox) Len() int {
+	return len(m.msgs)
+}
+
+func (m *fileMailbox) Close() error {
+	return m.file.Close()
+}
+
+func (m *fileMailbox) Discard() error {
+	m.file.Close()
+	return os.Remove(m.path)
+}
+
+/*
+Set where to keep the unsent messages of the sessions, e.g. in files
+by FileMailboxStore. Sessions fall back to the in-memory mailbox if
+their store fails to open. It only affects sessions created afterwards.
+*/
+func (inst *Instance) SetMailboxStore(factory MailboxFactory) *Instance {
+	inst.Lock()
+	defer inst.Unlock()
+	inst.options.store = factory
+	return inst
+}
@@ -0,0 +1,120 @@
+package gocomet
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestFileMailbox(t *testing.T) {
+	dir := t.TempDir()
+	options := defaultSessionOptions
+	options.mailbox = 3
+	options.store = FileMailboxStore(dir)
+
+	// messages left by the previous process
+	store, err := options.store("token/1")
+	assert(err == nil, t, "failed to open mailbox: %v", err)
+	for i := 1; i <= 2; i++ {
+		store.Append(&Message{channel: "/foo", data: json.RawMessage(strconv.Itoa(i))})
+	}
+
+	input := make(chan *Message)
+	ss := newSession("client/1", "token/1", input, options, func(CloseReason, []*Message) {})
+	for i := 3; i <= 4; i++ {
+		input <- &Message{channel: "/foo", data: json.RawMessage(strconv.Itoa(i))}
+	}
+	ss.touch() // wait until the messages are saved
+	ch, _, _ := ss.obtainChannel(false)
+	var received []string
+	for msg := range ch {
+		received = append(received, string(msg.data))
+	}
+	assert(len(received) == 3 && received[0] == "2" && received[2] == "4", t, "saved messages should be replayed in order (got %v)", received)
+
+	ss.close()
+	<-ss.done
+	files, _ := filepath.Glob(filepath.Join(dir, "*"))
+	assert(len(files) == 0, t, "mailbox should be removed once the session ends (got %v)", files)
+}
+
+func TestFileMailboxCompaction(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "m.mailbox")
+	m, err := openFileMailbox(path)
+	assert(err == nil, t, "failed to open mailbox: %v", err)
+	for i := 1; i <= MAILBOX_COMPACT_THRESHOLD*2; i++ {
+		m.Append(&Message{channel: "/foo", data: json.RawMessage(strconv.Itoa(i))})
+		m.Remove(func(msg *Message) bool { return string(msg.data) == strconv.Itoa(i-3) })
+	}
+	assert(m.Len() == 3, t, "only the latest messages should be kept (got %v)", m.Len())
+	info, _ := os.Stat(path)
+	assert(info.Size() < 100*MAILBOX_COMPACT_THRESHOLD, t, "removed messages should be compacted (size %v)", info.Size())
+	m.Close()
+
+	m, err = openFileMailbox(path)
+	assert(err == nil, t, "failed to reopen mailbox: %v", err)
+	msgs, _ := m.Drain()
+	assert(len(msgs) == 3 && string(msgs[0].data) == strconv.Itoa(MAILBOX_COMPACT_THRESHOLD*2-2), t,
+		"kept messages should be replayed in order (got %v)", msgs)
+	m.Discard()
+}
+
+func TestMailboxKeptOnShutdown(t *testing.T) {
+	dir := t.TempDir()
+	inst := New().SetMailboxStore(FileMailboxStore(dir))
+	clientId := handshake(t, inst)
+	post(t, inst, `[{"channel":"/meta/subscribe","clientId":"`+clientId+`","subscription":"/foo/bar"}]`)
+	token := inst.resumeToken(clientId)
+	inst.Publish("/foo/bar", "kept")
+	inst.Shutdown(context.Background())
+
+	// the client resumes with the token after a restart
+	inst = New().SetMailboxStore(FileMailboxStore(dir))
+	_, resp := post(t, inst, `[{"channel":"/meta/handshake","version":"1.0","supportedConnectionTypes":["long-polling"],`+
+		`"ext":{"resume":{"clientId":"`+clientId+`","token":"`+token+`"}}}]`)
+	assert(len(resp) == 1 && resp[0].Successful, t, "handshake should succeed: %v", resp)
+	clientId = resp[0].ClientId
+	assert(inst.resumeToken(clientId) == token, t, "the token should be kept")
+	_, resp = post(t, inst, `[{"channel":"/meta/connect","clientId":"`+clientId+`","connectionType":"long-polling"}]`)
+	assert(len(resp) == 2 && string(resp[0].Data) == `"kept"`, t, "kept message should be replayed: %v", resp)
+}
+
+func TestSlowMailboxStore(t *testing.T) {
+	started, opening := make(chan bool), make(chan bool)
+	var calls int32
+	inst := New().SetMailboxStore(func(token string) (MailboxStore, error) {
+		if atomic.AddInt32(&calls, 1) == 1 { // the first one is replayed slowly
+			close(started)
+			<-opening
+		}
+		return newMemoryMailbox(), nil
+	})
+	slow, _ := inst.handshake()
+	<-started
+
+	handshaken := make(chan string)
+	go func() {
+		clientId, _ := inst.handshake()
+		inst.subscribe(clientId, "/foo/bar")
+		handshaken <- clientId
+	}()
+	select {
+	case <-handshaken:
+	case <-time.After(time.Second):
+		t.Fatal("other clients should not wait for a mailbox being opened")
+	}
+	assert(inst.resumeToken(slow) != "", t, "slow session should be live")
+
+	close(opening)
+	_, ok := inst.disconnect(slow)
+	assert(ok, t, "slow session should be disconnected once opened")
+	inst.RLock()
+	tokens := len(inst.tokens)
+	inst.RUnlock()
+	assert(tokens == 1, t, "token of the disconnected session should be released (got %v)", tokens)
+}
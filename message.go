@@ -1,40 +1,128 @@
 package gocomet
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
+	"sort"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
+/*
+The message passed from the broker through the sessions to the clients,
+and marshaled as EventMessage in the responses. It's the only message
+type used by the broker, sessions and transports.
+*/
 type Message struct {
-	channel string
-	data    string
+	channel   string
+	data      json.RawMessage
+	clientId  string    // the publisher, or empty if anonymous
+	queued    time.Time // when saved in the mailbox
+	timestamp time.Time // when published
+	trace     string    // ID of the trace of the publish, if traced
 }
 
 func (msg *Message) String() string {
-	return fmt.Sprintf("@%v: %v", msg.channel, msg.data)
+	return fmt.Sprintf("@%v: %s", msg.channel, msg.data)
+}
+
+func (msg *Message) Channel() string {
+	return msg.channel
+}
+
+func (msg *Message) Data() json.RawMessage {
+	return msg.data
+}
+
+/*
+The client ID of the publisher, or empty if it's published by the
+server or anonymously.
+*/
+func (msg *Message) ClientId() string {
+	return msg.clientId
+}
+
+func (msg *Message) Timestamp() time.Time {
+	return msg.timestamp
 }
 
+/*
+The broker dispatching messages between clients. Besides the local
+Broker, it may be backed by other systems to work across nodes.
+*/
+type messageBroker interface {
+	register(clientId string) chan *Message
+	deregister(clientId string)
+	subscribe(clientId, channel string) error
+	unsubscribe(clientId, channel string) bool
+	broadcast(clientId, channel string, msg json.RawMessage, exclude ...string)
+	broadcastTraced(span Span, clientId, channel string, msg json.RawMessage, exclude []string)
+	broadcastBatch(clientId, channel string, msgs []json.RawMessage, exclude ...string)
+	close()
+
+	// the local broker maintaining subscriptions and client channels
+	local() *Broker
+}
+
+var errTooManySubscriptions = errors.New("Too many subscriptions.")
+
+// Default number of messages buffered for each client, so that
+// broadcast isn't blocked by a client momentarily busy.
+const CLIENT_BUFFER = 64
+
 /*
 A simple Message Broker that transmits text messages between clients
 through subscribed channels.
 */
 type Broker struct {
 	*sync.RWMutex
-	clients map[string]chan *Message
-	router  *Router
-	rules   map[string]map[string]*Rule
+	clients  map[string]chan *Message
+	router   *Router
+	rules    map[string]map[string]*Rule
+	locks    map[string]*sync.Mutex // serialize subscription changes per client
+	guards   map[string]*sendGuard  // close the client channels after the senders
+	lossless map[string]bool        // clients never dropping messages, e.g. listeners
+	stats    *channelStats
+	health   *clientStats
+	counters *counters
+	logger   Logger
+
+	blocking bool             // block instead of drop if a client's buffer is full
+	maxSubs  int              // max number of subscriptions per client, or unlimited if 0
+	buffer   int              // capacity of the client channels
+	filters  []MessageFilter  // applied to every broadcast in order
+	now      func() time.Time // source of the message timestamps
+	tracer   Tracer
+	foldCase bool // match the channels case-insensitively
 }
 
+/*
+Rewrite the JSON data of a message broadcasted to the channel, or drop
+the message by returning false.
+*/
+type MessageFilter func(channel string, data string) (string, bool)
+
 /*
 Creates a message broker instance.
 */
 func newBroker() *Broker {
 	return &Broker{
-		RWMutex: &sync.RWMutex{},
-		clients: make(map[string]chan *Message),
-		router:  newRouter(),
-		rules:   make(map[string]map[string]*Rule),
+		RWMutex:  &sync.RWMutex{},
+		clients:  make(map[string]chan *Message),
+		guards:   make(map[string]*sendGuard),
+		lossless: make(map[string]bool),
+		router:   newRouter(),
+		rules:    make(map[string]map[string]*Rule),
+		locks:    make(map[string]*sync.Mutex),
+		stats:    newChannelStats(MAX_CHANNEL_STATS),
+		health:   newClientStats(),
+		counters: &counters{},
+		logger:   nopLogger{},
+		now:      time.Now,
+		tracer:   nopTracer{},
+		buffer:   CLIENT_BUFFER,
 	}
 }
 
@@ -47,24 +135,118 @@ func (b *Broker) register(clientId string) chan *Message {
 
 	ch, ok := b.clients[clientId]
 	if !ok {
-		ch = make(chan *Message)
+		ch = make(chan *Message, b.buffer)
 		b.clients[clientId] = ch
 		b.rules[clientId] = make(map[string]*Rule)
+		b.locks[clientId] = &sync.Mutex{}
+		b.guards[clientId] = &sendGuard{gone: make(chan bool)}
+		b.health.add(clientId)
 	}
 	return ch
 }
 
+/*
+Make broadcast wait for the client instead of dropping its messages,
+for a client which always keeps reading its channel.
+*/
+func (b *Broker) setLossless(clientId string) {
+	b.Lock()
+	defer b.Unlock()
+	if _, ok := b.clients[clientId]; ok {
+		b.lossless[clientId] = true
+	}
+}
+
+/*
+Lock the client for subscription changes. It returns nil if the client
+doesn't exist.
+*/
+func (b *Broker) lockClient(clientId string) *sync.Mutex {
+	b.RLock()
+	lock, ok := b.locks[clientId]
+	b.RUnlock()
+	if !ok {
+		return nil
+	}
+	lock.Lock()
+	if !b.hasClient(clientId) { // deregistered meanwhile
+		lock.Unlock()
+		return nil
+	}
+	return lock
+}
+
 /*
 Deregister an existing client and release all its subscribed channels.
 */
 func (b *Broker) deregister(clientId string) {
+	if lock := b.lockClient(clientId); lock != nil {
+		defer lock.Unlock()
+	}
 	b.Lock()
 	defer b.Unlock()
 	if ch, ok := b.clients[clientId]; ok {
+		guard := b.guards[clientId]
 		delete(b.clients, clientId)
-		close(ch) // close the channel
+		delete(b.guards, clientId)
+		delete(b.lossless, clientId)
+		close(guard.gone) // unblock the senders
+		guard.Lock()
+		close(ch) // close the channel once no one is sending
+		guard.Unlock()
 	}
+	b.removeRules(clientId)
 	delete(b.rules, clientId)
+	delete(b.locks, clientId)
+	b.health.remove(clientId)
+}
+
+/*
+Unsubscribe the client from all its channels at once. The client is
+kept registered. It returns the number of the removed subscriptions.
+*/
+func (b *Broker) unsubscribeAll(clientId string) int {
+	lock := b.lockClient(clientId)
+	if lock == nil {
+		return 0 // client ID not exists
+	}
+	defer lock.Unlock()
+
+	b.Lock()
+	defer b.Unlock()
+	return b.removeRules(clientId)
+}
+
+/*
+Remove all the rules of the client from the router. The broker should
+be locked already.
+*/
+func (b *Broker) removeRules(clientId string) int {
+	rules := b.rules[clientId]
+	for channel, rule := range rules {
+		rule.remove()
+		atomic.AddInt64(&b.counters.subscriptions, -1)
+		b.stats.update(channel, false, func(stat *ChannelStat) { stat.Subscribers-- })
+	}
+	if len(rules) > 0 {
+		b.rules[clientId] = make(map[string]*Rule)
+	}
+	return len(rules)
+}
+
+/*
+Normalize the channel to lower case if the channels are matched
+case-insensitively, so that the subscriptions and the broadcasts
+agree on it.
+*/
+func (b *Broker) normalize(channel string) string {
+	b.RLock()
+	fold := b.foldCase
+	b.RUnlock()
+	if fold {
+		return foldChannel(channel)
+	}
+	return channel
 }
 
 /*
@@ -72,9 +254,21 @@ Subscribe the client to the channel. After that, the client's own
 channel can get messages when others broadcast messages to the
 subscribed channel.
 */
-func (b *Broker) subscribe(clientId, channel string) {
-	if !b.hasClient(clientId) {
-		return // client ID not exists
+func (b *Broker) subscribe(clientId, channel string) error {
+	channel = b.normalize(channel)
+	lock := b.lockClient(clientId)
+	if lock == nil {
+		return nil // client ID not exists
+	}
+	defer lock.Unlock()
+
+	// the subscriptions of the client only change with its lock held
+	b.RLock()
+	_, exists := b.rules[clientId][channel]
+	full := b.maxSubs > 0 && !exists && len(b.rules[clientId]) >= b.maxSubs
+	b.RUnlock()
+	if full {
+		return errTooManySubscriptions
 	}
 
 	rule := b.router.add(channel, clientId)
@@ -82,7 +276,12 @@ func (b *Broker) subscribe(clientId, channel string) {
 	b.Lock()
 	defer b.Unlock()
 
+	if _, ok := b.rules[clientId][channel]; !ok {
+		atomic.AddInt64(&b.counters.subscriptions, 1)
+		b.stats.update(channel, true, func(stat *ChannelStat) { stat.Subscribers++ })
+	}
 	b.rules[clientId][channel] = rule
+	return nil
 }
 
 func (b *Broker) hasClient(clientId string) (ok bool) {
@@ -97,9 +296,12 @@ Unsubscribe the client from the channel. After that, the future
 messages or pending messages are ceased.
 */
 func (b *Broker) unsubscribe(clientId, channel string) bool {
-	if !b.hasClient(clientId) {
+	channel = b.normalize(channel)
+	lock := b.lockClient(clientId)
+	if lock == nil {
 		return false // client ID not exists
 	}
+	defer lock.Unlock()
 
 	b.Lock()
 	defer b.Unlock()
@@ -107,32 +309,317 @@ func (b *Broker) unsubscribe(clientId, channel string) bool {
 	if rule, ok := b.rules[clientId][channel]; ok {
 		rule.remove()
 		delete(b.rules[clientId], channel)
+		atomic.AddInt64(&b.counters.subscriptions, -1)
+		b.stats.update(channel, false, func(stat *ChannelStat) { stat.Subscribers-- })
 		return true
 	}
 	return false
 }
 
 /*
-Broadcast the message to the given channel. This method is supposed
-to be non-blocking style iff the target channels are actively
-monitored. The broker client may choose to implement a different
-strategy, like message ordering or persistence. The broker doesn't
-guarrantee message delivery though.
+Broadcast the message to the given channel. This method is
+non-blocking style unless the broker is set to block, so one slow
+client doesn't stall the others. The broker client may choose to
+implement a different strategy, like message ordering or persistence.
+The broker doesn't guarrantee message delivery though, the message is
+dropped for a client whose buffer is full. The publisher's client ID is
+delivered along with the message, which is empty for anonymous ones.
+The excluded clients, e.g. the publisher, don't receive the message.
 */
-func (b *Broker) broadcast(channel, msg string) {
-	targets := b.router.run(channel)
+func (b *Broker) broadcast(clientId, channel string, msg json.RawMessage, exclude ...string) {
+	b.broadcastAt(nopSpan{}, clientId, channel, msg, b.timestamp(), exclude)
+}
+
+/*
+Broadcast the message as a child of the span of its publish.
+*/
+func (b *Broker) broadcastTraced(span Span, clientId, channel string, msg json.RawMessage, exclude []string) {
+	b.broadcastAt(span, clientId, channel, msg, b.timestamp(), exclude)
+}
+
+func (b *Broker) timestamp() time.Time {
+	b.RLock()
+	now := b.now
+	b.RUnlock()
+	return now()
+}
+
+/*
+Broadcast the message published at the given time, e.g. on another
+node.
+*/
+func (b *Broker) broadcastAt(parent Span, clientId, channel string, msg json.RawMessage, timestamp time.Time, exclude []string) {
+	channel = b.normalize(channel)
+	span := parent.Child("broadcast")
+	defer span.End()
+	var ok bool
+	if msg, ok = b.filter(channel, msg); !ok {
+		span.SetTag("filtered", true)
+		return
+	}
+	if isWildcard(channel) {
+		b.broadcastPattern(span, clientId, channel, msg, timestamp, exclude)
+		return
+	}
+	targets := excludeClients(b.router.run(channel), exclude)
+	b.deliver(span, clientId, channel, msg, timestamp, targets)
+}
+
+/*
+Broadcast the messages to the channel in order, each as a separate
+message, resolving the subscribers only once for all of them.
+*/
+func (b *Broker) broadcastBatch(clientId, channel string, msgs []json.RawMessage, exclude ...string) {
+	channel = b.normalize(channel)
+	timestamp := b.timestamp()
+	if isWildcard(channel) {
+		for _, msg := range msgs {
+			b.broadcastAt(nopSpan{}, clientId, channel, msg, timestamp, exclude)
+		}
+		return
+	}
+	targets := excludeClients(b.router.run(channel), exclude)
+	for _, msg := range msgs {
+		var ok bool
+		if msg, ok = b.filter(channel, msg); ok {
+			b.deliver(nopSpan{}, clientId, channel, msg, timestamp, targets)
+		}
+	}
+}
+
+func (b *Broker) deliver(span Span, clientId, channel string, msg json.RawMessage, timestamp time.Time, targets []string) {
+	b.stats.update(channel, true, func(stat *ChannelStat) {
+		stat.Publishes++
+		stat.Deliveries += len(targets)
+	})
 	if len(targets) > 0 {
-		log.Printf("[Broker]Broadcast to %v", targets)
+		b.logger.Debugf("[Broker]Broadcast to %v", targets)
 		for _, c := range targets {
-			b.send(c, &Message{channel, msg})
+			b.sendTraced(span, c, &Message{channel: channel, data: msg, clientId: clientId, timestamp: timestamp})
+		}
+	}
+}
+
+/*
+Broadcast the message to all the channels matching the pattern. To
+avoid double delivery, a client subscribing to some of the matching
+channels receives a copy on each of them, while a client matching only
+with wildcard subscriptions, e.g. /** for /foo/*, receives a single
+copy on the pattern. Neither receives a copy for each channel its
+wildcard subscriptions cover.
+*/
+func (b *Broker) broadcastPattern(span Span, clientId, pattern string, msg json.RawMessage, timestamp time.Time, exclude []string) {
+	channels := make(map[string][]string) // of the matched clients
+	for _, rule := range b.router.reverse(pattern) {
+		if isWildcard(rule.Pattern) {
+			if _, ok := channels[rule.ClientId]; !ok {
+				channels[rule.ClientId] = nil
+			}
+		} else {
+			channels[rule.ClientId] = append(channels[rule.ClientId], rule.Pattern)
+		}
+	}
+	for _, c := range exclude {
+		delete(channels, c)
+	}
+	deliveries := 0
+	for c, matched := range channels {
+		if len(matched) == 0 {
+			matched = []string{pattern}
+		}
+		sort.Strings(matched)
+		for _, channel := range matched {
+			b.sendTraced(span, c, &Message{channel: channel, data: msg, clientId: clientId, timestamp: timestamp})
 		}
+		deliveries += len(matched)
+	}
+	b.stats.update(pattern, true, func(stat *ChannelStat) {
+		stat.Publishes++
+		stat.Deliveries += deliveries
+	})
+}
+
+func excludeClients(targets, exclude []string) []string {
+	if len(exclude) == 0 {
+		return targets
+	}
+	result := targets[:0]
+	for _, c := range targets {
+		if !contains(exclude, c) {
+			result = append(result, c)
+		}
+	}
+	return result
+}
+
+func contains(ids []string, id string) bool {
+	for _, v := range ids {
+		if v == id {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+Guard a client channel against being closed by a racing deregister
+while a message is being sent to it.
+*/
+type sendGuard struct {
+	sync.RWMutex           // held by the senders
+	gone         chan bool // closed once the client is deregistered
+}
+
+func (b *Broker) send(client string, msg *Message) bool {
+	return b.sendTo(client, nil, msg)
+}
+
+/*
+Send the message in a child span of the broadcast, tagged with the
+client ID and whether it's delivered.
+*/
+func (b *Broker) sendTraced(parent Span, client string, msg *Message) {
+	msg.trace = parent.TraceId()
+	span := parent.Child("deliver")
+	span.SetTag("clientId", client)
+	span.SetTag("delivered", b.send(client, msg))
+	span.End()
+}
+
+/*
+Send the message to the client, only by the given channel unless it's
+nil, so that it never reaches another client reusing the ID. It returns
+whether the message is delivered.
+*/
+func (b *Broker) sendTo(client string, expected chan *Message, msg *Message) bool {
+	b.RLock()
+	ch, guard, blocking := b.clients[client], b.guards[client], b.blocking || b.lossless[client]
+	b.RUnlock()
+	if ch == nil || expected != nil && ch != expected {
+		return false // deregistered already
+	}
+	guard.RLock()
+	defer guard.RUnlock()
+	select {
+	case <-guard.gone: // deregistered meanwhile, and the channel may be closed
+		return false
+	default:
+	}
+	b.logger.Debugf("[%8.8v]Receiving message: %v", client, msg)
+	if blocking {
+		select {
+		case ch <- msg:
+			atomic.AddInt64(&b.counters.delivered, 1)
+			b.health.update(client, func(stat *ClientStat) { stat.Delivered++ })
+			return true
+		case <-guard.gone:
+			return false
+		}
+	}
+	select {
+	case ch <- msg:
+		atomic.AddInt64(&b.counters.delivered, 1)
+		b.health.update(client, func(stat *ClientStat) { stat.Delivered++ })
+		return true
+	default:
+		b.logger.Infof("[%8.8v]Dropped message: %v", client, msg)
+		b.health.update(client, func(stat *ClientStat) { stat.Dropped++ })
+		return false
+	}
+}
+
+/*
+List the clients whose subscriptions match the concrete channel.
+*/
+func (b *Broker) subscribers(channel string) []string {
+	clients := b.router.run(channel)
+	sort.Strings(clients)
+	return clients
+}
+
+/*
+List the channels subscribed by the client.
+*/
+func (b *Broker) channels(clientId string) []string {
+	b.RLock()
+	defer b.RUnlock()
+
+	channels := make([]string, 0, len(b.rules[clientId]))
+	for channel := range b.rules[clientId] {
+		channels = append(channels, channel)
 	}
+	sort.Strings(channels)
+	return channels
 }
 
-func (b *Broker) send(client string, msg *Message) {
+func (b *Broker) close() {}
+
+func (b *Broker) local() *Broker {
+	return b
+}
+
+/*
+Set whether to block broadcast if a client's buffer is full, instead
+of dropping the message.
+*/
+func (b *Broker) setBlocking(blocking bool) {
+	b.Lock()
+	defer b.Unlock()
+	b.blocking = blocking
+}
+
+/*
+Set the capacity of the channels of the clients registered afterwards.
+*/
+func (b *Broker) setClientBuffer(n int) {
+	b.Lock()
+	defer b.Unlock()
+	b.buffer = n
+}
+
+/*
+Set the max number of subscriptions per client, beyond which subscribe
+fails with errTooManySubscriptions. It's unlimited if 0.
+*/
+func (b *Broker) setMaxSubscriptions(n int) {
+	b.Lock()
+	defer b.Unlock()
+	b.maxSubs = n
+}
+
+/*
+Add a filter applied to every message broadcasted afterwards, after
+the ones added before.
+*/
+func (b *Broker) addFilter(filter MessageFilter) {
+	b.Lock()
+	defer b.Unlock()
+	b.filters = append(b.filters, filter)
+}
+
+/*
+Run the filters on the message once for all the subscribers. A message
+rewritten to invalid JSON is dropped.
+*/
+func (b *Broker) filter(channel string, msg json.RawMessage) (json.RawMessage, bool) {
 	b.RLock()
-	ch := b.clients[client]
+	filters := b.filters
 	b.RUnlock()
-	log.Printf("[%8.8v]Receiving message: %v", client, msg)
-	ch <- msg
+	if len(filters) == 0 {
+		return msg, true
+	}
+
+	data := string(msg)
+	for _, filter := range filters {
+		var ok bool
+		if data, ok = filter(channel, data); !ok {
+			b.logger.Debugf("[Broker]Filtered message at '%v'", channel)
+			return nil, false
+		}
+	}
+	if !json.Valid([]byte(data)) {
+		b.logger.Errorf("[Broker]Filtered message at '%v' is invalid: %v", channel, data)
+		return nil, false
+	}
+	return json.RawMessage(data), true
 }
@@ -1,8 +1,12 @@
 package gocomet
 
 import (
-	"runtime"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestClientLifeCycle(t *testing.T) {
@@ -19,30 +23,207 @@ func assert(ok bool, t *testing.T, format string, args ...interface{}) {
 	}
 }
 
+func TestClientBuffer(t *testing.T) {
+	b := newBroker()
+	assert(cap(b.register("client1")) == CLIENT_BUFFER, t, "expect the default buffer")
+	b.setClientBuffer(8)
+	assert(cap(b.register("client2")) == 8, t, "expect the configured buffer")
+	assert(cap(b.register("client1")) == CLIENT_BUFFER, t, "existing client should be kept")
+}
+
 func TestMessageBroadcast(t *testing.T) {
 	b := newBroker()
 	ch := b.register("client")
-	var msg *Message
-	go func() { msg = <-ch }()
-	b.broadcast("/foo/bar", "hello")
+	b.broadcast("", "/foo/bar", json.RawMessage(`"hello"`))
 	assert(len(ch) == 0, t, "nothing should happens")
 	b.subscribe("client", "/foo/bar")
-	b.broadcast("/foo/bar", "hello again")
-	runtime.Gosched()
-	assert(msg.data == "hello again", t, "failed to receive message")
+	b.broadcast("", "/foo/bar", json.RawMessage(`"hello again"`))
+	msg := nextMessage(ch)
+	assert(msg != nil && string(msg.data) == `"hello again"`, t, "failed to receive message")
 }
 
 func TestChannelUnsubscribe(t *testing.T) {
 	b := newBroker()
 	clientId := "client"
 	ch := b.register(clientId)
-	var msg *Message
-	go func() { msg = <-ch }()
 	b.subscribe(clientId, "/foo/bar")
-	b.broadcast("/foo/bar", "hello")
-	runtime.Gosched()
-	assert(msg.data == "hello", t, "failed to receive message")
+	b.broadcast("", "/foo/bar", json.RawMessage(`"hello"`))
+	msg := nextMessage(ch)
+	assert(msg != nil && string(msg.data) == `"hello"`, t, "failed to receive message")
 	b.unsubscribe(clientId, "/foo/bar")
-	b.broadcast("/foo/bar", "hello again")
+	b.broadcast("", "/foo/bar", json.RawMessage(`"hello again"`))
 	assert(len(ch) == 0, t, "nothing should happens")
 }
+
+func TestUnsubscribeWildcard(t *testing.T) {
+	for _, order := range [][]string{{"/foo/bar", "/foo/*"}, {"/foo/*", "/foo/bar"}} {
+		b := newBroker()
+		ch := b.register("client")
+		b.register("other")
+		b.subscribe("other", "/foo/bar")
+		for _, channel := range order {
+			b.subscribe("client", channel)
+		}
+		assert(b.unsubscribe("client", "/foo/*"), t, "wildcard should be unsubscribed")
+
+		b.broadcast("", "/foo/bar", json.RawMessage(`"hello"`))
+		b.broadcast("", "/foo/baz", json.RawMessage(`"hello"`))
+		if len(ch) != 1 {
+			t.Errorf("concrete subscription should be kept after %v (got %v messages)", order, len(ch))
+		} else {
+			msg := <-ch
+			assert(msg.channel == "/foo/bar", t, "only /foo/bar should be delivered (got %v)", msg)
+		}
+		res := b.router.run("/foo/bar")
+		assert(len(res) == 2, t, "concrete rules should be kept in the router: %v", b.router)
+		assert(b.unsubscribe("client", "/foo/bar"), t, "concrete rule should be removed by itself")
+		assert(len(b.router.run("/foo/bar")) == 1, t, "only the rule of the other client should be left: %v", b.router)
+	}
+}
+
+func TestConcurrentSubscription(t *testing.T) {
+	b := newBroker()
+	clientId := "client"
+	b.register(clientId)
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(2)
+		go func() { defer wg.Done(); b.subscribe(clientId, "/foo/bar") }()
+		go func() { defer wg.Done(); b.unsubscribe(clientId, "/foo/bar") }()
+	}
+	wg.Wait()
+
+	_, subscribed := b.rules[clientId]["/foo/bar"]
+	routed := len(b.router.run("/foo/bar")) > 0
+	assert(subscribed == routed, t, "router and rules should agree (subscribed %v, routed %v)", subscribed, routed)
+}
+
+func TestStuckConsumer(t *testing.T) {
+	b := newBroker()
+	b.register("stuck") // never read
+	ch := b.register("client")
+	b.subscribe("stuck", "/foo/bar")
+	b.subscribe("client", "/foo/bar")
+
+	received := make(chan bool)
+	go func() {
+		<-ch
+		close(received)
+	}()
+	done := make(chan bool)
+	go func() {
+		for i := 0; i < CLIENT_BUFFER*2; i++ {
+			b.broadcast("", "/foo/bar", json.RawMessage(`"ping"`))
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("broadcast should not be stalled by a stuck consumer")
+	}
+	select {
+	case <-received:
+	case <-time.After(time.Second):
+		t.Error("other subscribers should still receive messages")
+	}
+}
+
+func TestDeregisterWhileBroadcasting(t *testing.T) {
+	for _, blocking := range []bool{false, true} {
+		b := newBroker()
+		b.setBlocking(blocking)
+		done := make(chan bool)
+		go func() {
+			for {
+				select {
+				case <-done:
+					return
+				default:
+					b.broadcast("", "/foo/bar", json.RawMessage(`"ping"`))
+				}
+			}
+		}()
+		for i := 0; i < 200; i++ {
+			clientId := fmt.Sprintf("client%d", i)
+			ch := b.register(clientId)
+			b.subscribe(clientId, "/foo/bar")
+			if i%2 == 0 {
+				<-ch
+			}
+			b.deregister(clientId)
+			for range ch {
+				// drain the messages sent before
+			}
+		}
+		close(done)
+	}
+}
+
+func TestUnsubscribeAll(t *testing.T) {
+	b := newBroker()
+	b.register("client")
+	b.register("other")
+	b.subscribe("client", "/foo/bar")
+	b.subscribe("client", "/foo/*")
+	b.subscribe("client", "/baz/**")
+	b.subscribe("other", "/foo/bar")
+	assert(b.unsubscribeAll("client") == 3, t, "all subscriptions should be removed")
+	for _, channel := range []string{"/foo/bar", "/foo/qux", "/baz/qux/quux"} {
+		assert(!contains(b.router.run(channel), "client"), t, "no rule should match the client on %v: %v", channel, b.router)
+	}
+	res := b.router.run("/foo/bar")
+	assert(len(res) == 1 && res[0] == "other", t, "others should not be affected (got %v)", res)
+	assert(b.hasClient("client") && len(b.channels("client")) == 0, t, "client should be kept without channels")
+	assert(b.unsubscribeAll("unknown") == 0, t, "unknown client has nothing to remove")
+}
+
+func TestBroadcastPattern(t *testing.T) {
+	b := newBroker()
+	room1, room2, all := b.register("room1"), b.register("room2"), b.register("all")
+	b.subscribe("room1", "/rooms/1")
+	b.subscribe("room2", "/rooms/2")
+	b.subscribe("room2", "/rooms/3")
+	b.subscribe("all", "/**")
+	b.subscribe("all", "/rooms/*")
+	b.broadcast("", "/rooms/*", json.RawMessage(`"hi"`))
+	time.Sleep(10 * time.Millisecond)
+	receive := func(ch chan *Message) (channels []string) {
+		for len(ch) > 0 {
+			channels = append(channels, (<-ch).channel)
+		}
+		return
+	}
+	res := receive(room1)
+	assert(len(res) == 1 && res[0] == "/rooms/1", t, "subscriber should receive on its channel (got %v)", res)
+	res = receive(room2)
+	assert(len(res) == 2 && res[0] == "/rooms/2" && res[1] == "/rooms/3", t, "subscriber should receive on each of its channels (got %v)", res)
+	res = receive(all)
+	assert(len(res) == 1 && res[0] == "/rooms/*", t, "wildcard subscriber should receive a single copy (got %v)", res)
+}
+
+func TestMessageFilter(t *testing.T) {
+	b := newBroker()
+	ch := b.register("client")
+	b.subscribe("client", "/foo/*")
+	var calls []string
+	b.addFilter(func(channel, data string) (string, bool) {
+		calls = append(calls, "drop")
+		return data, channel != "/foo/secret"
+	})
+	b.addFilter(func(channel, data string) (string, bool) {
+		calls = append(calls, "redact")
+		return strings.Replace(data, "1234", "****", -1), true
+	})
+	b.addFilter(func(channel, data string) (string, bool) {
+		return data, data != `"broken"`
+	})
+	b.broadcast("", "/foo/secret", json.RawMessage(`"hidden"`))
+	b.broadcast("", "/foo/card", json.RawMessage(`"card 1234"`))
+	b.broadcast("", "/foo/card", json.RawMessage(`"broken"`))
+	time.Sleep(10 * time.Millisecond)
+	assert(len(ch) == 1, t, "filtered messages should be dropped (got %v)", len(ch))
+	msg := <-ch
+	assert(string(msg.data) == `"card ****"`, t, "message should be rewritten (got %s)", msg.data)
+	assert(strings.Join(calls, ",") == "drop,drop,redact,drop,redact", t, "filters should run in order once per broadcast (got %v)", calls)
+}
@@ -0,0 +1,97 @@
+package gocomet
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// Upper bounds of the buckets of the mailbox depth histogram.
+var mailboxDepthBuckets = []int64{0, 1, 10, 100, 1000}
+
+/*
+Expose the metrics in the Prometheus text format, e.g. to be mounted at
+/metrics. It's formatted here, so there's no dependency on the
+Prometheus client.
+*/
+func (inst *Instance) MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		stats := inst.Stats()
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		metric := func(name, kind, help string, value int64) {
+			fmt.Fprintf(w, "# HELP %v %v\n# TYPE %v %v\n%v %v\n", name, help, name, kind, name, value)
+		}
+		metric("gocomet_clients_connected", "gauge", "Number of connected clients.", stats.Clients)
+		metric("gocomet_messages_published_total", "counter", "Total messages published.", stats.Published)
+		metric("gocomet_messages_delivered_total", "counter", "Total messages delivered to the clients.", stats.Delivered)
+		metric("gocomet_subscriptions", "gauge", "Number of active subscriptions.", stats.Subscriptions)
+
+		counts, sum, total := inst.mailboxDepths()
+		fmt.Fprintf(w, "# HELP gocomet_mailbox_depth Number of messages in the mailbox of a session.\n")
+		fmt.Fprintf(w, "# TYPE gocomet_mailbox_depth histogram\n")
+		for i, le := range mailboxDepthBuckets {
+			fmt.Fprintf(w, "gocomet_mailbox_depth_bucket{le=\"%v\"} %v\n", le, counts[i])
+		}
+		fmt.Fprintf(w, "gocomet_mailbox_depth_bucket{le=\"+Inf\"} %v\n", total)
+		fmt.Fprintf(w, "gocomet_mailbox_depth_sum %v\ngocomet_mailbox_depth_count %v\n", sum, total)
+	})
+}
+
+type healthInfo struct {
+	Clients int64   `json:"clients"`
+	Uptime  float64 `json:"uptime"` // in seconds
+}
+
+/*
+Check the health of the instance, e.g. by a load balancer, without
+talking Bayeux. It answers any request with 200 and a JSON body like
+{"clients":2,"uptime":12.5}, or 503 once the instance is shutting down.
+It's meant to be mounted at its own path like /health, apart from the
+Bayeux endpoint.
+*/
+func (inst *Instance) HealthHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		inst.inflight.Lock()
+		shuttingDown := inst.shuttingDown
+		inst.inflight.Unlock()
+
+		data, _ := json.Marshal(&healthInfo{
+			Clients: inst.Stats().Clients,
+			Uptime:  time.Since(inst.started).Seconds(),
+		})
+		w.Header().Set("Content-Type", "application/json;charset=UTF-8")
+		w.Header().Set("Cache-Control", "no-cache")
+		if shuttingDown {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		w.Write(data)
+	})
+}
+
+/*
+Sample the mailbox depths of the sessions into the cumulative counts of
+the histogram buckets.
+*/
+func (c *Server) mailboxDepths() (counts []int64, sum, total int64) {
+	c.RLock()
+	depths := make([]*int64, 0, len(c.sessions))
+	for _, ss := range c.sessions {
+		depths = append(depths, ss.depth)
+	}
+	c.RUnlock()
+
+	counts = make([]int64, len(mailboxDepthBuckets))
+	for _, p := range depths {
+		depth := atomic.LoadInt64(p)
+		for i, le := range mailboxDepthBuckets {
+			if depth <= le {
+				counts[i]++
+			}
+		}
+		sum += depth
+		total++
+	}
+	return
+}
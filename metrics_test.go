@@ -0,0 +1,62 @@
+package gocomet
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetricsHandler(t *testing.T) {
+	inst := New()
+	subscriber := handshake(t, inst)
+	post(t, inst, `[{"channel":"/meta/subscribe","clientId":"`+subscriber+`","subscription":"/foo"}]`)
+	handshake(t, inst)
+	for i := 0; i < 3; i++ {
+		inst.Publish("/foo", i)
+	}
+	time.Sleep(20 * time.Millisecond) // until the messages are in the mailbox
+
+	w := httptest.NewRecorder()
+	inst.MetricsHandler().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	body, _ := ioutil.ReadAll(w.Body)
+	for _, line := range []string{
+		"# TYPE gocomet_clients_connected gauge",
+		"gocomet_clients_connected 2",
+		"gocomet_messages_published_total 3",
+		"gocomet_messages_delivered_total 3",
+		"gocomet_subscriptions 1",
+		"# TYPE gocomet_mailbox_depth histogram",
+		`gocomet_mailbox_depth_bucket{le="0"} 1`,
+		`gocomet_mailbox_depth_bucket{le="1"} 1`,
+		`gocomet_mailbox_depth_bucket{le="10"} 2`,
+		`gocomet_mailbox_depth_bucket{le="+Inf"} 2`,
+		"gocomet_mailbox_depth_sum 3",
+		"gocomet_mailbox_depth_count 2",
+	} {
+		assert(strings.Contains(string(body), line+"\n"), t, "metrics should contain %v (got %s)", line, body)
+	}
+}
+
+func TestHealthHandler(t *testing.T) {
+	inst := New()
+	handshake(t, inst)
+	handshake(t, inst)
+	check := func() (code int, health healthInfo) {
+		w := httptest.NewRecorder()
+		inst.HealthHandler().ServeHTTP(w, httptest.NewRequest("GET", "/health", nil))
+		if err := json.Unmarshal(w.Body.Bytes(), &health); err != nil {
+			t.Fatalf("invalid health '%v': %v", w.Body.String(), err)
+		}
+		return w.Code, health
+	}
+	code, health := check()
+	assert(code == 200 && health.Clients == 2 && health.Uptime > 0, t, "healthy instance should be reported (got %v, %+v)", code, health)
+
+	inst.Shutdown(context.Background())
+	code, health = check()
+	assert(code == 503 && health.Clients == 0, t, "instance shutting down should be unavailable (got %v, %+v)", code, health)
+}
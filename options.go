@@ -0,0 +1,29 @@
+package gocomet
+
+import "time"
+
+/*
+An option of New, e.g. New(WithSessionTimeout(time.Minute)), which is
+the same as calling the corresponding setter on the new instance.
+*/
+type Option func(inst *Instance)
+
+func WithSessionTimeout(d time.Duration) Option {
+	return func(inst *Instance) { inst.SetSessionTimeout(d) }
+}
+
+func WithLogger(logger Logger) Option {
+	return func(inst *Instance) { inst.SetLogger(logger) }
+}
+
+func WithMailbox(size int, policy OverflowPolicy) Option {
+	return func(inst *Instance) { inst.SetMailbox(size, policy) }
+}
+
+func WithSecurityPolicy(policy SecurityPolicy) Option {
+	return func(inst *Instance) { inst.SetSecurityPolicy(policy) }
+}
+
+func WithConnectionTypes(types ...string) Option {
+	return func(inst *Instance) { inst.SetConnectionTypes(types) }
+}
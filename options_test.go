@@ -0,0 +1,26 @@
+package gocomet
+
+import (
+	"testing"
+	"time"
+)
+
+func TestOptions(t *testing.T) {
+	logger := &recordingLogger{}
+	inst := New(
+		WithSessionTimeout(2*time.Second),
+		WithLogger(logger),
+		WithMailbox(10, DropNewest),
+		WithSecurityPolicy(readOnlyPolicy{}),
+		WithConnectionTypes("long-polling", "unknown"),
+	)
+	assert(inst.options.timeout == 2*time.Second, t, "session timeout should be set (got %v)", inst.options.timeout)
+	assert(inst.options.mailbox == 10 && inst.options.overflow == DropNewest, t, "mailbox should be set (got %v, %v)",
+		inst.options.mailbox, inst.options.overflow)
+	assert(inst.policy == readOnlyPolicy{}, t, "security policy should be set (got %v)", inst.policy)
+	assert(len(inst.connectionTypes) == 1 && inst.connectionTypes[0] == "long-polling", t,
+		"connection types should be set (got %v)", inst.connectionTypes)
+	logger.Lock()
+	defer logger.Unlock()
+	assert(len(logger.lines) == 1, t, "options after the logger should log to it (got %v)", logger.lines)
+}
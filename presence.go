@@ -0,0 +1,46 @@
+package gocomet
+
+import (
+	"encoding/json"
+)
+
+const (
+	PRESENCE_SUBSCRIBE   = "subscribe"
+	PRESENCE_UNSUBSCRIBE = "unsubscribe"
+)
+
+/*
+The presence notification broadcasted when a client subscribes or
+unsubscribes a channel.
+*/
+type presenceMessage struct {
+	ClientId string `json:"clientId"`
+	Action   string `json:"action"`
+}
+
+/*
+Enable presence notifications. Once a client subscribes or unsubscribes
+a channel, e.g. /chat/room1, a message carrying the client ID and the
+action is broadcasted to the channel under the prefix, e.g.
+/meta/presence/chat/room1 with the prefix "/meta/presence". A wildcard
+subscription like /chat/* isn't notified, since it's not a member of
+any channel. An empty prefix disables the notifications, which is the
+default.
+*/
+func (inst *Instance) EnablePresence(prefix string) *Instance {
+	inst.Lock()
+	defer inst.Unlock()
+	inst.presence = prefix
+	return inst
+}
+
+func (c *Server) notifyPresence(clientId, channel, action string) {
+	c.RLock()
+	prefix := c.presence
+	c.RUnlock()
+	if prefix == "" || isWildcard(channel) {
+		return
+	}
+	data, _ := json.Marshal(&presenceMessage{clientId, action})
+	c.broker.broadcast("", prefix+channel, data)
+}
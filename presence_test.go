@@ -0,0 +1,53 @@
+package gocomet
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestPresence(t *testing.T) {
+	inst := New().EnablePresence("/meta/presence")
+	watcher, _ := inst.handshake()
+	inst.subscribe(watcher, "/meta/presence/chat/room1")
+	member, _ := inst.handshake()
+	inst.subscribe(member, "/chat/room1")
+	inst.unsubscribe(member, "/chat/room1")
+	time.Sleep(10 * time.Millisecond)
+
+	ch, _, _ := inst.connect(watcher)
+	var msgs []*Message
+	for len(ch) > 0 {
+		msgs = append(msgs, <-ch)
+	}
+	assert(len(msgs) == 2, t, "watcher should see join and leave (got %v)", msgs)
+	var p presenceMessage
+	json.Unmarshal(msgs[0].data, &p)
+	assert(p.ClientId == member && p.Action == PRESENCE_SUBSCRIBE, t, "unexpected join %v", msgs[0])
+	json.Unmarshal(msgs[1].data, &p)
+	assert(p.ClientId == member && p.Action == PRESENCE_UNSUBSCRIBE, t, "unexpected leave %v", msgs[1])
+}
+
+func TestPresenceDisabled(t *testing.T) {
+	inst := New()
+	watcher, _ := inst.handshake()
+	inst.subscribe(watcher, "/meta/presence/chat/room1")
+	member, _ := inst.handshake()
+	inst.subscribe(member, "/chat/room1")
+	stats := inst.ChannelStats()
+	_, ok := stats["/meta/presence/chat/room1"]
+	assert(ok && stats["/meta/presence/chat/room1"].Publishes == 0, t, "presence should be off by default (got %v)", stats)
+}
+
+func TestPresenceWildcard(t *testing.T) {
+	inst := New().EnablePresence("/meta/presence")
+	watcher, _ := inst.handshake()
+	inst.subscribe(watcher, "/meta/presence/chat/room1")
+	lurker, _ := inst.handshake()
+	inst.subscribe(lurker, "/chat/*")
+	inst.unsubscribe(lurker, "/chat/*")
+	time.Sleep(10 * time.Millisecond)
+
+	ch, _, _ := inst.connect(watcher)
+	assert(len(ch) == 0, t, "wildcard subscriber should not be present in a room (got %v messages)", len(ch))
+}
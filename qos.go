@@ -0,0 +1,69 @@
+package gocomet
+
+import (
+	"sync"
+)
+
+/*
+The delivery guarantee of the messages of a channel within a session.
+*/
+type QoS int
+
+const (
+	// Kept in the mailbox until delivered, and put back once a delivery
+	// fails, e.g. the client is gone before the response is written, so
+	// that it's replayed on the next connect. It's the default.
+	AtLeastOnce QoS = iota
+	// Never put back once a delivery fails, and dropped before the others
+	// once the mailbox is full, e.g. for high-volume telemetry which
+	// isn't worth buffering.
+	AtMostOnce
+)
+
+/*
+The channel patterns opted into AtMostOnce, matched by a router.
+*/
+type qosTable struct {
+	sync.Mutex
+	router *Router
+	rules  map[string]*Rule // by pattern
+}
+
+func newQosTable() *qosTable {
+	return &qosTable{router: newRouter(), rules: make(map[string]*Rule)}
+}
+
+func (t *qosTable) set(pattern string, qos QoS) {
+	t.Lock()
+	defer t.Unlock()
+	if rule, ok := t.rules[pattern]; ok {
+		rule.remove()
+		delete(t.rules, pattern)
+	}
+	if qos == AtMostOnce {
+		t.rules[pattern] = t.router.add(pattern, "AtMostOnce")
+	}
+}
+
+func (t *qosTable) of(channel string) QoS {
+	if t == nil {
+		return AtLeastOnce
+	}
+	t.Lock()
+	empty := len(t.rules) == 0
+	t.Unlock()
+	if !empty && len(t.router.run(channel)) > 0 {
+		return AtMostOnce
+	}
+	return AtLeastOnce
+}
+
+/*
+Set the QoS of the channels matching the pattern, which may be a
+wildcard like /telemetry/**. A channel is AtMostOnce if any of the
+patterns it matches is, and AtLeastOnce otherwise.
+*/
+func (inst *Instance) SetChannelQoS(pattern string, qos QoS) *Instance {
+	inst.options.qos.set(pattern, qos)
+	return inst
+}
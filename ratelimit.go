@@ -0,0 +1,112 @@
+package gocomet
+
+import (
+	"sync"
+	"time"
+)
+
+// Default rate of the publishes without client ID, shared by all the
+// anonymous publishers once allowed.
+const (
+	ANONYMOUS_PUBLISH_RATE  = 10
+	ANONYMOUS_PUBLISH_BURST = 20
+)
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+/*
+A token bucket rate limiter keyed by client ID. It's disabled if the
+rate isn't positive.
+*/
+type rateLimiter struct {
+	sync.Locker
+	rate    float64 // tokens per second
+	burst   int
+	buckets map[string]*tokenBucket
+}
+
+func newRateLimiter() *rateLimiter {
+	return &rateLimiter{Locker: &sync.Mutex{}, buckets: make(map[string]*tokenBucket)}
+}
+
+func (l *rateLimiter) setRate(perSecond, burst int) {
+	l.Lock()
+	defer l.Unlock()
+	if burst < 1 {
+		burst = 1
+	}
+	l.rate, l.burst = float64(perSecond), burst
+	l.buckets = make(map[string]*tokenBucket)
+}
+
+/*
+Take a token of the client. If there's none left, it returns false
+along with the time to wait for the next one.
+*/
+func (l *rateLimiter) allow(clientId string) (ok bool, wait time.Duration) {
+	l.Lock()
+	defer l.Unlock()
+	if l.rate <= 0 {
+		return true, 0
+	}
+
+	now := time.Now()
+	b, found := l.buckets[clientId]
+	if !found {
+		b = &tokenBucket{float64(l.burst), now}
+		l.buckets[clientId] = b
+	}
+	b.tokens += now.Sub(b.last).Seconds() * l.rate
+	if b.tokens > float64(l.burst) {
+		b.tokens = float64(l.burst)
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+	}
+	b.tokens--
+	return true, 0
+}
+
+func (l *rateLimiter) remove(clientId string) {
+	l.Lock()
+	defer l.Unlock()
+	delete(l.buckets, clientId)
+}
+
+/*
+Limit the rate of publishing per client, with a burst allowance. The
+exceeding publishes are rejected with a 429 error and an advice of the
+interval to slow down, while the session is kept. A non-positive rate
+disables the limit, which is the default.
+*/
+func (inst *Instance) SetPublishRate(perSecond, burst int) *Instance {
+	inst.limiter.setRate(perSecond, burst)
+	return inst
+}
+
+/*
+Allow publishing without client ID, e.g. by a backend posting to the
+HTTP endpoint without handshaking, which is disabled by default. Such
+a publish is authorized by the security policy with an empty client
+ID, and never to a meta channel.
+*/
+func (inst *Instance) AllowAnonymousPublish(enabled bool) *Instance {
+	inst.Lock()
+	defer inst.Unlock()
+	inst.anonymous = enabled
+	return inst
+}
+
+/*
+Limit the rate of the anonymous publishes, shared by all the anonymous
+publishers, which is ANONYMOUS_PUBLISH_RATE by default. A non-positive
+rate disables the limit.
+*/
+func (inst *Instance) SetAnonymousPublishRate(perSecond, burst int) *Instance {
+	inst.anonLimit.setRate(perSecond, burst)
+	return inst
+}
@@ -0,0 +1,35 @@
+package gocomet
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPublishRate(t *testing.T) {
+	inst := New().SetPublishRate(10, 2)
+	publisher := handshake(t, inst)
+	publish := `[{"channel":"/foo/bar","clientId":"` + publisher + `","data":"ping"}]`
+	for i := 0; i < 2; i++ {
+		_, resp := post(t, inst, publish)
+		assert(len(resp) == 1 && resp[0].Successful, t, "burst should be allowed (got %v)", resp)
+	}
+	_, resp := post(t, inst, publish)
+	assert(len(resp) == 1 && !resp[0].Successful && strings.HasPrefix(resp[0].Error, "429:"), t, "publish should be throttled (got %v)", resp)
+	assert(resp[0].Advice != nil && resp[0].Advice.Interval > 0, t, "client should be advised to slow down (got %v)", resp[0].Advice)
+
+	time.Sleep(100 * time.Millisecond)
+	_, resp = post(t, inst, publish)
+	assert(len(resp) == 1 && resp[0].Successful, t, "publish should be allowed after refill (got %v)", resp)
+	assert(inst.Touch(publisher), t, "session should be kept")
+}
+
+func TestRateLimiterRemove(t *testing.T) {
+	l := newRateLimiter()
+	l.setRate(1, 1)
+	l.allow("client")
+	l.remove("client")
+	assert(len(l.buckets) == 0, t, "bucket should be removed")
+	ok, _ := l.allow("client")
+	assert(ok, t, "removed client should start with a full bucket")
+}
@@ -0,0 +1,362 @@
+package gocomet
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+/*
+Configuration of the Redis broker. Messages broadcasted on any node are
+published to the Redis channel, and delivered to the local subscribers
+by every node receiving them from Redis. Subscriptions are node-local.
+*/
+type RedisConfig struct {
+	Addr        string        // address of the Redis server, e.g. "localhost:6379"
+	Channel     string        // Redis channel to fan out messages, "gocomet" by default
+	DialTimeout time.Duration // timeout of connecting to Redis, and of each publish
+	RetryMin    time.Duration // initial delay of reconnecting
+	RetryMax    time.Duration // maximum delay of reconnecting
+}
+
+const (
+	DEFAULT_REDIS_CHANNEL = "gocomet"
+	DEFAULT_REDIS_TIMEOUT = 5 * time.Second
+	DEFAULT_REDIS_RETRY   = 100 * time.Millisecond
+	MAX_REDIS_RETRY       = 10 * time.Second
+	REDIS_PUBLISH_QUEUE   = 1024 // max number of messages waiting to be published
+	REDIS_PIPELINE_SIZE   = 64   // max number of messages published in a write
+)
+
+type redisMessage struct {
+	Channel   string          `json:"channel"`
+	Data      json.RawMessage `json:"data"`
+	ClientId  string          `json:"clientId,omitempty"`
+	Exclude   []string        `json:"exclude,omitempty"`
+	Timestamp time.Time       `json:"timestamp"`
+	Trace     string          `json:"trace,omitempty"`
+}
+
+// a message waiting to be published, or delivered locally on failure
+type redisPublish struct {
+	span      Span
+	clientId  string
+	channel   string
+	msg       json.RawMessage
+	timestamp time.Time
+	exclude   []string
+	payload   []byte
+}
+
+/*
+A broker fanning out broadcast to other nodes through Redis pub/sub.
+The local broker is still responsible for the subscriptions and the
+delivery to the local clients. The messages are published by a writer
+goroutine, so that a broadcast never waits for Redis.
+*/
+type redisBroker struct {
+	*Broker
+	config RedisConfig
+
+	queue   chan *redisPublish // to the writer
+	closing chan bool
+	done    chan bool // closed once the writer stops
+}
+
+func newRedisBroker(config RedisConfig, local *Broker) *redisBroker {
+	if config.Channel == "" {
+		config.Channel = DEFAULT_REDIS_CHANNEL
+	}
+	if config.DialTimeout <= 0 {
+		config.DialTimeout = DEFAULT_REDIS_TIMEOUT
+	}
+	if config.RetryMin <= 0 {
+		config.RetryMin = DEFAULT_REDIS_RETRY
+	}
+	if config.RetryMax < config.RetryMin {
+		config.RetryMax = MAX_REDIS_RETRY
+	}
+	b := &redisBroker{
+		Broker:  local,
+		config:  config,
+		queue:   make(chan *redisPublish, REDIS_PUBLISH_QUEUE),
+		closing: make(chan bool),
+		done:    make(chan bool),
+	}
+	go b.receive()
+	go b.write()
+	return b
+}
+
+/*
+Publish the message to Redis, which is delivered to the local clients
+once it comes back. It's delivered locally instead if Redis is not
+available, so that the local clients still work, or if too many are
+waiting to be published already.
+*/
+func (b *redisBroker) broadcast(clientId, channel string, msg json.RawMessage, exclude ...string) {
+	b.broadcastTraced(nopSpan{}, clientId, channel, msg, exclude)
+}
+
+/*
+Publish the message to Redis with its trace ID, so that the broadcast
+on every node is tagged with it.
+*/
+func (b *redisBroker) broadcastTraced(span Span, clientId, channel string, msg json.RawMessage, exclude []string) {
+	timestamp := b.timestamp()
+	payload, _ := json.Marshal(&redisMessage{channel, msg, clientId, exclude, timestamp, span.TraceId()})
+	p := &redisPublish{span, clientId, channel, msg, timestamp, exclude, payload}
+	select {
+	case <-b.closing:
+		b.fallback(p)
+	case b.queue <- p:
+	default:
+		b.logger.Errorf("[Redis]Too many messages to publish, delivered locally.")
+		b.fallback(p)
+	}
+}
+
+/*
+Publish the messages to Redis one by one, as every node resolves its
+own subscribers.
+*/
+func (b *redisBroker) broadcastBatch(clientId, channel string, msgs []json.RawMessage, exclude ...string) {
+	for _, msg := range msgs {
+		b.broadcast(clientId, channel, msg, exclude...)
+	}
+}
+
+// deliver the message unpublished to the local clients only
+func (b *redisBroker) fallback(p *redisPublish) {
+	b.Broker.broadcastAt(p.span, p.clientId, p.channel, p.msg, p.timestamp, p.exclude)
+}
+
+/*
+Keep publishing the queued messages, pipelined by batches. A broken
+connection is retried once with a new one. Once Redis can't be
+connected, the messages are delivered locally without dialing again
+till the retry time, which backs off exponentially.
+*/
+func (b *redisBroker) write() {
+	defer close(b.done)
+	var conn net.Conn
+	var reader *bufio.Reader
+	defer func() {
+		if conn != nil {
+			conn.Close()
+		}
+	}()
+	var retry time.Time // of dialing while Redis is down
+	delay := b.config.RetryMin
+	for {
+		var batch []*redisPublish
+		select {
+		case p := <-b.queue:
+			batch = append(batch, p)
+		case <-b.closing:
+			for { // those left are delivered locally
+				select {
+				case p := <-b.queue:
+					b.fallback(p)
+				default:
+					return
+				}
+			}
+		}
+	collect:
+		for len(batch) < REDIS_PIPELINE_SIZE {
+			select {
+			case p := <-b.queue:
+				batch = append(batch, p)
+			default:
+				break collect
+			}
+		}
+
+		sent := 0
+		for attempt := 0; attempt < 2 && sent < len(batch); attempt++ {
+			if conn == nil && time.Now().After(retry) {
+				var err error
+				if conn, err = net.DialTimeout("tcp", b.config.Addr, b.config.DialTimeout); err == nil {
+					reader, delay = bufio.NewReader(conn), b.config.RetryMin
+				} else {
+					b.logger.Errorf("[Redis]Failed to connect, retry in %v: %v", delay, err)
+					retry = time.Now().Add(delay)
+					if delay *= 2; delay > b.config.RetryMax {
+						delay = b.config.RetryMax
+					}
+				}
+			}
+			if conn == nil {
+				break
+			}
+			n, err := b.publish(conn, reader, batch[sent:])
+			if sent += n; err != nil {
+				b.logger.Errorf("[Redis]Failed to publish: %v", err)
+				conn.Close()
+				conn, reader = nil, nil
+			}
+		}
+		for _, p := range batch[sent:] {
+			b.fallback(p)
+		}
+	}
+}
+
+/*
+Publish the messages in a single write, and return the number of those
+confirmed by Redis.
+*/
+func (b *redisBroker) publish(conn net.Conn, reader *bufio.Reader, batch []*redisPublish) (int, error) {
+	var buf []byte
+	for _, p := range batch {
+		buf = append(buf, redisCommand("PUBLISH", b.config.Channel, string(p.payload))...)
+	}
+	conn.SetDeadline(time.Now().Add(b.config.DialTimeout))
+	if _, err := conn.Write(buf); err != nil {
+		return 0, err
+	}
+	for i := range batch {
+		if _, err := readRedisReply(reader); err != nil {
+			return i, err
+		}
+	}
+	return len(batch), nil
+}
+
+/*
+Keep receiving messages from Redis and deliver them locally. It
+reconnects with an exponential backoff if the connection is broken.
+*/
+func (b *redisBroker) receive() {
+	delay := b.config.RetryMin
+	for {
+		start := time.Now()
+		err := b.subscribeRedis()
+		select {
+		case <-b.closing:
+			return
+		default:
+		}
+		if time.Since(start) > b.config.RetryMax {
+			delay = b.config.RetryMin // it worked for a while
+		}
+		b.logger.Errorf("[Redis]Subscription is broken, retry in %v: %v", delay, err)
+		select {
+		case <-b.closing:
+			return
+		case <-time.After(delay):
+		}
+		if delay *= 2; delay > b.config.RetryMax {
+			delay = b.config.RetryMax
+		}
+	}
+}
+
+func (b *redisBroker) subscribeRedis() error {
+	conn, err := net.DialTimeout("tcp", b.config.Addr, b.config.DialTimeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	done := make(chan bool)
+	defer close(done)
+	go func() {
+		select {
+		case <-b.closing:
+			conn.Close()
+		case <-done:
+		}
+	}()
+
+	if _, err = conn.Write(redisCommand("SUBSCRIBE", b.config.Channel)); err != nil {
+		return err
+	}
+	reader := bufio.NewReader(conn)
+	for {
+		reply, err := readRedisReply(reader)
+		if err != nil {
+			return err
+		}
+		// a message is pushed as ["message", channel, payload]
+		if parts, ok := reply.([]interface{}); ok && len(parts) == 3 && parts[0] == "message" {
+			var msg redisMessage
+			if payload, ok := parts[2].(string); ok && json.Unmarshal([]byte(payload), &msg) == nil {
+				if msg.Timestamp.IsZero() { // from an older node
+					msg.Timestamp = b.timestamp()
+				}
+				span := b.startSpan("receive")
+				if msg.Trace != "" {
+					span.SetTag("trace", msg.Trace) // of the publish on the other node
+				}
+				b.Broker.broadcastAt(span, msg.ClientId, msg.Channel, msg.Data, msg.Timestamp, msg.Exclude)
+				span.End()
+			}
+		}
+	}
+}
+
+func (b *redisBroker) close() {
+	close(b.closing)
+	<-b.done
+}
+
+func redisCommand(args ...string) []byte {
+	buf := []byte(fmt.Sprintf("*%d\r\n", len(args)))
+	for _, arg := range args {
+		buf = append(buf, fmt.Sprintf("$%d\r\n%s\r\n", len(arg), arg)...)
+	}
+	return buf
+}
+
+/*
+Read a reply in the Redis serialization protocol. Bulk strings and
+simple strings are returned as string, integers as int64, and arrays
+as []interface{}.
+*/
+func readRedisReply(r *bufio.Reader) (interface{}, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 {
+		return nil, errors.New("Invalid Redis reply.")
+	}
+	line = line[:len(line)-2] // strip \r\n
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, errors.New(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		buf := make([]byte, n+2)
+		if _, err = io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		return string(buf[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		parts := make([]interface{}, n)
+		for i := range parts {
+			if parts[i], err = readRedisReply(r); err != nil {
+				return nil, err
+			}
+		}
+		return parts, nil
+	}
+	return nil, fmt.Errorf("Unknown Redis reply: %v", line)
+}
@@ -0,0 +1,137 @@
+package gocomet
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+/*
+A fake Redis server supporting only SUBSCRIBE and PUBLISH.
+*/
+func fakeRedis(t *testing.T) (addr string, stop func()) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var lock sync.Mutex
+	var subscribers []net.Conn
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				r := bufio.NewReader(conn)
+				for {
+					reply, err := readRedisReply(r)
+					if err != nil {
+						return
+					}
+					args := reply.([]interface{})
+					switch args[0] {
+					case "SUBSCRIBE":
+						lock.Lock()
+						subscribers = append(subscribers, conn)
+						lock.Unlock()
+						// reply as ["subscribe", channel, 1]
+						reply := redisCommand("subscribe", args[1].(string), "")
+						conn.Write(append(reply[:len(reply)-6], ":1\r\n"...))
+					case "PUBLISH":
+						lock.Lock()
+						for _, sub := range subscribers {
+							sub.Write(redisCommand("message", args[1].(string), args[2].(string)))
+						}
+						conn.Write([]byte(":1\r\n"))
+						lock.Unlock()
+					}
+				}
+			}()
+		}
+	}()
+	return l.Addr().String(), func() { l.Close() }
+}
+
+func TestRedisBroker(t *testing.T) {
+	addr, stop := fakeRedis(t)
+	defer stop()
+
+	nodeA := New().UseRedis(RedisConfig{Addr: addr})
+	nodeB := New().UseRedis(RedisConfig{Addr: addr})
+	defer nodeA.broker.close()
+	defer nodeB.broker.close()
+	time.Sleep(50 * time.Millisecond) // wait for subscriptions
+
+	received := make(chan string, 1)
+	cancel, _ := nodeB.Listen("/foo/bar", func(channel string, data json.RawMessage) {
+		received <- string(data)
+	})
+	defer cancel()
+	nodeA.Publish("/foo/bar", "ping")
+	select {
+	case data := <-received:
+		assert(data == `"ping"`, t, "wrong message received (got %v)", data)
+	case <-time.After(time.Second):
+		t.Error("message published on one node should reach the other")
+	}
+}
+
+func TestRedisBrokerUnavailable(t *testing.T) {
+	inst := New().UseRedis(RedisConfig{Addr: "127.0.0.1:1", DialTimeout: 10 * time.Millisecond})
+	defer inst.broker.close()
+	received := make(chan string, 1)
+	cancel, _ := inst.Listen("/foo/bar", func(channel string, data json.RawMessage) {
+		received <- string(data)
+	})
+	defer cancel()
+	inst.Publish("/foo/bar", "ping")
+	select {
+	case <-received:
+	case <-time.After(time.Second):
+		t.Error("message should be delivered locally if Redis is unavailable")
+	}
+}
+
+func TestRedisBrokerStalled(t *testing.T) {
+	// a Redis accepting connections but never replying
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	inst := New().UseRedis(RedisConfig{Addr: l.Addr().String(), DialTimeout: 100 * time.Millisecond})
+	defer inst.broker.close()
+	received := make(chan string, 10)
+	cancel, _ := inst.Listen("/foo/bar", func(channel string, data json.RawMessage) {
+		received <- string(data)
+	})
+	defer cancel()
+	start := time.Now()
+	for i := 0; i < 10; i++ {
+		inst.Publish("/foo/bar", i)
+	}
+	assert(time.Since(start) < 50*time.Millisecond, t, "publish should not wait for Redis (took %v)", time.Since(start))
+	for i := 0; i < 10; i++ {
+		select {
+		case data := <-received:
+			assert(data == strconv.Itoa(i), t, "messages should be delivered locally in order (got %v)", data)
+		case <-time.After(time.Second):
+			t.Fatal("message should be delivered locally once Redis times out")
+		}
+	}
+}
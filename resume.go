@@ -0,0 +1,82 @@
+package gocomet
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+)
+
+/*
+The resume info carried in the handshake extension. A client asks to
+resume its session like {"resume":{"clientId":"abc","token":"xyz"}},
+with the token given by the handshake response of that session like
+{"resume":{"token":"xyz","resumed":false}}. The token proves the
+ownership of the session, so a client can't take over another's
+session by its client ID only. If the session is gone, e.g. by a
+restart, the client handshakes anew keeping the token, and the messages
+kept for it by the mailbox store are replayed.
+*/
+type resumeInfo struct {
+	ClientId string `json:"clientId,omitempty"`
+	Token    string `json:"token"`
+	Resumed  bool   `json:"resumed"`
+}
+
+func parseResume(ext interface{}) (info resumeInfo, ok bool) {
+	fields, ok := ext.(map[string]interface{})
+	if !ok || fields["resume"] == nil {
+		return info, false
+	}
+	data, _ := json.Marshal(fields["resume"])
+	return info, json.Unmarshal(data, &info) == nil && info.ClientId != "" && info.Token != ""
+}
+
+/*
+A client never wanting the events buffered while it's away, e.g. a live
+overlay, handshakes like {"replay":false}. Then its session delivers to
+each request only those arriving after it, dropping the others instead
+of flushing them.
+*/
+func parseNoReplay(ext interface{}) bool {
+	fields, ok := ext.(map[string]interface{})
+	return ok && fields["replay"] == false
+}
+
+func newResumeToken() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+/*
+Resume the live session of the client, keeping its subscriptions and
+mailbox, if the token matches. It returns false if the session is gone
+already, or the token doesn't match.
+*/
+func (c *Server) resume(clientId, token string) bool {
+	if !c.names.touch(clientId) {
+		return false
+	}
+	c.RLock()
+	ss, ok := c.sessions[clientId]
+	c.RUnlock()
+	if !ok || subtle.ConstantTimeCompare([]byte(ss.token), []byte(token)) != 1 {
+		c.logger.Infof("[%8.8v]Failed to resume the session.", clientId)
+		return false
+	}
+	return ss.touch()
+}
+
+/*
+Get the token to resume the client's session, or empty if the session
+doesn't exist.
+*/
+func (c *Server) resumeToken(clientId string) string {
+	c.RLock()
+	defer c.RUnlock()
+	if ss, ok := c.sessions[clientId]; ok {
+		return ss.token
+	}
+	return ""
+}
@@ -0,0 +1,48 @@
+package gocomet
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSessionResume(t *testing.T) {
+	inst := New()
+	_, resp := post(t, inst, `[{"channel":"/meta/handshake","version":"1.0"}]`)
+	clientId := resp[0].ClientId
+	resume, _ := resp[0].Extension.(map[string]interface{})["resume"].(map[string]interface{})
+	token, _ := resume["token"].(string)
+	assert(token != "" && resume["resumed"] == false, t, "handshake should give a resume token (got %v)", resp[0].Extension)
+	post(t, inst, `[{"channel":"/meta/subscribe","clientId":"`+clientId+`","subscription":"/foo/bar"}]`)
+	inst.Publish("/foo/bar", "kept")
+
+	handshake := `[{"channel":"/meta/handshake","version":"1.0","ext":{"resume":{"clientId":"` + clientId + `","token":"%v"}}}]`
+	_, resp = post(t, inst, fmt.Sprintf(handshake, "forged"))
+	assert(resp[0].Successful && resp[0].ClientId != clientId, t, "session should not be resumed without the token (got %+v)", resp[0])
+	assert(strings.Contains(fmt.Sprint(resp[0].Extension), "resumed:false"), t, "client should be told it's a new session (got %v)", resp[0].Extension)
+
+	_, resp = post(t, inst, fmt.Sprintf(handshake, token))
+	assert(resp[0].Successful && resp[0].ClientId == clientId, t, "session should be resumed (got %+v)", resp[0])
+	_, resp = post(t, inst, `[{"channel":"/meta/connect","clientId":"`+clientId+`","connectionType":"long-polling"}]`)
+	assert(len(resp) == 2 && resp[0].DataString() == "kept", t, "mailbox should be kept (got %v)", resp)
+
+	inst.disconnect(clientId)
+	_, resp = post(t, inst, fmt.Sprintf(handshake, token))
+	assert(resp[0].Successful && resp[0].ClientId != clientId, t, "gone session should not be resumed (got %+v)", resp[0])
+}
+
+func TestNoReplay(t *testing.T) {
+	inst := New()
+	_, resp := post(t, inst, `[{"channel":"/meta/handshake","version":"1.0","ext":{"replay":false}}]`)
+	clientId := resp[0].ClientId
+	post(t, inst, `[{"channel":"/meta/subscribe","clientId":"`+clientId+`","subscription":"/foo/bar"}]`)
+	inst.Publish("/foo/bar", "stale")
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		inst.Publish("/foo/bar", "live")
+	}()
+	_, resp = post(t, inst, `[{"channel":"/meta/connect","clientId":"`+clientId+`","connectionType":"long-polling"}]`)
+	assert(len(resp) == 2 && resp[0].DataString() == "live", t, "only the message after the connect should be delivered (got %v)", resp)
+	assert(inst.ClientHealth(clientId).Dropped == 1, t, "stale message should be dropped (got %+v)", inst.ClientHealth(clientId))
+}
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"container/list"
 	"fmt"
+	"sort"
 	"strings"
 	"sync"
 )
@@ -16,13 +17,25 @@ Internally, it uses a Trie to do path matching. Adding or removing
 rule will change the internal Trie structure. The lookup efficiency
 is proportional to the approximte number of path segments.
 
-Note: it's thread-safe and can be shared in different goroutines.
+Besides the wildcards, a rule may contain named parameter segments like
+/users/{id}/inbox, each of which matches exactly one segment like "*"
+does, and the matched segments are captured by runWithParams. So may a
+"*" followed by more segments, which is a parameter without name.
+
+Note: it's thread-safe and can be shared in different goroutines. The
+whole Trie is guarded by a single lock shared by all the sub routers,
+which is only taken by the exported operations of the router and its
+rules, i.e. add, run, reverse, Rules, String and Rule.remove. The
+other methods assume the lock is held already.
 */
 type Router struct {
 	*sync.RWMutex
 	parent   *Router
 	prefix   string
 	children map[string]*Router
+	loose    []string // prefixes of sub routers not ending with '/'
+	params   []string // parameter rules, and prefixes of sub routers starting with one
+	foldCase bool     // match the paths case-insensitively, only set on the root
 	rules    map[string]map[string]*Rule
 }
 
@@ -38,42 +51,91 @@ func newRouter() *Router {
 Add a new router rule into the table.
 */
 func (r *Router) add(path, id string) *Rule {
-	if pos := strings.Index(path, "*"); pos > 0 { // wildcard rule
+	r.Lock()
+	defer r.Unlock()
+	return r.insert(r.normalize(path), id)
+}
+
+/*
+Match the paths case-insensitively or not. It only affects the rules
+added afterwards.
+*/
+func (r *Router) setFoldCase(fold bool) {
+	r.Lock()
+	defer r.Unlock()
+	r.foldCase = fold
+}
+
+func (r *Router) normalize(path string) string {
+	if r.foldCase {
+		return foldChannel(path)
+	}
+	return path
+}
+
+/*
+Convert the channel to lower case, except the names of its parameters.
+*/
+func foldChannel(channel string) string {
+	if !strings.Contains(channel, "{") {
+		return strings.ToLower(channel)
+	}
+	segments := strings.Split(channel, "/")
+	for i, segment := range segments {
+		if !isParam(segment) {
+			segments[i] = strings.ToLower(segment)
+		}
+	}
+	return strings.Join(segments, "/")
+}
+
+func (r *Router) insert(path, id string) *Rule {
+	if pos := strings.IndexAny(path, "*{"); pos > 0 { // wildcard or parameter rule
 		prefix, part := path[:pos], path[pos:]
 
 		r2, exists := r.obtainSubRouter(prefix)
 		if !exists {
 			candidates := r.moveSimpleRulesMatching(prefix, r2)
-			r2.removeRules(candidates)
+			r.removeRules(candidates)
+		}
+		return r2.insert(part, id)
+	} else if pos == 0 && startsWithParam(path) {
+		// no simple rule is moved, which never starts with a parameter
+		if end := strings.Index(path, "/"); end > 0 {
+			r2, _ := r.obtainSubRouter(path[:end+1])
+			return r2.insert(path[end+1:], id)
+		}
+		if _, ok := r.rules[path]; !ok {
+			r.params = append(r.params, path)
 		}
-		return r2.add(part, id)
 	}
 	return r.addSimpleRule(path, id)
 }
 
 func (r *Router) obtainSubRouter(prefix string) (r2 *Router, ok bool) {
-	r.Lock()
-	defer r.Unlock()
-
 	r2, ok = r.children[prefix]
-	if !ok { // create a new child router
+	if !ok { // create a new child router sharing the lock
 		r2 = newRouter()
+		r2.RWMutex = r.RWMutex
 		r2.parent = r
 		r2.prefix = prefix
 		r.children[prefix] = r2
+		if startsWithParam(prefix) {
+			r.params = append(r.params, prefix)
+		} else if !strings.HasSuffix(prefix, "/") {
+			r.loose = append(r.loose, prefix)
+		}
 	}
 	return
 }
 
 func (r *Router) moveSimpleRulesMatching(prefix string, r2 *Router) (candidates []string) {
-	r.RLock()
-	defer r.RUnlock()
-
 	pos := len(prefix)
 	for rp, rules := range r.rules {
 		if strings.HasPrefix(rp, prefix) {
 			for _, rule := range rules {
-				r2.add(rp[pos:], rule.id)
+				rule.path = rp[pos:]
+				r2.adoptRule(rule)
 			}
 			candidates = append(candidates, rp)
 		}
@@ -81,19 +143,25 @@ func (r *Router) moveSimpleRulesMatching(prefix string, r2 *Router) (candidates
 	return
 }
 
-func (r *Router) removeRules(rules []string) {
-	r.Lock()
-	defer r.Unlock()
+/*
+Move an existing rule into this router, so that its owner can still
+remove it later.
+*/
+func (r *Router) adoptRule(rule *Rule) {
+	if r.rules[rule.path] == nil {
+		r.rules[rule.path] = make(map[string]*Rule)
+	}
+	rule.router = r
+	r.rules[rule.path][rule.id] = rule
+}
 
+func (r *Router) removeRules(rules []string) {
 	for _, rule := range rules {
 		delete(r.rules, rule)
 	}
 }
 
 func (r *Router) addSimpleRule(path, id string) (rule *Rule) {
-	r.Lock()
-	defer r.Unlock()
-
 	if r.rules[path] == nil {
 		r.rules[path] = make(map[string]*Rule)
 	}
@@ -101,6 +169,7 @@ func (r *Router) addSimpleRule(path, id string) (rule *Rule) {
 		return rule
 	}
 	rule = &Rule{
+		lock:   r.RWMutex,
 		router: r,
 		path:   path,
 		id:     id,
@@ -110,104 +179,326 @@ func (r *Router) addSimpleRule(path, id string) (rule *Rule) {
 }
 
 /*
-Run the router to obtain a list of matched IDs.
+Run the router to obtain a list of matched IDs. An ID matching several
+rules is returned only once. A recursive wildcard like /foo/** matches
+the channel /foo itself and all the channels under it at any depth.
 */
-func (r *Router) run(path string) (matches []string) {
+func (r *Router) run(path string) []string {
+	r.RLock()
+	defer r.RUnlock()
+	rules := r.match(nil, r.normalize(path))
+	ids := make([]string, len(rules))
+	for i, rule := range rules {
+		ids[i] = rule.id
+	}
+	return unique(ids)
+}
+
+/*
+A rule matched by a channel, with the segments matched by its named
+parameters, or nil if it has none.
+*/
+type RouteMatch struct {
+	RuleInfo
+	Params map[string]string
+}
+
+/*
+Run the router like run, but return the matched rules, each with the
+segments captured by its named parameters, e.g. {"id":"42"} once
+/users/42/inbox matches /users/{id}/inbox. An ID matching several rules
+is returned once per rule. The captured segments keep their case.
+*/
+func (r *Router) runWithParams(path string) (matches []RouteMatch) {
+	r.RLock()
+	defer r.RUnlock()
+	for _, rule := range r.match(nil, r.normalize(path)) {
+		pattern := rule.pattern()
+		matches = append(matches, RouteMatch{RuleInfo{pattern, rule.id}, paramsOf(pattern, path)})
+	}
+	return
+}
+
+func (r *Router) match(matches []*Rule, path string) []*Rule {
 	matches = r.collectRules(matches, path)
 	if !strings.Contains(path, "/") { // try wildcard match
 		matches = r.collectRules(matches, "*")
 	}
 	matches = r.collectRules(matches, "**")
+	// a parameter matches any single segment
+	segment := path
+	if end := strings.Index(path, "/"); end >= 0 {
+		segment = path[:end]
+	}
+	for _, param := range r.params {
+		switch {
+		case segment == "":
+		case !strings.HasSuffix(param, "/"):
+			if segment == path {
+				matches = r.collectRules(matches, param)
+			}
+		case segment == path: // the channel itself
+			matches = r.children[param].collectRules(matches, "**")
+		default:
+			matches = r.children[param].match(matches, path[len(segment)+1:])
+		}
+	}
 
-	if len(matches) == 0 { // try sub routers
-		for prefix, r2 := range r.children {
-			if strings.HasPrefix(path, prefix) {
-				matches = r2.run(path[len(prefix):])
-				if len(matches) > 0 {
-					break
-				}
+	// try sub routers, any of which may have matching rules
+	if len(r.children) == 0 {
+		return matches
+	}
+	for i := 0; i < len(path); i++ {
+		// a prefix normally ends with '/', so look it up directly
+		// instead of scanning all the sub routers
+		if path[i] == '/' {
+			if r2, ok := r.children[path[:i+1]]; ok {
+				matches = r2.match(matches, path[i+1:])
+			}
+		}
+	}
+	for _, prefix := range r.loose {
+		if strings.HasPrefix(path, prefix) {
+			matches = r.children[prefix].match(matches, path[len(prefix):])
+		}
+	}
+	if r2, ok := r.children[path+"/"]; ok { // the channel itself
+		matches = r2.collectRules(matches, "**")
+	}
+	return matches
+}
+
+/*
+Whether the segment is a named parameter like {id}.
+*/
+func isParam(segment string) bool {
+	return strings.HasPrefix(segment, "{")
+}
+
+/*
+Whether the path starts with a parameter, either named or a "*"
+followed by more segments.
+*/
+func startsWithParam(path string) bool {
+	return isParam(path) || strings.HasPrefix(path, "*/")
+}
+
+/*
+Capture the segments of the channel matched by the named parameters
+of the pattern.
+*/
+func paramsOf(pattern, channel string) (params map[string]string) {
+	segments := strings.Split(channel, "/")
+	for i, part := range strings.Split(pattern, "/") {
+		if isParam(part) && i < len(segments) {
+			if params == nil {
+				params = make(map[string]string)
 			}
+			params[strings.Trim(part, "{}")] = segments[i]
 		}
 	}
 	return
 }
 
-func (r *Router) collectRules(matches []string, patt string) []string {
-	r.RLock()
-	defer r.RUnlock()
+func unique(ids []string) []string {
+	seen := make(map[string]bool, len(ids))
+	result := ids[:0]
+	for _, id := range ids {
+		if !seen[id] {
+			seen[id] = true
+			result = append(result, id)
+		}
+	}
+	return result
+}
 
+func (r *Router) collectRules(matches []*Rule, patt string) []*Rule {
 	if rules, ok := r.rules[patt]; ok {
 		for _, rule := range rules {
-			matches = append(matches, rule.id)
+			matches = append(matches, rule)
 		}
 	}
 	return matches
 }
 
 func (r *Router) removeRule(rule *Rule) {
-	r.Lock()
-	defer r.Unlock()
-
 	if rules, ok := r.rules[rule.path]; ok {
 		// remove rule from its router
 		delete(rules, rule.id)
+		if len(rules) == 0 {
+			delete(r.rules, rule.path)
+			r.params = without(r.params, rule.path)
+		}
 	}
 }
 
+func without(values []string, value string) []string {
+	for i, v := range values {
+		if v == value {
+			return append(values[:i], values[i+1:]...)
+		}
+	}
+	return values
+}
+
 func (r *Router) minify() {
 	parent := r.parent
-	if r.hasSubRouters() || r.hasWildcardRules() || parent == nil {
+	if r.hasSubRouters() || parent == nil {
+		return
+	}
+	if startsWithParam(r.prefix) { // never merged, but dropped once empty
+		if len(r.rules) == 0 {
+			parent.removeSubRouter(r.prefix)
+			parent.minify()
+		}
+		return
+	}
+	if r.hasWildcardRules() {
 		return
 	}
-
-	r.Lock()
-	defer r.Unlock()
 
 	// if no child router and no other wildcard rule,
 	// merge current router to its parent
-	if parent != nil {
-		for _, rules := range r.rules {
-			for path, rule := range rules {
-				parent.add(r.prefix+path, rule.id)
-				rule.router = nil // ease GC work
-			}
+	for _, rules := range r.rules {
+		for _, rule := range rules {
+			rule.path = r.prefix + rule.path
+			parent.adoptRule(rule)
 		}
-		parent.removeSubRouter(r.prefix)
 	}
+	parent.removeSubRouter(r.prefix)
 }
 
 func (r *Router) hasSubRouters() bool {
-	r.RLock()
-	defer r.RUnlock()
 	return len(r.children) > 0
 }
 
 func (r *Router) hasWildcardRules() bool {
-	r.RLock()
-	defer r.RUnlock()
 	_, ok := r.rules["*"]
 	if !ok {
 		_, ok = r.rules["**"]
 	}
-	return ok
+	return ok || len(r.params) > 0
 }
 
 func (r *Router) removeSubRouter(prefix string) {
-	r.Lock()
-	defer r.Unlock()
 	delete(r.children, prefix)
+	r.loose = without(r.loose, prefix)
+	r.params = without(r.params, prefix)
+}
+
+/*
+A live rule in the router table, with its fully-qualified pattern.
+*/
+type RuleInfo struct {
+	Pattern  string
+	ClientId string
+}
+
+/*
+Enumerate the live rules, sorted by pattern and then client ID.
+*/
+func (r *Router) Rules() (rules []RuleInfo) {
+	r.RLock()
+	rules = r.collectRuleInfo(rules, "")
+	r.RUnlock()
+	sort.Slice(rules, func(i, j int) bool {
+		if rules[i].Pattern != rules[j].Pattern {
+			return rules[i].Pattern < rules[j].Pattern
+		}
+		return rules[i].ClientId < rules[j].ClientId
+	})
+	return
+}
+
+func (r *Router) collectRuleInfo(rules []RuleInfo, prefix string) []RuleInfo {
+	prefix += r.prefix
+	for path, ids := range r.rules {
+		for id := range ids {
+			rules = append(rules, RuleInfo{prefix + path, id})
+		}
+	}
+	for _, r2 := range r.children {
+		rules = r2.collectRuleInfo(rules, prefix)
+	}
+	return rules
+}
+
+/*
+Find the rules matching any of the channels matched by the pattern,
+which is the reverse of run. A recursive wildcard matches zero or more
+segments on either side, e.g. /foo/** and /foo/bar/* overlap.
+*/
+func (r *Router) reverse(pattern string) (rules []RuleInfo) {
+	r.RLock()
+	defer r.RUnlock()
+	return r.collectOverlapping(rules, "", strings.Split(r.normalize(pattern), "/"))
+}
+
+func (r *Router) collectOverlapping(rules []RuleInfo, prefix string, segments []string) []RuleInfo {
+	prefix += r.prefix
+	if !prefixOverlaps(prefix, segments) {
+		return rules // skip the whole sub router
+	}
+	for path, ids := range r.rules {
+		if overlaps(strings.Split(prefix+path, "/"), segments) {
+			for id := range ids {
+				rules = append(rules, RuleInfo{prefix + path, id})
+			}
+		}
+	}
+	for _, r2 := range r.children {
+		rules = r2.collectOverlapping(rules, prefix, segments)
+	}
+	return rules
+}
+
+func overlaps(a, b []string) bool {
+	for len(a) > 0 && len(b) > 0 {
+		if a[0] == "**" || b[0] == "**" {
+			return true
+		}
+		if a[0] != b[0] && !matchesAny(a[0]) && !matchesAny(b[0]) {
+			return false
+		}
+		a, b = a[1:], b[1:]
+	}
+	return len(a) == len(b) || len(a) > 0 && a[0] == "**" || len(b) > 0 && b[0] == "**"
+}
+
+func matchesAny(segment string) bool {
+	return segment == "*" || isParam(segment)
+}
+
+// whether the rules under the prefix may overlap the segments
+func prefixOverlaps(prefix string, segments []string) bool {
+	parts := strings.Split(prefix, "/")
+	last := len(parts) - 1 // the partial segment
+	for i, part := range parts {
+		if i >= len(segments) {
+			return i == last && part == "" // e.g. /foo/** overlaps /foo
+		}
+		switch segment := segments[i]; {
+		case segment == "**":
+			return true
+		case i == last:
+			return segment == "*" || strings.HasPrefix(segment, part)
+		case !matchesAny(segment) && !matchesAny(part) && segment != part:
+			return false
+		}
+	}
+	return true
 }
 
 func (r *Router) String() string {
+	r.RLock()
+	defer r.RUnlock()
+
 	var buf bytes.Buffer
 	r.toString(&buf, 0)
 	return buf.String()
 }
 
 func (r *Router) toString(buf *bytes.Buffer, tabSize int) {
-	r.RLock()
-	defer r.RUnlock()
-
 	tab := makeTab(tabSize)
 	buf.WriteString("Router(\n")
 	for part, _ := range r.rules {
@@ -230,20 +521,33 @@ func makeTab(tabSize int) string {
 }
 
 type Rule struct {
+	lock   *sync.RWMutex // of the whole router table
 	router *Router
 	path   string
 	id     string
 }
 
 func (rule *Rule) remove() {
+	rule.lock.Lock()
+	defer rule.lock.Unlock()
+
 	rule.router.removeRule(rule)
-	if strings.HasPrefix(rule.path, "*") {
-		// minify the router table if wildcard rule is removed
+	if strings.HasPrefix(rule.path, "*") || isParam(rule.path) || startsWithParam(rule.router.prefix) {
+		// minify the router table if wildcard or parameter rule is removed
 		rule.router.minify()
 	}
 }
 
 func (rule *Rule) String() string {
+	rule.lock.RLock()
+	defer rule.lock.RUnlock()
+	return rule.pattern()
+}
+
+/*
+The fully-qualified pattern of the rule. It assumes the lock is held.
+*/
+func (rule *Rule) pattern() string {
 	stack := list.New()
 	stack.PushFront(rule.path)
 	for r := rule.router; r != nil; r = r.parent {
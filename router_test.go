@@ -1,6 +1,10 @@
 package gocomet
 
 import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
 	"testing"
 )
 
@@ -83,3 +87,225 @@ func TestRemoveRule(t *testing.T) {
 	rule.remove()
 	assert(len(r.run("/foo")) == 0, t, "no matching rule now")
 }
+
+func TestRecursiveWildcardRule(t *testing.T) {
+	r := newRouter()
+	r.add("/a/**", "client1")
+	r.add("/a/b/*", "client2")
+	r.add("/a/c", "client3")
+	for _, path := range []string{"/a", "/a/b", "/a/b/c", "/a/c"} {
+		res := r.run(path)
+		assert(contains(res, "client1"), t, "/a/** should match %v (got %v)", path, res)
+	}
+	assert(len(r.run("/ab")) == 0, t, "/a/** should not match /ab")
+	res := r.run("/a/c")
+	assert(len(res) == 2, t, "both simple and recursive rules should match (got %v)", res)
+
+	r.add("/**", "client4")
+	for _, path := range []string{"/a", "/x", "/x/y/z"} {
+		res := r.run(path)
+		assert(contains(res, "client4"), t, "/** should match %v (got %v)", path, res)
+	}
+}
+
+func TestParamRule(t *testing.T) {
+	r := newRouter()
+	inbox := r.add("/users/{id}/inbox", "client1")
+	r.add("/users/{id}", "client2")
+	r.add("/users/admin/inbox", "client3")
+	r.add("/users/{id}/**", "client4")
+	r.add("/users/*", "client5")
+
+	res := r.run("/users/42/inbox")
+	sort.Strings(res)
+	assert(strings.Join(res, ",") == "client1,client4", t, "parameter should match one segment (got %v)", res)
+	res = r.run("/users/42")
+	sort.Strings(res)
+	assert(strings.Join(res, ",") == "client2,client4,client5", t, "parameter should match the last segment (got %v)", res)
+	assert(len(r.run("/users/42/inbox/x")) == 1, t, "parameter should not match more segments")
+	assert(len(r.run("/users//inbox")) == 0, t, "parameter should not match an empty segment")
+	lone := newRouter()
+	lone.add("/users/{id}", "client1")
+	assert(len(lone.run("/users/42")) == 1, t, "parameter rule should match without sub routers")
+
+	var params map[string]string
+	for _, m := range r.runWithParams("/users/42/inbox") {
+		if m.Pattern == "/users/{id}/inbox" && m.ClientId == "client1" {
+			params = m.Params
+		}
+	}
+	assert(len(params) == 1 && params["id"] == "42", t, "parameter should be captured (got %v)", params)
+	matches := r.runWithParams("/users/admin/inbox")
+	assert(len(matches) == 3, t, "both literal and parameter rules should match (got %v)", matches)
+
+	inbox.remove()
+	assert(len(r.run("/users/42/inbox")) == 1, t, "removed parameter rule should not match")
+	r.add("/users/{id}/inbox", "client1")
+	assert(len(r.run("/users/42/inbox")) == 2, t, "parameter rule should match again once added")
+}
+
+func TestFoldCaseRule(t *testing.T) {
+	r := newRouter()
+	r.add("/Foo/Bar", "client1")
+	assert(len(r.run("/foo/bar")) == 0, t, "paths should be case-sensitive by default")
+
+	r.setFoldCase(true)
+	r.add("/Foo/*", "client2")
+	r.add("/Users/{userId}", "client3")
+	res := r.run("/FOO/bar")
+	assert(len(res) == 1 && res[0] == "client2", t, "paths should match case-insensitively (got %v)", res)
+	matches := r.runWithParams("/users/AbC")
+	assert(len(matches) == 1 && matches[0].Pattern == "/users/{userId}" && matches[0].Params["userId"] == "AbC", t,
+		"parameters should keep their case (got %v)", matches)
+}
+
+func TestRules(t *testing.T) {
+	r := newRouter()
+	r.add("/foo/bar", "client1")
+	r.add("/foo/*", "client2")
+	r.add("/foo/baz/**", "client1")
+	r.add("/qux", "client2")
+	r.add("/users/{id}/inbox", "client1")
+	rules := r.Rules()
+	expected := []RuleInfo{
+		{"/foo/*", "client2"},
+		{"/foo/bar", "client1"},
+		{"/foo/baz/**", "client1"},
+		{"/qux", "client2"},
+		{"/users/{id}/inbox", "client1"},
+	}
+	assert(len(rules) == len(expected), t, "unexpected rules %v", rules)
+	for i, rule := range expected {
+		assert(rules[i] == rule, t, "expected %v but got %v", rule, rules[i])
+	}
+}
+
+// the previous lookup scanning all the sub routers, as a reference
+func runByScan(r *Router, path string) (matches []string) {
+	var rules []*Rule
+	rules = r.collectRules(rules, path)
+	if !strings.Contains(path, "/") {
+		rules = r.collectRules(rules, "*")
+	}
+	rules = r.collectRules(rules, "**")
+	for prefix, r2 := range r.children {
+		if strings.HasPrefix(path, prefix) {
+			matches = append(matches, runByScan(r2, path[len(prefix):])...)
+		} else if path+"/" == prefix {
+			rules = r2.collectRules(rules, "**")
+		}
+	}
+	for _, rule := range rules {
+		matches = append(matches, rule.id)
+	}
+	return unique(matches)
+}
+
+func populateRouter(r *Router, n int) {
+	for i := 0; i < n; i++ {
+		id := fmt.Sprintf("client%d", i)
+		region, room := i%20, i%50
+		switch i % 4 {
+		case 0:
+			r.add(fmt.Sprintf("/region/%d/room/%d", region, room), id)
+		case 1:
+			r.add(fmt.Sprintf("/region/%d/*", region), id)
+		case 2:
+			r.add(fmt.Sprintf("/region/%d/room/**", region), id)
+		case 3:
+			r.add(fmt.Sprintf("/region/%d/room/%d/users", region, room), id)
+		}
+	}
+	r.add("/reg*", "loose")
+}
+
+func TestRouterLookup(t *testing.T) {
+	r := newRouter()
+	populateRouter(r, 1000)
+	for i := 0; i < 200; i++ {
+		path := fmt.Sprintf("/region/%d/room/%d", i%25, i%60)
+		if i%3 == 0 {
+			path += "/users"
+		}
+		res, ref := r.run(path), runByScan(r, path)
+		sort.Strings(res)
+		sort.Strings(ref)
+		assert(strings.Join(res, ",") == strings.Join(ref, ","), t, "lookup of %v differs: %v vs %v", path, res, ref)
+	}
+}
+
+func BenchmarkRouterRun(b *testing.B) {
+	r := newRouter()
+	populateRouter(r, 20000)
+	paths := make([]string, 100)
+	for i := range paths {
+		paths[i] = fmt.Sprintf("/region/%d/room/%d/users", i%20, i%50)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		r.run(paths[i%len(paths)])
+	}
+}
+
+func TestRouterConcurrency(t *testing.T) {
+	r := newRouter()
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(3)
+		go func(i int) { // wildcard rules come and go
+			defer wg.Done()
+			for j := 0; j < 200; j++ {
+				r.add(fmt.Sprintf("/foo/%d/*", j%5), fmt.Sprintf("w%d", i)).remove()
+				r.add("/foo/**", fmt.Sprintf("w%d", i))
+			}
+		}(i)
+		go func(i int) { // simple rules moved around by the wildcard ones
+			defer wg.Done()
+			for j := 0; j < 200; j++ {
+				rule := r.add(fmt.Sprintf("/foo/%d/bar", j%5), fmt.Sprintf("s%d", i))
+				if j%2 == 0 {
+					rule.remove()
+				}
+			}
+		}(i)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 200; j++ {
+				r.run(fmt.Sprintf("/foo/%d/bar", j%5))
+				r.Rules()
+			}
+		}()
+	}
+	wg.Wait()
+	for i := 0; i < 8; i++ {
+		res := r.run("/foo/1/bar")
+		assert(contains(res, fmt.Sprintf("w%d", i)), t, "recursive rule w%d should be kept (got %v)", i, res)
+	}
+}
+
+func TestReverseRule(t *testing.T) {
+	r := newRouter()
+	r.add("/notices/a", "client1")
+	r.add("/notices/b/c", "client2")
+	r.add("/notices/*", "client3")
+	r.add("/**", "client4")
+	r.add("/news/a", "client5")
+	r.add("/notices/b/**", "client6")
+	r.add("/notices/{id}/c", "client7")
+	for pattern, expected := range map[string]string{
+		"/notices/*":   "client1,client3,client4,client6",
+		"/notices/**":  "client1,client2,client3,client4,client6,client7",
+		"/notices/b":   "client3,client4,client6",
+		"/news/*":      "client4,client5",
+		"/**":          "client1,client2,client3,client4,client5,client6,client7",
+		"/notices/d/*": "client4,client7",
+	} {
+		var ids []string
+		for _, rule := range r.reverse(pattern) {
+			ids = append(ids, rule.ClientId)
+		}
+		ids = unique(ids)
+		sort.Strings(ids)
+		assert(strings.Join(ids, ",") == expected, t, "reverse of %v should be %v (got %v)", pattern, expected, ids)
+	}
+}
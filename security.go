@@ -0,0 +1,128 @@
+package gocomet
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+/*
+A security policy decides whether a client is allowed to subscribe or
+publish to a channel. It's consulted on every subscribe and publish,
+so an expensive policy should be wrapped with an authorization cache.
+*/
+type SecurityPolicy interface {
+	CanSubscribe(clientId, channel string) bool
+	CanPublish(clientId, channel string) bool
+}
+
+const (
+	AUTH_SUBSCRIBE = "subscribe"
+	AUTH_PUBLISH   = "publish"
+)
+
+type authKey struct {
+	clientId string
+	channel  string
+	action   string
+}
+
+type authResult struct {
+	key     authKey
+	allowed bool
+	expire  time.Time
+}
+
+/*
+A LRU cache of the authorization results. Only the last size results
+are kept, and each of them expires after ttl.
+*/
+type authCache struct {
+	sync.Locker
+	size    int
+	ttl     time.Duration
+	results map[authKey]*list.Element
+	order   *list.List
+}
+
+func newAuthCache(size int, ttl time.Duration) *authCache {
+	return &authCache{&sync.Mutex{}, size, ttl, make(map[authKey]*list.Element), list.New()}
+}
+
+/*
+Lookup the result by key, or evaluate and cache it if it's missing or
+expired already.
+*/
+func (cache *authCache) authorize(key authKey, evaluate func() bool) bool {
+	cache.Lock()
+	defer cache.Unlock()
+
+	now := time.Now()
+	if e, ok := cache.results[key]; ok {
+		if result := e.Value.(*authResult); result.expire.After(now) {
+			cache.order.MoveToBack(e)
+			return result.allowed
+		}
+		cache.order.Remove(e)
+		delete(cache.results, key)
+	}
+
+	allowed := evaluate()
+	cache.results[key] = cache.order.PushBack(&authResult{key, allowed, now.Add(cache.ttl)})
+	for cache.order.Len() > cache.size {
+		e := cache.order.Front()
+		delete(cache.results, e.Value.(*authResult).key)
+		cache.order.Remove(e)
+	}
+	return allowed
+}
+
+func (cache *authCache) invalidate(clientId string) {
+	cache.Lock()
+	defer cache.Unlock()
+
+	for key, e := range cache.results {
+		if key.clientId == clientId {
+			cache.order.Remove(e)
+			delete(cache.results, key)
+		}
+	}
+}
+
+/*
+Check the client's permission on the channel against the security
+policy. Everything is allowed if no policy is set.
+*/
+func (c *Server) authorize(clientId, channel, action string) bool {
+	c.RLock()
+	policy, cache := c.policy, c.authCache
+	c.RUnlock()
+
+	if policy == nil {
+		return true
+	}
+	evaluate := func() bool {
+		if action == AUTH_PUBLISH {
+			return policy.CanPublish(clientId, channel)
+		}
+		return policy.CanSubscribe(clientId, channel)
+	}
+	if cache == nil {
+		return evaluate()
+	}
+	return cache.authorize(authKey{clientId, channel, action}, evaluate)
+}
+
+/*
+Drop all the cached authorization results of the client, so that the
+security policy is consulted again on its next subscribe or publish.
+*/
+func (c *Server) InvalidateAuth(clientId string) {
+	c.RLock()
+	cache := c.authCache
+	c.RUnlock()
+
+	if cache != nil {
+		cache.invalidate(clientId)
+	}
+}
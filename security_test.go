@@ -0,0 +1,100 @@
+package gocomet
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+type countingPolicy struct {
+	calls map[string]int
+}
+
+func (p *countingPolicy) CanSubscribe(clientId, channel string) bool {
+	p.calls[AUTH_SUBSCRIBE+channel]++
+	return channel != "/secret"
+}
+
+func (p *countingPolicy) CanPublish(clientId, channel string) bool {
+	p.calls[AUTH_PUBLISH+channel]++
+	return true
+}
+
+func TestSecurityPolicy(t *testing.T) {
+	s := newServer()
+	s.policy = &countingPolicy{make(map[string]int)}
+	c1, _ := s.handshake()
+	_, err := s.subscribe(c1, "/foo/bar")
+	assert(err == nil, t, "subscription should be allowed")
+	_, err = s.subscribe(c1, "/secret")
+	assert(err == errUnauthorized, t, "subscription should be denied (got %v)", err)
+}
+
+func TestAuthCache(t *testing.T) {
+	s := newServer()
+	policy := &countingPolicy{make(map[string]int)}
+	s.policy = policy
+	s.authCache = newAuthCache(10, time.Minute)
+	c1, _ := s.handshake()
+
+	s.subscribe(c1, "/foo/bar")
+	s.subscribe(c1, "/foo/bar")
+	s.publish(c1, "/foo/bar", nil)
+	s.publish(c1, "/foo/bar", nil)
+	assert(policy.calls[AUTH_SUBSCRIBE+"/foo/bar"] == 1, t, "subscribe should be authorized once within TTL")
+	assert(policy.calls[AUTH_PUBLISH+"/foo/bar"] == 1, t, "publish should be authorized once within TTL")
+
+	s.InvalidateAuth(c1)
+	s.subscribe(c1, "/foo/bar")
+	assert(policy.calls[AUTH_SUBSCRIBE+"/foo/bar"] == 2, t, "subscribe should be authorized again after invalidation")
+}
+
+func TestAuthCacheExpiry(t *testing.T) {
+	cache := newAuthCache(1, 10*time.Millisecond)
+	calls := 0
+	evaluate := func() bool { calls++; return true }
+	key := authKey{"client", "/foo/bar", AUTH_SUBSCRIBE}
+	cache.authorize(key, evaluate)
+	cache.authorize(key, evaluate)
+	assert(calls == 1, t, "result should be cached within TTL")
+	time.Sleep(20 * time.Millisecond)
+	cache.authorize(key, evaluate)
+	assert(calls == 2, t, "result should expire after TTL")
+	cache.authorize(authKey{"client", "/foo/baz", AUTH_SUBSCRIBE}, evaluate)
+	cache.authorize(key, evaluate)
+	assert(calls == 4, t, "least recently used result should be evicted")
+}
+
+func TestPartialSubscribe(t *testing.T) {
+	inst := New().SetSecurityPolicy(&countingPolicy{make(map[string]int)})
+	clientId := handshake(t, inst)
+	_, resp := post(t, inst, `[{"channel":"/meta/subscribe","clientId":"`+clientId+`","subscription":"/foo, /secret,/bar"}]`)
+	assert(len(resp) == 1 && !resp[0].Successful && strings.HasPrefix(resp[0].Error, "403:"), t, "partial failure should fail the response (got %+v)", resp)
+	results := fmt.Sprint(resp[0].Extension)
+	assert(results == "map[subscriptions:[map[subscription:/foo successful:true] "+
+		"map[error:403:/secret:Unauthorized subscription:/secret successful:false] "+
+		"map[subscription:/bar successful:true]]]", t, "per-channel results should be reported (got %v)", results)
+	channels := inst.Channels(clientId)
+	assert(len(channels) == 2, t, "allowed channels should be subscribed (got %v)", channels)
+
+	_, resp = post(t, inst, `[{"channel":"/meta/subscribe","clientId":"`+clientId+`","subscription":"/baz"}]`)
+	assert(len(resp) == 1 && resp[0].Successful && resp[0].Extension == nil, t, "single subscription should be answered as before (got %+v)", resp)
+}
+
+func TestPartialUnsubscribe(t *testing.T) {
+	inst := New()
+	clientId := handshake(t, inst)
+	post(t, inst, `[{"channel":"/meta/subscribe","clientId":"`+clientId+`","subscription":"/foo,/bar"}]`)
+	_, resp := post(t, inst, `[{"channel":"/meta/unsubscribe","clientId":"`+clientId+`","subscription":"/foo,/bar"}]`)
+	assert(len(resp) == 1 && resp[0].Successful, t, "unsubscribe by the same subscription should succeed (got %+v)", resp)
+	assert(len(inst.Channels(clientId)) == 0, t, "all the channels should be unsubscribed (got %v)", inst.Channels(clientId))
+
+	post(t, inst, `[{"channel":"/meta/subscribe","clientId":"`+clientId+`","subscription":"/foo"}]`)
+	_, resp = post(t, inst, `[{"channel":"/meta/unsubscribe","clientId":"`+clientId+`","subscription":"/baz,/foo"}]`)
+	assert(len(resp) == 1 && !resp[0].Successful && strings.HasPrefix(resp[0].Error, "404:"), t, "partial failure should fail the response (got %+v)", resp)
+	results := fmt.Sprint(resp[0].Extension)
+	assert(strings.Contains(results, "subscription:/baz successful:false") && strings.Contains(results, "subscription:/foo successful:true"), t,
+		"per-channel results should be reported (got %v)", results)
+	assert(len(inst.Channels(clientId)) == 0, t, "succeeded channel should be unsubscribed anyway (got %v)", inst.Channels(clientId))
+}
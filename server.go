@@ -1,10 +1,12 @@
 package gocomet
 
 import (
+	"encoding/json"
+	"errors"
 	"github.com/serverhorror/uuid"
-	"log"
-	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 /*
@@ -19,133 +21,563 @@ type Server struct {
 	*sync.RWMutex
 	names    *UniqueStringPool
 	sessions map[string]*Session
-	broker   *Broker
+	tokens   map[string]string // resume token to client ID of the live sessions
+	broker   messageBroker
+
+	options       sessionOptions
+	policy        SecurityPolicy
+	authCache     *authCache
+	chunks        *chunkAssembler
+	limiter       *rateLimiter
+	anonymous     bool         // allow publishes without client ID
+	anonLimit     *rateLimiter // shared by the anonymous publishers
+	presence      string       // prefix of presence channels, disabled if empty
+	onClosed      func(clientId string, reason CloseReason)
+	onUndelivered func(clientId string, msgs []*Message)
+	onSlow        func(clientId string, depth int)
+	maxClients    int // max number of sessions, or unlimited if 0
+	logger        *sharedLogger
+	closed        bool
 }
 
+var errUnknownClient = errors.New("Unknown client.")
+var errUnauthorized = errors.New("Unauthorized.")
+var errNotSubscribed = errors.New("Not subscribed.")
+var errServerClosed = errors.New("Server is shut down.")
+var errAnonymousPublish = errors.New("Anonymous publish is not allowed.")
+var errRateLimited = errors.New("Too many requests.")
+var errTooManyClients = errors.New("Too many clients. Try again later.")
+
 func newServer() *Server {
+	logger := newSharedLogger()
+	broker := newBroker()
+	broker.logger = logger
+	options := defaultSessionOptions
+	options.logger = logger
+	options.coalesce = newChannelSet()
+	options.qos = newQosTable()
+	options.health = broker.health
+	anonLimit := newRateLimiter()
+	anonLimit.setRate(ANONYMOUS_PUBLISH_RATE, ANONYMOUS_PUBLISH_BURST)
 	return &Server{
-		RWMutex:  &sync.RWMutex{},
-		names:    newUniqueStringPool(uuid.UUID4),
-		sessions: make(map[string]*Session),
-		broker:   newBroker(),
+		RWMutex:   &sync.RWMutex{},
+		names:     newUniqueStringPool(uuid.UUID4),
+		sessions:  make(map[string]*Session),
+		tokens:    make(map[string]string),
+		broker:    broker,
+		options:   options,
+		chunks:    newChunkAssembler(MAX_CHUNKED_BYTES, MAX_CHUNK_WAIT),
+		limiter:   newRateLimiter(),
+		anonLimit: anonLimit,
+		logger:    logger,
 	}
 }
 
 func (c *Server) handshake() (clientId string, err error) {
-	clientId, err = c.names.get()
+	return c.handshakeWithToken("", false)
+}
+
+/*
+Handshake with the resume token of a session gone, e.g. by a restart,
+so that the messages kept in its mailbox store are replayed to the new
+session. The token is ignored without a mailbox store, or if a live
+session holds it, and a new one is generated instead. A session of no
+replay drops the messages buffered before each request.
+*/
+func (c *Server) handshakeWithToken(token string, noReplay bool) (clientId string, err error) {
+	if clientId, err = c.names.get(); err != nil {
+		return
+	}
 	c.Lock()
 	defer c.Unlock()
+	if c.closed {
+		return "", errServerClosed
+	}
+	// checked with the lock held till the session is added, so that
+	// concurrent handshakes never overshoot
+	if c.maxClients > 0 && len(c.sessions) >= c.maxClients {
+		c.names.release(clientId)
+		return "", errTooManyClients
+	}
+
+	if _, live := c.tokens[token]; live || c.options.store == nil {
+		token = ""
+	}
+	if token == "" {
+		token = newResumeToken()
+	}
 
 	routerOutput := c.broker.register(clientId)
-	c.sessions[clientId] = newSession(clientId, routerOutput, func() {
+	counters := c.broker.local().counters
+	atomic.AddInt64(&counters.handshakes, 1)
+	atomic.AddInt64(&counters.clients, 1)
+	options := c.options
+	options.noReplay = noReplay
+	options.slow = c.slowConsumer
+	var ss *Session
+	ss = newSession(clientId, token, routerOutput, options, func(reason CloseReason, undelivered []*Message) {
+		c.undelivered(clientId, undelivered)
 		c.Lock()
-		defer c.Unlock()
-		delete(c.sessions, clientId)
+		onClosed := c.onClosed
+		// unless disconnected already, and the ID may be reused
+		current := c.sessions[clientId] == ss
+		if current {
+			delete(c.sessions, clientId)
+			delete(c.tokens, token)
+			atomic.AddInt64(&counters.clients, -1)
+			c.broker.deregister(clientId) // in case of timeout or expiry
+		}
+		c.Unlock()
+		if current {
+			c.InvalidateAuth(clientId)
+			c.limiter.remove(clientId)
+			c.chunks.removeClient(clientId)
+		}
+		if onClosed != nil {
+			onClosed(clientId, reason)
+		}
 	})
+	c.sessions[clientId] = ss
+	c.tokens[token] = clientId
 	return
 }
 
 /*
-Connect may supercede other non-connect waiting channels.
+Connect may supercede other non-connect waiting channels. It fails
+with errChannelTimeout if the session is too busy to respond, which
+is transient and the client should simply retry.
 */
-func (c *Server) connect(clientId string) (ch chan *Message, stop chan bool, ok bool) {
-	if ok = c.names.touch(clientId); !ok {
-		return
+func (c *Server) connect(clientId string) (ch chan *Message, stop chan bool, err error) {
+	if !c.names.touch(clientId) {
+		return nil, nil, errUnknownClient
 	}
 	c.RLock()
-	defer c.RUnlock()
-
-	var ss *Session
-	if ss, ok = c.sessions[clientId]; ok {
-		ch, stop = ss.obtainChannel(true)
+	ss, ok := c.sessions[clientId]
+	c.RUnlock() // not held while waiting for a busy session
+	if !ok {
+		return nil, nil, errUnknownClient
+	}
+	if ch, stop, err = ss.obtainChannel(true); err == errSessionClosed {
+		err = errUnknownClient
 	}
 	return
 }
 
+/*
+Count the outcome of a connect of the client, and return the number of
+connects failed in a row, including this one if failed. A successful
+connect resets the count.
+*/
+func (c *Server) countConnect(clientId string, ok bool) int {
+	c.RLock()
+	ss, found := c.sessions[clientId]
+	c.RUnlock()
+	if !found {
+		return 0
+	} else if ok {
+		return int(atomic.SwapInt32(&ss.failedConnects, 0))
+	}
+	return int(atomic.AddInt32(&ss.failedConnects, 1))
+}
+
 func (c *Server) disconnect(clientId string) (ch chan *Message, ok bool) {
 	if ok = c.names.touch(clientId); !ok {
 		return
 	}
+	c.InvalidateAuth(clientId)
 	c.Lock()
-	defer c.Unlock()
-
 	var ss *Session
 	if ss, ok = c.sessions[clientId]; ok {
 		delete(c.sessions, clientId)
+		delete(c.tokens, ss.token)
+		atomic.AddInt64(&c.broker.local().counters.clients, -1)
+		c.limiter.remove(clientId)
+		c.chunks.removeClient(clientId)
+	}
+	c.Unlock()
+
+	// closed without the lock, e.g. while its mailbox is being opened,
+	// and the ID is kept till then so that it's never reused too early
+	if ok {
 		ch = ss.close()
+		c.broker.deregister(clientId)
+		c.names.release(clientId) // free the ID right away
 	}
 	return
 }
 
-func (c *Server) subscribe(clientId, subscription string) (ch chan *Message, ok bool) {
-	if strings.Contains(subscription, ",") {
-		panic("not supported yet")
+/*
+Subscribe the client to the channel. It fails with errUnknownClient,
+errUnauthorized, errTooManySubscriptions or the validation error of the
+channel. The rule is effective once it returns, so any later publish to
+the channel is queued in the session, either piggybacked on the
+returned channel or kept in the mailbox for the next connect.
+*/
+func (c *Server) subscribe(clientId, subscription string) (ch chan *Message, err error) {
+	if !c.names.touch(clientId) {
+		return nil, errUnknownClient
 	}
-	if ok = c.names.touch(clientId); !ok {
+	if err = validateChannel(subscription); err != nil {
+		c.logger.Infof("[%8.8v]Subscription to '%v' is invalid: %v", clientId, subscription, err)
+		return
+	}
+	if !c.authorize(clientId, subscription, AUTH_SUBSCRIBE) {
+		c.logger.Infof("[%8.8v]Subscription to '%v' is denied.", clientId, subscription)
+		return nil, errUnauthorized
+	}
+	if err = c.broker.subscribe(clientId, subscription); err != nil {
+		c.logger.Infof("[%8.8v]Subscription to '%v' is rejected: %v", clientId, subscription, err)
 		return
 	}
-	c.broker.subscribe(clientId, subscription)
+	c.notifyPresence(clientId, subscription, PRESENCE_SUBSCRIBE)
+	return c.pendingChannelOf(clientId)
+}
+
+/*
+Unsubscribe the client from the channel. It fails with
+errUnknownClient, or errNotSubscribed if there's no such subscription.
+*/
+func (c *Server) unsubscribe(clientId, subscription string) (ch chan *Message, err error) {
+	if !c.names.touch(clientId) {
+		return nil, errUnknownClient
+	}
+	if !c.broker.unsubscribe(clientId, subscription) {
+		return nil, errNotSubscribed
+	}
+	c.notifyPresence(clientId, subscription, PRESENCE_UNSUBSCRIBE)
+	return c.pendingChannelOf(clientId)
+}
+
+func (c *Server) pendingChannelOf(clientId string) (ch chan *Message, err error) {
 	c.RLock()
-	defer c.RUnlock()
+	ss, ok := c.sessions[clientId]
+	c.RUnlock() // not held while waiting for a busy session
+	if !ok {
+		return nil, errUnknownClient
+	}
+	return c.obtainPendingChannel(ss), nil
+}
 
-	var ss *Session
-	if ss, ok = c.sessions[clientId]; ok {
-		ch, _ = ss.obtainChannel(false)
+/*
+The options of a publish. They're opt-in, so by default the publisher
+receives its own message like any other subscriber.
+*/
+type PublishOptions struct {
+	ExcludeSender bool     // don't echo the message back to the publisher
+	Exclude       []string // other client IDs not to deliver to
+}
+
+func (o PublishOptions) exclusions(clientId string) []string {
+	if o.ExcludeSender && clientId != "" {
+		return append([]string{clientId}, o.Exclude...)
+	}
+	return o.Exclude
+}
+
+/*
+Parse the publish options of a client's message from its extension
+like {"excludeSender":true}.
+*/
+func parsePublishOptions(ext interface{}) (options PublishOptions) {
+	if fields, ok := ext.(map[string]interface{}); ok {
+		options.ExcludeSender, _ = fields["excludeSender"].(bool)
 	}
 	return
 }
 
-func (c *Server) unsubscribe(clientId, subscription string) (ch chan *Message, ok bool) {
-	if ok = c.names.touch(clientId); !ok {
-		return
+/*
+Publish the client's message to the channel. It fails with
+errUnknownClient, errUnauthorized, errWildcardPublish or the validation
+error of the channel.
+*/
+func (c *Server) publish(clientId, channel string, data json.RawMessage, options ...PublishOptions) (ch chan *Message, err error) {
+	if !c.names.touch(clientId) {
+		return nil, errUnknownClient
 	}
-	if ok = c.broker.unsubscribe(clientId, subscription); !ok {
+	if err = validatePublish(channel); err != nil {
+		c.logger.Infof("[%8.8v]Publish to '%v' is invalid: %v", clientId, channel, err)
 		return
 	}
+	if !c.authorize(clientId, channel, AUTH_PUBLISH) {
+		c.logger.Infof("[%8.8v]Publish to '%v' is denied.", clientId, channel)
+		return nil, errUnauthorized
+	}
+	c.logger.Debugf("[%8.8v]Publish '%s' at '%v'", clientId, data, channel)
+	atomic.AddInt64(&c.broker.local().counters.published, 1)
+	var exclude []string
+	for _, o := range options {
+		exclude = append(exclude, o.exclusions(clientId)...)
+	}
+	c.broadcastTraced(clientId, channel, data, exclude)
+	return c.pendingChannelOf(clientId)
+}
+
+/*
+Broadcast the published message in a "publish" span of the tracer.
+*/
+func (c *Server) broadcastTraced(clientId, channel string, data json.RawMessage, exclude []string) {
+	span := c.broker.local().startSpan("publish")
+	span.SetTag("clientId", clientId)
+	span.SetTag("channel", channel)
+	c.broker.broadcastTraced(span, clientId, channel, data, exclude)
+	span.End()
+}
+
+/*
+Close the client's downstream channel and return the undelivered
+messages to its session, e.g. when the client is gone during a poll.
+*/
+func (c *Server) closeAndReturn(clientId string, msgs []*Message) {
 	c.RLock()
-	defer c.RUnlock()
+	ss, ok := c.sessions[clientId]
+	c.RUnlock()
+	if !ok || !ss.fail(msgs) {
+		c.undelivered(clientId, msgs)
+	}
+}
 
-	var ss *Session
-	if ss, ok = c.sessions[clientId]; ok {
-		ch, _ = ss.obtainChannel(false)
+/*
+Report the messages never delivered to the client, e.g. once its
+session is closed with them left in the mailbox.
+*/
+func (c *Server) undelivered(clientId string, msgs []*Message) {
+	c.RLock()
+	callback := c.onUndelivered
+	c.RUnlock()
+	if callback != nil && len(msgs) > 0 {
+		c.logger.Debugf("[%8.8v]%v messages are undelivered.", clientId, len(msgs))
+		callback(clientId, msgs)
 	}
-	return
 }
 
-func (c *Server) publish(clientId, channel, data string) (ch chan *Message, ok bool) {
-	if ok = c.names.touch(clientId); !ok {
+/*
+Report the client whose mailbox is over the high-water mark.
+*/
+func (c *Server) slowConsumer(clientId string, depth int) {
+	c.RLock()
+	callback := c.onSlow
+	c.RUnlock()
+	if callback != nil {
+		callback(clientId, depth)
+	}
+}
+
+/*
+Report the messages of a closed channel nobody is going to receive.
+*/
+func (c *Server) discard(clientId string, ch chan *Message) {
+	var msgs []*Message
+	for msg := range ch {
+		msgs = append(msgs, msg)
+	}
+	c.undelivered(clientId, msgs)
+}
+
+/*
+Obtain a non-connect channel carrying pending messages. It's merely
+an opportunity to piggyback messages, so a busy session is skipped
+and its messages are left for the next connect.
+*/
+func (c *Server) obtainPendingChannel(ss *Session) chan *Message {
+	ch, _, err := ss.obtainChannel(false)
+	if err != nil {
+		c.logger.Infof("[%8.8v]%v", ss.ID, err)
+	}
+	return ch
+}
+
+/*
+Stop accepting new clients, then close all the existing sessions and
+release their broker channels.
+*/
+func (c *Server) shutdown() {
+	c.Lock()
+	c.closed = true
+	sessions := c.sessions
+	c.sessions = make(map[string]*Session)
+	c.tokens = make(map[string]string)
+	atomic.AddInt64(&c.broker.local().counters.clients, -int64(len(sessions)))
+	c.Unlock()
+
+	for clientId, ss := range sessions {
+		ss.shutdown()
+		c.broker.deregister(clientId)
+	}
+	c.broker.close()
+}
+
+/*
+Publish message without client ID.
+*/
+func (c *Server) whisper(channel string, data json.RawMessage, options ...PublishOptions) error {
+	if err := validateChannel(channel); err != nil {
+		return err
+	}
+	var exclude []string
+	for _, o := range options {
+		exclude = append(exclude, o.Exclude...)
+	}
+	atomic.AddInt64(&c.broker.local().counters.published, 1)
+	c.broadcastTraced("", channel, data, exclude)
+	return nil
+}
+
+/*
+Publish the message of a client without client ID, if anonymous publish
+is allowed. It's authorized by the security policy with an empty client
+ID, and limited by a rate shared by all the anonymous publishers.
+*/
+func (c *Server) publishAnonymous(channel string, data json.RawMessage) (wait time.Duration, err error) {
+	c.RLock()
+	allowed := c.anonymous
+	c.RUnlock()
+	if !allowed {
+		return 0, errAnonymousPublish
+	}
+	if err = validatePublish(channel); err != nil {
 		return
 	}
-	log.Printf("[%8.8v]Publish '%v' at '%v'", clientId, data, channel)
-	c.broker.broadcast(channel, data)
+	if ok, wait := c.anonLimit.allow(""); !ok {
+		return wait, errRateLimited
+	}
+	if !c.authorize("", channel, AUTH_PUBLISH) {
+		c.logger.Infof("Anonymous publish to '%v' is denied.", channel)
+		return 0, errUnauthorized
+	}
+	return 0, c.whisper(channel, data)
+}
+
+/*
+Publish the messages to the channel in order without client ID.
+*/
+func (c *Server) whisperBatch(channel string, data []json.RawMessage, options ...PublishOptions) error {
+	if err := validateChannel(channel); err != nil {
+		return err
+	}
+	var exclude []string
+	for _, o := range options {
+		exclude = append(exclude, o.Exclude...)
+	}
+	atomic.AddInt64(&c.broker.local().counters.published, int64(len(data)))
+	c.broker.broadcastBatch("", channel, data, exclude...)
+	return nil
+}
+
+/*
+Take the reconnect advice kept for the next connect of the client, or
+empty if there's none.
+*/
+func (c *Server) takeAdvice(clientId string) string {
+	c.RLock()
+	ss, ok := c.sessions[clientId]
+	c.RUnlock()
+	if !ok {
+		return ""
+	}
+	return ss.takeAdvice()
+}
+
+/*
+Keep the client alive without a message, e.g. for applications having
+their own liveness signals. It refreshes both the client ID and the
+idle timer of the session, and returns whether the client exists.
+*/
+func (c *Server) Touch(clientId string) bool {
+	if !c.names.touch(clientId) {
+		return false
+	}
 	c.RLock()
-	defer c.RUnlock()
+	ss, ok := c.sessions[clientId]
+	c.RUnlock()
+	return ok && ss.touch()
+}
 
-	var ss *Session
-	if ss, ok = c.sessions[clientId]; ok {
-		ch, _ = ss.obtainChannel(false)
+/*
+List the client IDs whose subscriptions match the concrete channel,
+including the wildcard ones.
+*/
+func (c *Server) Subscribers(channel string) []string {
+	return c.broker.local().subscribers(channel)
+}
+
+/*
+Take a snapshot of the live rules in the router table, e.g. to detect
+the clients subscribing to overly broad wildcards.
+*/
+func (c *Server) RouterSnapshot() []RuleInfo {
+	return c.broker.local().router.Rules()
+}
+
+/*
+List the channels the client has subscribed to.
+*/
+func (c *Server) Channels(clientId string) []string {
+	return c.broker.local().channels(clientId)
+}
+
+/*
+The notice delivered to a client on /meta/unsubscribe, once its
+subscription is removed by the server.
+*/
+type unsubscribedNotice struct {
+	Subscription string `json:"subscription"`
+	Reason       string `json:"reason,omitempty"`
+}
+
+/*
+Remove the client's subscription on its behalf, e.g. when its
+authorization is revoked. The client is told by a notice event on
+/meta/unsubscribe carrying the subscription and the reason, so that it
+doesn't keep expecting messages. It returns false if the client didn't
+subscribe the channel.
+*/
+func (c *Server) Unsubscribe(clientId, subscription, reason string) bool {
+	if !c.broker.unsubscribe(clientId, subscription) {
+		return false
 	}
-	return
+	c.logger.Infof("[%8.8v]Unsubscribed from '%v' by the server: %v", clientId, subscription, reason)
+	c.notifyPresence(clientId, subscription, PRESENCE_UNSUBSCRIBE)
+	data, _ := json.Marshal(&unsubscribedNotice{subscription, reason})
+	b := c.broker.local()
+	b.send(clientId, &Message{channel: "/meta/unsubscribe", data: data, timestamp: b.timestamp()})
+	return true
 }
 
 /*
-Publish message without client ID.
+Remove all the subscriptions of the client at once, e.g. for admin
+use, without notifying the client. It returns the number of the
+removed subscriptions.
 */
-func (c *Server) whisper(channel, data string) {
-	c.broker.broadcast(channel, data)
+func (c *Server) UnsubscribeAll(clientId string) int {
+	return c.broker.local().unsubscribeAll(clientId)
 }
 
 /*
 Send message directly to target client.
 */
-func (c *Server) Send(toClientId, channel, data string) bool {
+func (c *Server) Send(toClientId, channel string, data json.RawMessage) bool {
 	c.RLock()
-	defer c.Unlock()
+	defer c.RUnlock()
 
 	if ss, ok := c.sessions[toClientId]; ok {
-		ss.input <- &Message{channel: channel, data: data}
+		ss.input <- &Message{channel: channel, data: data, timestamp: c.broker.local().timestamp()}
 		return true
 	} else {
 		return false
 	}
 }
+
+/*
+The number of the connected clients. It's an atomic read, so that a
+frequent health check doesn't contend with the clients.
+*/
+func (c *Server) ClientCount() int {
+	return int(atomic.LoadInt64(&c.broker.local().counters.clients))
+}
+
+/*
+The number of the active subscriptions, read atomically as well.
+*/
+func (c *Server) SubscriptionCount() int {
+	return int(atomic.LoadInt64(&c.broker.local().counters.subscriptions))
+}
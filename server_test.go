@@ -1,8 +1,12 @@
 package gocomet
 
 import (
+	"encoding/json"
+	"fmt"
 	"log"
 	"runtime"
+	"strconv"
+	"sync"
 	"testing"
 	"time"
 )
@@ -21,10 +25,10 @@ func TestConnect(t *testing.T) {
 	log.Println("Testing connect...")
 	s := newServer()
 	c1, _ := s.handshake()
-	_, _, ok := s.connect(c1)
-	assert(ok, t, "failed to connect simple client")
-	_, _, ok = s.connect("invalid")
-	assert(!ok, t, "invalid client should not connect")
+	_, _, err := s.connect(c1)
+	assert(err == nil, t, "failed to connect simple client")
+	_, _, err = s.connect("invalid")
+	assert(err == errUnknownClient, t, "invalid client should not connect")
 }
 
 func TestDisconnect(t *testing.T) {
@@ -50,97 +54,186 @@ func TestDisconnect(t *testing.T) {
 func TestSubscribe(t *testing.T) {
 	log.Println("Testing subscribe...")
 	s := newServer()
-	_, ok := s.subscribe("invalid", "/foo/bar")
-	assert(!ok, t, "cannot subscribe w/o client ID")
+	_, err := s.subscribe("invalid", "/foo/bar")
+	assert(err == errUnknownClient, t, "cannot subscribe w/o client ID (got %v)", err)
 
 	c1, _ := s.handshake()
-	_, ok = s.subscribe(c1, "/foo/bar")
-	assert(ok, t, "failed to subscribe w/o connect")
+	_, err = s.subscribe(c1, "/foo/bar")
+	assert(err == nil, t, "failed to subscribe w/o connect: %v", err)
 
 	s.connect(c1)
-	_, ok = s.subscribe(c1, "/foo/bar")
-	assert(ok, t, "failed to subscribe")
+	_, err = s.subscribe(c1, "/foo/bar")
+	assert(err == nil, t, "failed to subscribe: %v", err)
+	_, err = s.subscribe(c1, "/foo//bar")
+	assert(err == errEmptySegment, t, "cannot subscribe to a malformed channel (got %v)", err)
 }
 
 func TestUnsubscribe(t *testing.T) {
 	log.Println("Testing unsubscribe...")
 	s := newServer()
-	_, ok := s.unsubscribe("invalid", "/foo/bar")
-	assert(!ok, t, "cannot unsubscribe w/o client ID")
+	_, err := s.unsubscribe("invalid", "/foo/bar")
+	assert(err == errUnknownClient, t, "cannot unsubscribe w/o client ID (got %v)", err)
 	c1, _ := s.handshake()
-	_, ok = s.unsubscribe(c1, "/foo/bar")
-	assert(!ok, t, "cannot unsubscribe w/o connect first")
+	_, err = s.unsubscribe(c1, "/foo/bar")
+	assert(err == errNotSubscribed, t, "cannot unsubscribe w/o connect first (got %v)", err)
 	s.connect(c1)
-	_, ok = s.unsubscribe(c1, "/foo/bar")
-	assert(!ok, t, "cannot unsubscribe w/o subscribe first")
+	_, err = s.unsubscribe(c1, "/foo/bar")
+	assert(err == errNotSubscribed, t, "cannot unsubscribe w/o subscribe first (got %v)", err)
 	s.subscribe(c1, "/foo/bar")
-	_, ok = s.unsubscribe(c1, "/foo/bar")
-	assert(ok, t, "failed to unsubscribe")
+	_, err = s.unsubscribe(c1, "/foo/bar")
+	assert(err == nil, t, "failed to unsubscribe: %v", err)
 }
 
 func TestPublish(t *testing.T) {
 	log.Println("Testing publish...")
 	s := newServer()
-	_, ok := s.publish("invalid", "/foo/bar", "ping")
-	assert(!ok, t, "cannot publish with invalid client ID")
+	_, err := s.publish("invalid", "/foo/bar", json.RawMessage(`"ping"`))
+	assert(err == errUnknownClient, t, "cannot publish with invalid client ID (got %v)", err)
 
 	c1, _ := s.handshake()
-	_, ok = s.publish(c1, "/foo/bar", "ping")
-	assert(ok, t, "failed to publish w/o connect")
+	_, err = s.publish(c1, "/foo/bar", json.RawMessage(`"ping"`))
+	assert(err == nil, t, "failed to publish w/o connect: %v", err)
+	_, err = s.publish(c1, "/foo/*", json.RawMessage(`"ping"`))
+	assert(err == errWildcardPublish, t, "cannot publish to a wildcard channel (got %v)", err)
 
 	c2, _ := s.handshake()
-	ch, _, ok := s.connect(c2)
-	var msg string
-	go func() { msg = (<-ch).data }()
+	ch, _, _ := s.connect(c2)
+	s.subscribe(c2, "/foo/bar")
+	s.publish(c1, "/foo/bar", json.RawMessage(`"ping"`))
+	msg := nextMessage(ch)
+	assert(msg != nil && string(msg.data) == `"ping"`, t, "failed to receive the delivered message (got %v)", msg)
+}
+
+// the next message from the channel, or nil if none comes in time
+func nextMessage(ch chan *Message) *Message {
+	select {
+	case msg := <-ch:
+		return msg
+	case <-time.After(time.Second):
+		return nil
+	}
+}
+
+func TestPublisherIdentity(t *testing.T) {
+	log.Println("Testing publisher identity...")
+	s := newServer()
+	c1, _ := s.handshake()
+	c2, _ := s.handshake()
+	ch, _, _ := s.connect(c2)
 	s.subscribe(c2, "/foo/bar")
-	s.publish(c1, "/foo/bar", "ping")
+	s.publish(c1, "/foo/bar", json.RawMessage(`"ping"`))
+	msg := nextMessage(ch)
+	assert(msg != nil && msg.clientId == c1, t, "subscriber should see the publisher (got %v)", msg)
+
+	c3, _ := s.handshake()
+	ch, _, _ = s.connect(c3)
+	s.subscribe(c3, "/foo/baz")
+	s.whisper("/foo/baz", json.RawMessage(`"ping"`))
+	msg = nextMessage(ch)
+	assert(msg != nil && msg.clientId == "", t, "whisper should be anonymous (got %v)", msg)
+}
+
+func TestExcludeSender(t *testing.T) {
+	log.Println("Testing publish excluding the sender...")
+	s := newServer()
+	c1, _ := s.handshake()
+	c2, _ := s.handshake()
+	c3, _ := s.handshake()
+	for _, c := range []string{c1, c2, c3} {
+		s.subscribe(c, "/chat")
+	}
+	s.publish(c1, "/chat", json.RawMessage(`"hi"`), parsePublishOptions(map[string]interface{}{"excludeSender": true}))
+	s.whisper("/chat", json.RawMessage(`"psst"`), PublishOptions{Exclude: []string{c2}})
 	time.Sleep(10 * time.Millisecond)
-	assert(msg == "ping", t, "failed to receive the delivered message (got %v)", msg)
+	count := func(clientId string) (n int) {
+		ch, _ := s.disconnect(clientId)
+		for _ = range ch {
+			n++
+		}
+		return
+	}
+	assert(count(c1) == 1, t, "publisher should not receive its own message")
+	assert(count(c2) == 1, t, "excluded client should not receive the whisper")
+	assert(count(c3) == 2, t, "other subscribers should receive both messages")
 }
 
 func TestWhisper(t *testing.T) {
 	log.Println("Testing whisper...")
 	s := newServer()
-	s.whisper("/foo/bar", "ping")
+	s.whisper("/foo/bar", json.RawMessage(`"ping"`))
 
 	c1, _ := s.handshake()
 	ch, _, _ := s.connect(c1)
-	var msg string
-	go func() { msg = (<-ch).data }()
 	s.subscribe(c1, "/foo/bar")
-	s.whisper("/foo/bar", "ping")
-	time.Sleep(10 * time.Millisecond) // give msg receiver a chance
-	assert(msg == "ping", t, "failed to receive whipered message (got %v)", msg)
+	s.whisper("/foo/bar", json.RawMessage(`"ping"`))
+	msg := nextMessage(ch)
+	assert(msg != nil && string(msg.data) == `"ping"`, t, "failed to receive whipered message (got %v)", msg)
 }
 
 func TestTwoConnectionRestrict(t *testing.T) {
 	log.Println("Testing 2 connections restrict...")
 	s := newServer()
 	c1, _ := s.handshake()
-	ch1, timeout, _ := s.connect(c1)
-	var msg string
-	go func() { msg = (<-ch1).data }()
+	ch1, _, _ := s.connect(c1)
 	ch2, _ := s.subscribe(c1, "/foo/bar")
 	_, ok := <-ch2
-	assert(!ok, t, "only one active channel is allowed")
+	assert(!ok, t, "the active connect should win over a subscribe")
 
 	c2, _ := s.handshake()
 	s.connect(c2)
-	s.publish(c2, "/foo/bar", "ping")
-	time.Sleep(10 * time.Millisecond)
-	assert(msg == "ping", t, "failed to receive message from previous active connect")
+	s.publish(c2, "/foo/bar", json.RawMessage(`"ping"`))
+	msg, ok := <-ch1
+	assert(ok && string(msg.data) == `"ping"`, t, "failed to receive message from previous active connect")
 
-	timeout <- true
+	ch3, stop, _ := s.connect(c1)
 	_, ok = <-ch1
-	assert(!ok, t, "active channel should be closed after disconnect")
+	assert(!ok, t, "previous connect should be closed once superseded")
+	s.publish(c2, "/foo/bar", json.RawMessage(`"pong"`))
+	select {
+	case msg = <-ch3:
+		assert(string(msg.data) == `"pong"`, t, "failed to receive message from new active connect (got %s)", msg.data)
+	case <-time.After(time.Second):
+		t.Error("new active connect should receive the messages")
+	}
 
+	stop <- true
+	_, ok = <-ch3
+	assert(!ok, t, "active channel should be closed once stopped")
 	s.subscribe(c1, "/foo/bar/2")
 	ch4, _, _ := s.connect(c1)
-	msg = ""
-	go func() { msg = (<-ch4).data }()
-	s.publish(c2, "/foo/bar/2", "ping")
-	time.Sleep(10 * time.Millisecond)
-	assert(msg == "ping", t, "failed to receive message from new active connect (got %v)", msg)
+	s.publish(c2, "/foo/bar/2", json.RawMessage(`"ping"`))
+	select {
+	case msg = <-ch4:
+		assert(string(msg.data) == `"ping"`, t, "failed to receive message from new active connect (got %s)", msg.data)
+	case <-time.After(time.Second):
+		t.Error("new active connect should receive the messages")
+	}
+}
+
+func TestMaxClients(t *testing.T) {
+	inst := New().SetMaxClients(10)
+	var wg sync.WaitGroup
+	var lock sync.Mutex
+	var accepted []string
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if id, err := inst.handshake(); err == nil {
+				lock.Lock()
+				accepted = append(accepted, id)
+				lock.Unlock()
+			} else {
+				assert(err == errTooManyClients, t, "handshake should fail beyond the limit (got %v)", err)
+			}
+		}()
+	}
+	wg.Wait()
+	assert(len(accepted) == 10, t, "concurrent handshakes should never overshoot (got %v)", len(accepted))
+
+	inst.disconnect(accepted[0])
+	_, err := inst.handshake()
+	assert(err == nil, t, "handshake should succeed once a client is gone (got %v)", err)
 }
 
 func TestAvoidReuseClientId(t *testing.T) {
@@ -157,3 +250,261 @@ func TestAvoidReuseClientId(t *testing.T) {
 		names[id] = true
 	}
 }
+
+func TestCustomIdGenerator(t *testing.T) {
+	log.Println("Testing collision-prone client ID generator...")
+	inst := New()
+	var next int
+	inst.SetIdGenerator(func() string { // only 3 distinct IDs
+		next++
+		return strconv.Itoa(next % 3)
+	})
+	names := make(map[string]bool)
+	for i := 0; i < 3; i++ {
+		id, err := inst.handshake()
+		assert(err == nil && !names[id], t, "ID should be retried on conflict (got %v, %v)", id, err)
+		names[id] = true
+	}
+	_, err := inst.handshake()
+	assert(err == errIdExhausted, t, "handshake should fail once IDs are exhausted (got %v)", err)
+	assert(len(inst.names.values) == 3, t, "a conflicting ID should not be kept")
+
+	for id := range names {
+		inst.disconnect(id)
+		break
+	}
+	id, err := inst.handshake()
+	assert(err == nil && names[id], t, "released ID should be reused (got %v, %v)", id, err)
+}
+
+func TestSessionTimeout(t *testing.T) {
+	log.Println("Testing session timeout...")
+	s := newServer()
+	s.options.timeout = 20 * time.Millisecond
+	c1, _ := s.handshake()
+	time.Sleep(50 * time.Millisecond)
+	s.RLock()
+	_, ok := s.sessions[c1]
+	s.RUnlock()
+	assert(!ok, t, "idle session should be removed after timeout")
+}
+
+func TestSessionLifetime(t *testing.T) {
+	log.Println("Testing session lifetime...")
+	s := newServer()
+	s.options.lifetime = 50 * time.Millisecond
+	c1, _ := s.handshake()
+	var err error
+	for i := 0; i < 10 && err == nil; i++ {
+		var stop chan bool
+		if _, stop, err = s.connect(c1); err == nil {
+			stop <- true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert(err == errUnknownClient, t, "active session should expire after its lifetime (got %v)", err)
+}
+
+func TestChannelStats(t *testing.T) {
+	log.Println("Testing channel stats...")
+	s := newServer()
+	c1, _ := s.handshake()
+	c2, _ := s.handshake()
+	s.subscribe(c1, "/foo/bar")
+	s.subscribe(c2, "/foo/bar")
+	s.subscribe(c2, "/foo/*")
+	s.publish(c1, "/foo/bar", json.RawMessage(`1`))
+	s.publish(c1, "/foo/baz", json.RawMessage(`2`))
+	s.publish(c1, "/foo/baz", json.RawMessage(`3`))
+	s.unsubscribe(c1, "/foo/bar")
+
+	stats := s.ChannelStats()
+	bar, baz, wildcard := stats["/foo/bar"], stats["/foo/baz"], stats["/foo/*"]
+	assert(bar.Publishes == 1 && bar.Deliveries == 2 && bar.Subscribers == 1, t, "wrong stats of /foo/bar (got %v)", bar)
+	assert(baz.Publishes == 2 && baz.Deliveries == 2 && baz.Subscribers == 0, t, "wrong stats of /foo/baz (got %v)", baz)
+	assert(wildcard.Subscribers == 1, t, "wrong stats of /foo/* (got %v)", wildcard)
+}
+
+func TestChannelStatsBounded(t *testing.T) {
+	stats := newChannelStats(2)
+	for _, channel := range []string{"/a", "/b", "/a", "/c"} {
+		stats.update(channel, true, func(stat *ChannelStat) { stat.Publishes++ })
+	}
+	snapshot := stats.snapshot()
+	_, hasB := snapshot["/b"]
+	assert(len(snapshot) == 2 && !hasB, t, "least recently used channel should be dropped (got %v)", snapshot)
+}
+
+func TestSubscribersAndChannels(t *testing.T) {
+	log.Println("Testing subscribers and channels...")
+	s := newServer()
+	c1, _ := s.handshake()
+	c2, _ := s.handshake()
+	s.subscribe(c1, "/foo/bar")
+	s.subscribe(c2, "/foo/*")
+	s.subscribe(c2, "/baz")
+
+	subscribers := s.Subscribers("/foo/qux")
+	assert(len(subscribers) == 1 && subscribers[0] == c2, t, "wildcard subscriber should match (got %v)", subscribers)
+	assert(len(s.Subscribers("/none")) == 0, t, "no one subscribes /none")
+	channels := s.Channels(c2)
+	assert(len(channels) == 2 && channels[0] == "/baz" && channels[1] == "/foo/*", t, "wrong channels of c2 (got %v)", channels)
+	assert(len(s.Channels("invalid")) == 0, t, "unknown client has no channels")
+}
+
+func TestClientHealth(t *testing.T) {
+	log.Println("Testing client health...")
+	inst := New().SetMailbox(2, DropNewest)
+	slow, _ := inst.handshake()
+	inst.subscribe(slow, "/foo/bar")
+	publisher, _ := inst.handshake()
+	for i := 0; i < 5; i++ {
+		inst.publish(publisher, "/foo/bar", json.RawMessage(`"ping"`))
+	}
+	time.Sleep(10 * time.Millisecond)
+	health := inst.ClientHealth(slow)
+	assert(health.Delivered == 5 && health.Dropped == 3, t, "3 messages should be dropped by the slow client (got %v)", health)
+
+	b := newBroker()
+	b.register("stuck")
+	b.subscribe("stuck", "/foo/bar")
+	for i := 0; i < CLIENT_BUFFER+3; i++ {
+		b.broadcast("", "/foo/bar", json.RawMessage(`"ping"`))
+	}
+	health = b.health.get("stuck")
+	assert(health.Delivered == CLIENT_BUFFER && health.Dropped == 3, t, "full buffer should drop messages (got %v)", health)
+	b.deregister("stuck")
+	health = b.health.get("stuck")
+	assert(health.Delivered == 0 && health.Dropped == 0, t, "health should be reset once the client is gone (got %v)", health)
+}
+
+func TestTouch(t *testing.T) {
+	log.Println("Testing touch...")
+	s := newServer()
+	s.options.timeout = 50 * time.Millisecond
+	c1, _ := s.handshake()
+	for i := 0; i < 4; i++ {
+		time.Sleep(30 * time.Millisecond)
+		assert(s.Touch(c1), t, "touched session should be alive")
+	}
+	time.Sleep(100 * time.Millisecond)
+	assert(!s.Touch(c1), t, "idle session should be removed after timeout")
+	assert(!s.Touch("invalid"), t, "invalid client should not be touched")
+}
+
+func TestBrokerReleased(t *testing.T) {
+	log.Println("Testing broker released...")
+	s := newServer()
+	s.options.timeout = 20 * time.Millisecond
+	c1, _ := s.handshake()
+	c2, _ := s.handshake()
+	s.subscribe(c1, "/foo/bar")
+	s.subscribe(c2, "/foo/*")
+	s.disconnect(c1)
+	time.Sleep(50 * time.Millisecond) // c2 times out
+
+	b := s.broker.local()
+	b.broadcast("", "/foo/bar", json.RawMessage(`"ping"`))
+	assert(!b.hasClient(c1) && !b.hasClient(c2), t, "broker should release the clients")
+	b.RLock()
+	rules := len(b.rules)
+	b.RUnlock()
+	assert(rules == 0, t, "broker should release the rules (got %v)", rules)
+	assert(len(b.router.run("/foo/bar")) == 0, t, "no rule should linger in router: %v", b.router)
+}
+
+func TestForcedUnsubscribe(t *testing.T) {
+	log.Println("Testing forced unsubscribe...")
+	s := newServer()
+	c1, _ := s.handshake()
+	s.subscribe(c1, "/foo/bar")
+	assert(s.Unsubscribe(c1, "/foo/bar", "revoked"), t, "subscription should be removed")
+	assert(!s.Unsubscribe(c1, "/foo/bar", "revoked"), t, "subscription should not be removed twice")
+	s.whisper("/foo/bar", json.RawMessage(`"ping"`))
+
+	ch, _, _ := s.connect(c1)
+	var msg *Message
+	select {
+	case msg = <-ch:
+	case <-time.After(time.Second):
+	}
+	var notice unsubscribedNotice
+	assert(msg != nil && msg.channel == "/meta/unsubscribe", t, "client should receive the notice (got %v)", msg)
+	json.Unmarshal(msg.data, &notice)
+	assert(notice.Subscription == "/foo/bar" && notice.Reason == "revoked", t, "unexpected notice %v", msg)
+	assert(len(ch) == 0, t, "no more message after unsubscribed")
+}
+
+func TestStats(t *testing.T) {
+	log.Println("Testing stats...")
+	s := newServer()
+	c1, _ := s.handshake()
+	c2, _ := s.handshake()
+	s.subscribe(c1, "/foo/bar")
+	s.subscribe(c2, "/foo/bar")
+	s.subscribe(c2, "/foo/baz")
+	s.publish(c1, "/foo/bar", json.RawMessage(`1`))
+	s.whisper("/foo/baz", json.RawMessage(`2`))
+	s.unsubscribe(c2, "/foo/baz")
+	stats := s.Stats()
+	assert(stats == Stats{Clients: 2, Handshakes: 2, Subscriptions: 2, Published: 2, Delivered: 3}, t, "unexpected stats %+v", stats)
+
+	s.disconnect(c1)
+	time.Sleep(10 * time.Millisecond)
+	stats = s.Stats()
+	assert(stats.Clients == 1 && stats.Handshakes == 2 && stats.Subscriptions == 1, t, "unexpected stats after disconnect %+v", stats)
+}
+
+func TestCountsUnderChurn(t *testing.T) {
+	log.Println("Testing client and subscription counts...")
+	s := newServer()
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				c, _ := s.handshake()
+				s.subscribe(c, fmt.Sprintf("/foo/%d", j%3))
+				s.subscribe(c, "/bar/*")
+				if j%2 == 0 {
+					s.unsubscribe(c, "/bar/*")
+				}
+				if j%3 == 0 {
+					s.disconnect(c)
+				}
+			}
+		}(i)
+		go func() { // the health check
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				assert(s.ClientCount() >= 0 && s.SubscriptionCount() >= 0, t, "counts should never be negative")
+			}
+		}()
+	}
+	wg.Wait()
+
+	s.RLock()
+	clients := len(s.sessions)
+	s.RUnlock()
+	subscriptions := len(s.RouterSnapshot())
+	assert(s.ClientCount() == clients, t, "client count %v should match the sessions %v", s.ClientCount(), clients)
+	assert(s.SubscriptionCount() == subscriptions, t, "subscription count %v should match the rules %v", s.SubscriptionCount(), subscriptions)
+}
+
+func TestMaxSubscriptions(t *testing.T) {
+	inst := New().SetMaxSubscriptionsPerClient(3)
+	c1, _ := inst.handshake()
+	for i := 0; i < 3; i++ {
+		_, err := inst.subscribe(c1, fmt.Sprintf("/foo/%d", i))
+		assert(err == nil, t, "subscription %v should be allowed: %v", i, err)
+	}
+	_, err := inst.subscribe(c1, "/foo/0")
+	assert(err == nil, t, "subscribing again should be allowed: %v", err)
+	_, err = inst.subscribe(c1, "/foo/3")
+	assert(err == errTooManySubscriptions, t, "subscription over the limit should fail (got %v)", err)
+	assert(inst.SubscriptionCount() == 3, t, "expect 3 subscriptions (got %v)", inst.SubscriptionCount())
+	inst.unsubscribe(c1, "/foo/0")
+	_, err = inst.subscribe(c1, "/foo/3")
+	assert(err == nil, t, "subscription should be allowed after unsubscribe: %v", err)
+}
@@ -0,0 +1,106 @@
+package gocomet
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+/*
+Match the channel against the pattern segment by segment, where "*" or
+a named parameter like {id} matches exactly one segment and a trailing
+"**" matches the rest. The segments matched by them are returned in
+order.
+*/
+func matchChannel(pattern, channel string) (params []string, ok bool) {
+	parts, segments := strings.Split(pattern, "/"), strings.Split(channel, "/")
+	for i, part := range parts {
+		if part == "**" && i == len(parts)-1 {
+			if i >= len(segments) {
+				return nil, false
+			}
+			return append(params, strings.Join(segments[i:], "/")), true
+		}
+		if i >= len(segments) {
+			return nil, false
+		}
+		switch {
+		case matchesAny(part):
+			params = append(params, segments[i])
+		case part == segments[i]:
+			// literal segment matched
+		default:
+			return nil, false
+		}
+	}
+	return params, len(parts) == len(segments)
+}
+
+/*
+Find the service handler of the channel. An exact match is preferred,
+otherwise the longest service channel matched wins. The segments
+matched by its wildcards and parameters are returned as params in
+order, and those by its parameters as named too.
+*/
+func (c *Instance) service(channel string) (handler func(session *Session, message *MetaMessage), params []string, named map[string]string, ok bool) {
+	c.RLock()
+	defer c.RUnlock()
+
+	if handler, ok = c.services[channel]; ok {
+		return
+	}
+	var best *RouteMatch
+	matches := c.servicePatterns.runWithParams(channel)
+	for i, m := range matches {
+		if best == nil || len(m.Pattern) > len(best.Pattern) ||
+			len(m.Pattern) == len(best.Pattern) && m.Pattern < best.Pattern {
+			best = &matches[i]
+		}
+	}
+	if best == nil {
+		return nil, nil, nil, false
+	}
+	params, _ = matchChannel(best.Pattern, channel)
+	return c.services[best.Pattern], params, best.Params, true
+}
+
+/*
+Call the service handler with the message of the client instead of
+broadcasting it. The handler replies to the client only by
+message.Reply.
+*/
+func (c *Server) callService(handler func(session *Session, message *MetaMessage), message *MetaMessage) (ch chan *Message, err error) {
+	if !c.names.touch(message.ClientId) {
+		return nil, errUnknownClient
+	}
+	if !c.authorize(message.ClientId, message.Channel, AUTH_PUBLISH) {
+		c.logger.Infof("[%8.8v]Call to '%v' is denied.", message.ClientId, message.Channel)
+		return nil, errUnauthorized
+	}
+	c.RLock()
+	ss, ok := c.sessions[message.ClientId]
+	c.RUnlock()
+	if !ok {
+		return nil, errUnknownClient
+	}
+	message.Reply = func(data json.RawMessage) bool {
+		return c.reply(ss, message.Channel, data)
+	}
+	handler(ss, message)
+	// nothing is piggybacked, so that the replies are left in the session
+	// for the next connect
+	return closedChannel, nil
+}
+
+/*
+Queue the message in the session like a broadcast, without waiting for
+a busy session, unless it's ended already. It returns whether the
+message is queued.
+*/
+func (c *Server) reply(ss *Session, channel string, data json.RawMessage) bool {
+	b := c.broker.local()
+	return b.sendTo(ss.ID, ss.input, &Message{channel: channel, data: data, timestamp: b.timestamp()})
+}
+
+func isWildcard(channel string) bool {
+	return strings.Contains(channel, "*")
+}
@@ -0,0 +1,110 @@
+package gocomet
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMatchChannel(t *testing.T) {
+	params, ok := matchChannel("/service/user/*/profile", "/service/user/42/profile")
+	assert(ok && len(params) == 1 && params[0] == "42", t, "failed to match wildcard segment (got %v)", params)
+	_, ok = matchChannel("/service/user/*/profile", "/service/user/42/settings")
+	assert(!ok, t, "should not match different segment")
+	_, ok = matchChannel("/service/user/*/profile", "/service/user/42/profile/x")
+	assert(!ok, t, "should not match more segments")
+	params, ok = matchChannel("/service/user/{id}/profile", "/service/user/42/profile")
+	assert(ok && len(params) == 1 && params[0] == "42", t, "failed to match parameter segment (got %v)", params)
+	params, ok = matchChannel("/service/**", "/service/a/b")
+	assert(ok && len(params) == 1 && params[0] == "a/b", t, "failed to match trailing wildcard (got %v)", params)
+}
+
+func TestServiceParams(t *testing.T) {
+	inst := New()
+	var received []string
+	inst.AddService("/service/user/*/profile", func(session *Session, message *MetaMessage) {
+		received = message.Params
+	})
+	inst.AddService("/service/user/admin/profile", func(session *Session, message *MetaMessage) {
+		received = []string{"exact"}
+	})
+
+	handler, params, _, ok := inst.service("/service/user/42/profile")
+	if !ok {
+		t.Fatal("failed to find wildcard service")
+	}
+	handler(nil, &MetaMessage{Channel: "/service/user/42/profile", Params: params})
+	assert(len(received) == 1 && received[0] == "42", t, "handler should receive the matched segment (got %v)", received)
+
+	handler, _, _, _ = inst.service("/service/user/admin/profile")
+	handler(nil, &MetaMessage{})
+	assert(len(received) == 1 && received[0] == "exact", t, "exact service should be preferred (got %v)", received)
+
+	_, _, _, ok = inst.service("/service/user/42")
+	assert(!ok, t, "should not find any service")
+}
+
+func TestNamedServiceParams(t *testing.T) {
+	inst := New().SetPollTimeout(50 * time.Millisecond)
+	received := make(chan *MetaMessage, 1)
+	inst.AddService("/service/users/{id}/inbox", func(session *Session, message *MetaMessage) {
+		received <- message
+	})
+	inst.AddService("/service/users/*/**", func(session *Session, message *MetaMessage) {
+		t.Errorf("shorter service should not be called (got %v)", message.Channel)
+	})
+	caller := handshake(t, inst)
+	post(t, inst, `[{"channel":"/service/users/42/inbox","clientId":"`+caller+`","data":"ping"}]`)
+	select {
+	case message := <-received:
+		assert(message.NamedParams["id"] == "42" && len(message.Params) == 1 && message.Params[0] == "42", t,
+			"handler should receive the named parameter (got %v, %v)", message.NamedParams, message.Params)
+	case <-time.After(time.Second):
+		t.Fatal("handler should be called")
+	}
+}
+
+func TestServiceDispatch(t *testing.T) {
+	inst := New().SetPollTimeout(50 * time.Millisecond)
+	inst.AddService("/service/echo", func(session *Session, message *MetaMessage) {
+		message.Reply(message.Data)
+	})
+	caller, other := handshake(t, inst), handshake(t, inst)
+	post(t, inst, `[{"channel":"/meta/subscribe","clientId":"`+other+`","subscription":"/service/**"}]`)
+
+	_, resp := post(t, inst, `[{"channel":"/service/echo","clientId":"`+caller+`","data":"ping","id":"1"}]`)
+	assert(len(resp) == 1 && resp[0].Successful && resp[0].Id == "1", t, "service call should succeed (got %+v)", resp)
+	_, resp = post(t, inst, `[{"channel":"/service/echo","clientId":"unknown","data":"ping"}]`)
+	assert(len(resp) == 1 && strings.HasPrefix(resp[0].Error, "402:"), t, "unknown client should be rejected (got %+v)", resp)
+
+	_, resp = post(t, inst, `[{"channel":"/meta/connect","clientId":"`+caller+`","connectionType":"long-polling"}]`)
+	assert(len(resp) == 2 && resp[0].Channel == "/service/echo" && string(resp[0].Data) == `"ping"`, t,
+		"caller should receive the reply (got %+v)", resp)
+	_, resp = post(t, inst, `[{"channel":"/meta/connect","clientId":"`+other+`","connectionType":"long-polling"}]`)
+	assert(len(resp) == 1, t, "service message should not be broadcast (got %+v)", resp)
+}
+
+func TestServiceReplyWithoutLock(t *testing.T) {
+	inst := New()
+	var reply func(data json.RawMessage) bool
+	inst.AddService("/service/later", func(session *Session, message *MetaMessage) {
+		reply = message.Reply
+	})
+	caller := handshake(t, inst)
+	post(t, inst, `[{"channel":"/service/later","clientId":"`+caller+`","data":"ping"}]`)
+
+	replied := make(chan bool)
+	inst.Lock() // e.g. by a handshake in progress
+	go func() { replied <- reply(json.RawMessage(`"pong"`)) }()
+	select {
+	case ok := <-replied:
+		assert(ok, t, "reply should be queued")
+	case <-time.After(time.Second):
+		t.Error("reply should not wait for the server lock")
+	}
+	inst.Unlock()
+
+	inst.Disconnect(caller)
+	assert(!reply(json.RawMessage(`"pong"`)), t, "reply to an ended session should fail")
+}
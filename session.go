@@ -3,17 +3,19 @@ package gocomet
 import (
 	"container/list"
 	"errors"
-	"log"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 // Maximum number of retry to avoid conflict
 const MAX_ID_GEN_RETRY = 100
 
-// Maximum time to keep IDs from being auto-released
+// Default maximum time to keep IDs from being auto-released
 const MAX_ID_KEPT_TIME = 30 * time.Minute
 
+var errIdExhausted = errors.New("Unable to obtain new unique ID. Try again later.")
+
 type timeAndValue struct {
 	value  interface{}
 	expire time.Time
@@ -21,13 +23,14 @@ type timeAndValue struct {
 
 type UniqueStringPool struct {
 	sync.Locker
-	newValue func() string
-	values   map[string]*list.Element
-	order    *list.List
+	newValue  func() string
+	retention time.Duration // time to keep IDs since last touched
+	values    map[string]*list.Element
+	order     *list.List
 }
 
 func newUniqueStringPool(f func() string) *UniqueStringPool {
-	return &UniqueStringPool{&sync.Mutex{}, f, make(map[string]*list.Element), list.New()}
+	return &UniqueStringPool{&sync.Mutex{}, f, MAX_ID_KEPT_TIME, make(map[string]*list.Element), list.New()}
 }
 
 func (pool *UniqueStringPool) get() (value string, err error) {
@@ -43,21 +46,57 @@ func (pool *UniqueStringPool) get() (value string, err error) {
 		limit--
 	}
 	if limit == 0 {
-		err = errors.New("Unable to obtain new unique ID. Try again later.")
+		return "", errIdExhausted
 	}
 
 	now := time.Now()
-	pool.values[value] = pool.order.PushBack(&timeAndValue{value, now.Add(MAX_ID_KEPT_TIME)})
-	for e := pool.order.Front(); e != nil; e = e.Next() {
-		if e.Value.(*timeAndValue).expire.After(now) {
+	pool.values[value] = pool.order.PushBack(&timeAndValue{value, now.Add(pool.retention)})
+	for e := pool.order.Front(); e != nil; e = pool.order.Front() {
+		tv := e.Value.(*timeAndValue)
+		if tv.expire.After(now) {
 			break
 		}
 		pool.order.Remove(e)
+		delete(pool.values, tv.value.(string))
 	}
 
 	return
 }
 
+/*
+Replace the generator of new values. The values obtained already are
+kept, so that the new ones still don't conflict with them.
+*/
+func (pool *UniqueStringPool) setGenerator(f func() string) {
+	pool.Lock()
+	defer pool.Unlock()
+	pool.newValue = f
+}
+
+/*
+Set how long a value is kept since last touched, before it's
+auto-released. It applies to the values obtained or touched afterwards.
+*/
+func (pool *UniqueStringPool) setRetention(d time.Duration) {
+	pool.Lock()
+	defer pool.Unlock()
+	pool.retention = d
+}
+
+/*
+Return the value to the pool right away, instead of waiting for it to
+be auto-released.
+*/
+func (pool *UniqueStringPool) release(value string) {
+	pool.Lock()
+	defer pool.Unlock()
+
+	if e, ok := pool.values[value]; ok {
+		pool.order.Remove(e)
+		delete(pool.values, value)
+	}
+}
+
 func (pool *UniqueStringPool) touch(value string) (ok bool) {
 	pool.Lock()
 	defer pool.Unlock()
@@ -65,30 +104,112 @@ func (pool *UniqueStringPool) touch(value string) (ok bool) {
 	var e *list.Element
 	if e, ok = pool.values[value]; ok {
 		pool.order.Remove(e)
-		e = pool.order.PushBack(&timeAndValue{value, time.Now().Add(MAX_ID_KEPT_TIME)})
+		e = pool.order.PushBack(&timeAndValue{value, time.Now().Add(pool.retention)})
 		pool.values[value] = e
 	}
 	return
 }
 
-// Maximum allowed session idel. After that, the session is
+// Default maximum allowed session idel. After that, the session is
 // considered as disconnected.
 const MAX_SESSION_IDEL time.Duration = 1 * time.Minute
 
 // The unsent messages are kept temporarily in a mailbox. But only
-// last MAILBOX_SIZE messages are kept.
+// last MAILBOX_SIZE messages are kept by default.
 const MAILBOX_SIZE = 1000
 
-type SessionRemovalListener func(session *Session, timeout bool)
+/*
+What to do with a new message when the mailbox is full.
+*/
+type OverflowPolicy int
+
+const (
+	DropOldest OverflowPolicy = iota // drop the oldest message in the mailbox
+	DropNewest                       // drop the new message
+	Block                            // block the sender until the mailbox is drained
+)
+
+/*
+Why a session is closed.
+*/
+type CloseReason int
+
+const (
+	Disconnected CloseReason = iota // by the client, or by the server side
+	TimedOut                        // idle longer than the session timeout
+	Expired                         // alive longer than the session lifetime
+	ShutDown                        // by the shutdown of the server
+)
+
+func (r CloseReason) String() string {
+	switch r {
+	case Disconnected:
+		return "disconnected"
+	case TimedOut:
+		return "timed out"
+	case Expired:
+		return "expired"
+	case ShutDown:
+		return "shut down"
+	}
+	return "unknown"
+}
+
+// Minimum time between two reports of the same slow consumer.
+const SLOW_CONSUMER_INTERVAL = 10 * time.Second
+
+// Maximum time to wait for a busy session to accept a channel request.
+const MAX_CHANNEL_WAIT = 5 * time.Second
+
+var errChannelTimeout = errors.New("Session is busy. Try again later.")
+var errSessionClosed = errors.New("Session is closed.")
+
+/*
+The configurable behaviors of a session, which are fixed on creation.
+*/
+type sessionOptions struct {
+	wait     time.Duration // max time to accept a channel request
+	timeout  time.Duration // max idle time before auto-disconnect
+	lifetime time.Duration // max lifetime regardless of activity, or 0
+	mailbox  int           // max number of unsent messages
+	overflow OverflowPolicy
+	coalesce *channelSet    // channels keeping only the latest message
+	qos      *qosTable      // delivery guarantee of the channels
+	store    MailboxFactory // or in memory if nil
+	ttl      time.Duration  // max time to keep an unsent message, or 0
+	noReplay bool           // only the messages arriving after a request
+	highMark int            // mailbox depth of a slow consumer, or the mailbox size if 0
+	slow     func(clientId string, depth int)
+	health   *clientStats
+	logger   Logger
+}
+
+var defaultSessionOptions = sessionOptions{
+	wait:     MAX_CHANNEL_WAIT,
+	timeout:  MAX_SESSION_IDEL,
+	mailbox:  MAILBOX_SIZE,
+	overflow: DropOldest,
+	logger:   nopLogger{},
+}
 
 type Session struct {
-	ID              string
-	input           chan *Message
-	channelReq      chan bool
-	channelResp     chan chan *Message
-	channelTimeout  chan bool
-	channelClose    chan bool
-	channelListener chan SessionRemovalListener
+	ID             string
+	Created        time.Time
+	token          string // to resume the session
+	input          chan *Message
+	channelReq     chan chan bool // carrying the stop channel of a connect, or nil
+	channelResp    chan chan *Message
+	channelClose   chan bool
+	channelTouch   chan bool
+	channelFail    chan []*Message
+	done           chan bool // closed once the session ends
+	options        sessionOptions
+	depth          *int64 // number of messages in the mailbox, updated atomically
+	failedConnects int32  // in a row, updated atomically
+	adviceLock     sync.Mutex
+	advice         string // reconnect advice of the next connect, sent once
+	attrLock       sync.RWMutex
+	attrs          map[string]interface{} // of the application
 }
 
 var closedChannel chan *Message = func() chan *Message {
@@ -97,71 +218,270 @@ var closedChannel chan *Message = func() chan *Message {
 	return ch
 }()
 
-func newSession(id string, input chan *Message, cleanup func()) *Session {
-	channelReq := make(chan bool)
+/*
+Create a session running on its own goroutine. Once it ends, the
+cleanup is called on another goroutine with the messages left
+undelivered in the mailbox, unless it's kept to be replayed.
+*/
+func newSession(id, token string, input chan *Message, options sessionOptions, cleanup func(reason CloseReason, undelivered []*Message)) *Session {
+	channelReq := make(chan chan bool)
 	channelResp := make(chan chan *Message)
-	channelTimeout := make(chan bool)
 	channelClose := make(chan bool)
-	channelListener := make(chan SessionRemovalListener)
+	channelTouch := make(chan bool)
+	channelFail := make(chan []*Message)
+	done := make(chan bool)
+
+	var expire <-chan time.Time
+	if options.lifetime > 0 {
+		expire = time.After(options.lifetime)
+	}
 
+	depth := new(int64)
 	go func() {
-		var mailbox *list.List = list.New()
+		// opened on the session's own goroutine, so that the disk I/O of
+		// replaying a mailbox store never blocks the server
+		mailbox := newMemoryMailbox()
+		if options.store != nil {
+			if store, err := options.store(token); err == nil {
+				mailbox = store
+			} else {
+				options.logger.Errorf("[%8.8v]Failed to open mailbox: %v", id, err)
+			}
+		}
+
+		var latest = make(map[string]bool) // coalescing channels in the mailbox
 		var output chan *Message
+		var stop chan bool // of the connect holding the output
 		var isRunning = true
+		var keep bool // the mailbox on close
+		var reason CloseReason
+		var reported time.Time // as a slow consumer
+		highMark := options.highMark
+		if highMark <= 0 {
+			highMark = options.mailbox
+		}
+		isBlocked := func() bool {
+			return options.overflow == Block && mailbox.Len() >= options.mailbox
+		}
+		appendAll := func(msgs []*Message) {
+			for _, msg := range msgs {
+				if err := mailbox.Append(msg); err != nil {
+					options.logger.Errorf("[%8.8v]Failed to save message: %v", id, err)
+				}
+			}
+		}
+		takeAll := func() []*Message {
+			msgs, err := mailbox.Drain()
+			if err != nil {
+				options.logger.Errorf("[%8.8v]Failed to read mailbox: %v", id, err)
+			}
+			return msgs
+		}
+		remove := func(drop func(msg *Message) bool) {
+			if err := mailbox.Remove(drop); err != nil {
+				options.logger.Errorf("[%8.8v]Failed to remove messages: %v", id, err)
+			}
+		}
+		trim := func() { // drop the oldest messages beyond the size
+			n := mailbox.Len() - options.mailbox
+			if n <= 0 {
+				return
+			}
+			drop := func(atMostOnce bool) func(msg *Message) bool {
+				return func(msg *Message) bool {
+					if n <= 0 || atMostOnce && options.qos.of(msg.channel) != AtMostOnce {
+						return false
+					}
+					n--
+					delete(latest, msg.channel)
+					options.health.update(id, func(stat *ClientStat) { stat.Dropped++ })
+					return true
+				}
+			}
+			// the AtMostOnce messages are dropped first
+			remove(drop(true))
+			remove(drop(false))
+		}
+		save := func(msg *Message) {
+			if options.overflow == DropNewest && mailbox.Len() >= options.mailbox {
+				options.logger.Infof("[%8.8v]Dropped message: %v", id, msg)
+				options.health.update(id, func(stat *ClientStat) { stat.Dropped++ })
+				return
+			}
+			options.logger.Debugf("[%8.8v]Saved message: %v", id, msg)
+			msg.queued = time.Now()
+			if options.coalesce.contains(msg.channel) {
+				if latest[msg.channel] { // superseded by the new one
+					remove(func(old *Message) bool {
+						return old.channel == msg.channel
+					})
+				}
+				latest[msg.channel] = true
+			}
+			appendAll([]*Message{msg})
+			trim()
+		}
+		expired := func(msg *Message) bool {
+			return options.ttl > 0 && time.Since(msg.queued) > options.ttl
+		}
+		drain := func() chan *Message { // the expired messages are dropped
+			latest = make(map[string]bool)
+			msgs := takeAll()
+			fresh := msgs[:0]
+			for _, msg := range msgs {
+				if expired(msg) {
+					options.logger.Debugf("[%8.8v]Expired message: %v", id, msg)
+					options.health.update(id, func(stat *ClientStat) { stat.Dropped++ })
+				} else {
+					fresh = append(fresh, msg)
+				}
+			}
+			return convertMailboxToChannel(fresh)
+		}
+		collect := func() { // the messages buffered before the request
+			for !isBlocked() {
+				select {
+				case msg, ok := <-input:
+					if !ok { // deregistered from the broker
+						return
+					}
+					save(msg)
+				default:
+					return
+				}
+			}
+		}
 		for isRunning {
+			n := mailbox.Len()
+			atomic.StoreInt64(depth, int64(n))
+			if options.slow != nil && n >= highMark && time.Since(reported) >= SLOW_CONSUMER_INTERVAL {
+				options.logger.Infof("[%8.8v]Slow consumer with %v messages.", id, n)
+				reported = time.Now()
+				go options.slow(id, n)
+			}
+
+			// stop receiving messages if the full mailbox should block
+			in := input
+			if output == nil && isBlocked() {
+				in = nil
+			}
+
 			// Session's major responsibilities are:
 			// 1. transimit the message from broker to clients;
 			// 2. respond to client's channel request;
-			// 3. manage listeners on session destroy;
-			// 4. close downstream channel;
-			// 6. shutdown and destroy session; and
-			// 7. auto-disconnect those clients that exceed max idel time.
+			// 3. close downstream channel;
+			// 4. keep alive on touch, and take back undelivered messages;
+			// 5. shutdown and destroy session;
+			// 6. auto-disconnect those clients that exceed max idel time; and
+			// 7. expire those sessions that exceed max lifetime.
 			select {
-			case msg := <-input:
+			case msg := <-in:
 				if output == nil { // no downstream channel
-					log.Printf("[%8.8v]Saved message: %v", id, msg)
-					mailbox.PushBack(msg)
-					if mailbox.Len() > MAILBOX_SIZE {
-						mailbox.Remove(mailbox.Front())
-					}
+					save(msg)
 				} else {
-					log.Printf("[%8.8v]Received message: %v", id, msg)
+					options.logger.Debugf("[%8.8v]Received message: %v", id, msg)
 					output <- msg
 				}
 
-			case isConnect := <-channelReq:
+			case connect := <-channelReq:
+				if connect != nil && output != nil {
+					// a new connect supersedes the held one, which
+					// returns with what it has received
+					options.logger.Debugf("[%8.8v]Connect is superseded.", id)
+					close(output)
+					output = nil
+				}
 				if output == nil {
+					collect()
+					if options.noReplay { // the buffered ones are stale
+						remove(func(msg *Message) bool {
+							options.logger.Debugf("[%8.8v]Skipped message: %v", id, msg)
+							options.health.update(id, func(stat *ClientStat) { stat.Dropped++ })
+							return true
+						})
+					}
+
 					// no existing active channel
 					// try queueing the messages by using a large size channel
-					ch := convertMailboxToChannel(mailbox)
-					if isConnect {
-						output = ch
+					ch := drain()
+					if connect != nil {
+						output, stop = ch, connect
 					} else {
 						close(ch)
 					}
 					channelResp <- ch
 				} else {
-					// active connect channel already exists
+					// the held connect wins over other requests
 					channelResp <- closedChannel
 				}
 
-			case <-channelTimeout:
+			case <-stop:
+				stop = nil
 				if output != nil {
 					close(output)
 					output = nil
 				}
 
-			case <-channelClose:
+			case keep = <-channelClose:
 				isRunning = false
 				if output != nil {
 					close(output)
 					output = nil
 				}
-				ch := convertMailboxToChannel(mailbox)
-				close(ch)
-				channelResp <- ch
+				if keep { // to be replayed once resumed
+					reason = ShutDown
+					collect()
+					channelResp <- closedChannel
+				} else {
+					ch := drain()
+					close(ch)
+					channelResp <- ch
+				}
+
+			case <-channelTouch:
+				// nothing to do, the idle timer is reset by any event
 
-			case <-time.After(MAX_SESSION_IDEL):
+			case msgs := <-channelFail:
+				// put the undelivered messages back before the others,
+				// including those not received yet by the connect held
+				// since, which are newer
+				var pending []*Message
+				if output != nil {
+					pending = reclaim(output)
+					close(output)
+					output = nil
+				}
+				pending = append(pending, takeAll()...)
+				for _, msg := range msgs {
+					if latest[msg.channel] {
+						continue // superseded already
+					}
+					if options.qos.of(msg.channel) == AtMostOnce {
+						options.health.update(id, func(stat *ClientStat) { stat.Dropped++ })
+						continue
+					}
+					if msg.queued.IsZero() { // never saved before
+						msg.queued = time.Now()
+					}
+					if options.coalesce.contains(msg.channel) {
+						latest[msg.channel] = true
+					}
+					appendAll([]*Message{msg})
+				}
+				appendAll(pending)
+				trim()
+
+			case <-time.After(options.timeout):
+				reason = TimedOut
+				isRunning = false
+				if output != nil {
+					close(output)
+					output = nil
+				}
+
+			case <-expire:
+				options.logger.Infof("[%8.8v]Session expired.", id)
+				reason = Expired
 				isRunning = false
 				if output != nil {
 					close(output)
@@ -170,48 +490,194 @@ func newSession(id string, input chan *Message, cleanup func()) *Session {
 			}
 		}
 
-		go cleanup()
+		var undelivered []*Message
+		release := mailbox.Discard
+		if keep {
+			release = mailbox.Close
+		} else {
+			collect()
+			undelivered = takeAll()
+		}
+		if err := release(); err != nil {
+			options.logger.Errorf("[%8.8v]Failed to close mailbox: %v", id, err)
+		}
+		close(done)
+		go cleanup(reason, undelivered)
 	}()
 
 	return &Session{
-		ID:              id,
-		input:           input,
-		channelReq:      channelReq,
-		channelResp:     channelResp,
-		channelTimeout:  channelTimeout,
-		channelClose:    channelClose,
-		channelListener: channelListener,
+		ID:           id,
+		Created:      time.Now(),
+		token:        token,
+		depth:        depth,
+		input:        input,
+		channelReq:   channelReq,
+		channelResp:  channelResp,
+		channelClose: channelClose,
+		channelTouch: channelTouch,
+		channelFail:  channelFail,
+		done:         done,
+		options:      options,
+	}
+}
+
+/*
+Take back the messages buffered in the channel but not received yet.
+*/
+func reclaim(ch chan *Message) (msgs []*Message) {
+	for {
+		select {
+		case msg := <-ch:
+			msgs = append(msgs, msg)
+		default:
+			return
+		}
 	}
 }
 
-func convertMailboxToChannel(mailbox *list.List) chan *Message {
-	if mailbox.Len() == 0 {
+func convertMailboxToChannel(msgs []*Message) chan *Message {
+	if len(msgs) == 0 {
 		return make(chan *Message)
 	}
-	ch := make(chan *Message, mailbox.Len())
-	for e := mailbox.Front(); e != nil; e = e.Next() {
-		if e.Value == nil {
+	ch := make(chan *Message, len(msgs))
+	for _, msg := range msgs {
+		if msg == nil {
 			panic("message should not be nil")
 		}
-		ch <- e.Value.(*Message)
+		ch <- msg
 	}
-	mailbox.Init()
 	return ch
 }
 
 /*
-Attach a listener for session destroy event.
+Keep the application state of the session, e.g. the authenticated
+user, which is removed if the value is nil. It's safe to be called by
+any goroutine.
 */
-func (ss *Session) ListenOnRemoval(listener func(session *Session, timeout bool)) {
-	ss.channelListener <- listener
+func (ss *Session) Set(key string, value interface{}) {
+	ss.attrLock.Lock()
+	defer ss.attrLock.Unlock()
+	if value == nil {
+		delete(ss.attrs, key)
+		return
+	}
+	if ss.attrs == nil {
+		ss.attrs = make(map[string]interface{})
+	}
+	ss.attrs[key] = value
+}
+
+/*
+Get the application state of the session, or nil if it's not set.
+*/
+func (ss *Session) Get(key string) interface{} {
+	ss.attrLock.RLock()
+	defer ss.attrLock.RUnlock()
+	return ss.attrs[key]
+}
+
+/*
+Keep the reconnect advice for the next connect response, replacing the
+one not sent yet.
+*/
+func (ss *Session) setAdvice(reconnect string) {
+	ss.adviceLock.Lock()
+	defer ss.adviceLock.Unlock()
+	ss.advice = reconnect
+}
+
+/*
+Take the reconnect advice kept for the connect response, if any, which
+is cleared so that it's sent only once.
+*/
+func (ss *Session) takeAdvice() (reconnect string) {
+	ss.adviceLock.Lock()
+	defer ss.adviceLock.Unlock()
+	reconnect, ss.advice = ss.advice, ""
+	return
+}
+
+/*
+Obtain the downstream channel of the session. If the session is too
+busy to accept the request within its wait time, or it's closed
+already, a closed channel is returned along with an error so that the
+caller won't stall.
+
+A new connect supersedes the one held already, while any other request
+is answered by a closed channel during a connect. A connect is stopped
+by sending to its own stop channel, which never blocks even if the
+session has ended or the connect is superseded. So a stale stop never
+cuts another connect short.
+*/
+func (ss *Session) obtainChannel(isConnect bool) (ch chan *Message, stop chan bool, err error) {
+	var req chan bool
+	if isConnect {
+		req = make(chan bool, 1)
+	}
+	select {
+	case ss.channelReq <- req:
+		// the session always responds once the request is accepted
+		return <-ss.channelResp, req, nil
+	case <-ss.done:
+		return closedChannel, nil, errSessionClosed
+	case <-time.After(ss.options.wait):
+		return closedChannel, nil, errChannelTimeout
+	}
 }
 
-func (ss *Session) obtainChannel(isConnect bool) (ch chan *Message, stop chan bool) {
-	ss.channelReq <- isConnect
-	return <-ss.channelResp, ss.channelTimeout
+/*
+Reset the idle timer of the session. It returns false if the session is
+closed already.
+*/
+func (ss *Session) touch() bool {
+	select {
+	case ss.channelTouch <- true:
+		return true
+	case <-ss.done:
+		return false
+	case <-time.After(ss.options.wait):
+		return true // busy but alive
+	}
+}
+
+/*
+Close the downstream channel, and put the messages which failed to be
+delivered, e.g. because the client is gone, back into the mailbox so
+that they're sent again on the next request. It returns false if the
+session is closed already.
+
+The messages are delivered in the order the session receives them. The
+failed ones are put back in their original order ahead of the others,
+so they come out first on the next request, unless they're AtMostOnce
+or superseded by coalescing. Only those already received by a connect
+held in the meantime are delivered before them.
+*/
+func (ss *Session) fail(msgs []*Message) bool {
+	select {
+	case ss.channelFail <- msgs:
+		return true
+	case <-ss.done:
+		return false
+	}
 }
 
 func (ss *Session) close() chan *Message {
-	ss.channelClose <- true
-	return <-ss.channelResp
+	return ss.end(false)
+}
+
+/*
+Close the session on shutdown, keeping the unsent messages in its
+mailbox store to be replayed after a restart.
+*/
+func (ss *Session) shutdown() {
+	ss.end(true)
+}
+
+func (ss *Session) end(keep bool) chan *Message {
+	select {
+	case ss.channelClose <- keep:
+		return <-ss.channelResp
+	case <-ss.done:
+		return closedChannel
+	}
 }
@@ -0,0 +1,376 @@
+package gocomet
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestObtainChannelTimeout(t *testing.T) {
+	input := make(chan *Message)
+	options := defaultSessionOptions
+	options.wait = 10 * time.Millisecond
+	ss := newSession("client", "", input, options, func(CloseReason, []*Message) {})
+	output, _, err := ss.obtainChannel(true)
+	assert(err == nil, t, "failed to obtain connect channel")
+
+	// nobody reads the output, so the session is stuck on delivery
+	go func() { input <- &Message{channel: "/foo/bar", data: json.RawMessage(`"ping"`)} }()
+	time.Sleep(10 * time.Millisecond)
+
+	ch, stop, err := ss.obtainChannel(false)
+	assert(err == errChannelTimeout, t, "obtain channel should time out (got %v)", err)
+	assert(stop == nil, t, "no stop channel should be returned on timeout")
+	_, ok := <-ch
+	assert(!ok, t, "a closed channel should be returned on timeout")
+
+	msg := <-output
+	assert(string(msg.data) == `"ping"`, t, "blocked message should still be delivered")
+}
+
+func TestStaleStop(t *testing.T) {
+	ss := newSession("client", "", make(chan *Message), defaultSessionOptions, func(CloseReason, []*Message) {})
+	superseded, staleStop, _ := ss.obtainChannel(true)
+	held, stop, err := ss.obtainChannel(true)
+	_, ok := <-superseded
+	assert(err == nil && !ok, t, "a new connect should supersede the held one (got %v)", err)
+	staleStop <- true
+	select {
+	case <-held:
+		t.Error("held connect should not be stopped by the superseded one")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	stop <- true
+	_, ok = <-held
+	assert(!ok, t, "held connect should be stopped by its own")
+	_, stop, _ = ss.obtainChannel(true)
+	ss.close()
+	select {
+	case stop <- true:
+	default:
+		t.Error("stopping a connect should never block once the session ends")
+	}
+}
+
+func mailboxTest(t *testing.T, policy OverflowPolicy) []string {
+	input := make(chan *Message)
+	options := defaultSessionOptions
+	options.mailbox = 2
+	options.overflow = policy
+	ss := newSession("client", "", input, options, func(CloseReason, []*Message) {})
+	for _, data := range []string{`1`, `2`, `3`} {
+		select {
+		case input <- &Message{channel: "/foo/bar", data: json.RawMessage(data)}:
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	ch, _, _ := ss.obtainChannel(false)
+	var received []string
+	for msg := range ch {
+		received = append(received, string(msg.data))
+	}
+	return received
+}
+
+func TestMailboxOverflow(t *testing.T) {
+	received := mailboxTest(t, DropOldest)
+	assert(len(received) == 2 && received[0] == "2" && received[1] == "3", t, "oldest message should be dropped (got %v)", received)
+	received = mailboxTest(t, DropNewest)
+	assert(len(received) == 2 && received[0] == "1" && received[1] == "2", t, "newest message should be dropped (got %v)", received)
+	received = mailboxTest(t, Block)
+	assert(len(received) == 2 && received[0] == "1" && received[1] == "2", t, "sender should be blocked (got %v)", received)
+}
+
+func TestSessionFail(t *testing.T) {
+	input := make(chan *Message)
+	ss := newSession("client", "", input, defaultSessionOptions, func(CloseReason, []*Message) {})
+	ch, _, _ := ss.obtainChannel(true)
+	first := &Message{channel: "/foo/bar", data: json.RawMessage(`1`)}
+	input <- first
+	msg := <-ch
+	ss.fail([]*Message{msg})
+	_, ok := <-ch
+	assert(!ok, t, "downstream channel should be closed on failure")
+
+	input <- &Message{channel: "/foo/bar", data: json.RawMessage(`2`)}
+	ch, _, _ = ss.obtainChannel(false)
+	var received []string
+	for msg := range ch {
+		received = append(received, string(msg.data))
+	}
+	assert(len(received) == 2 && received[0] == "1" && received[1] == "2", t, "failed message should be returned first (got %v)", received)
+}
+
+func TestPoolRelease(t *testing.T) {
+	values := []string{"a", "a", "b"}
+	pool := newUniqueStringPool(func() string {
+		v := values[0]
+		values = values[1:]
+		return v
+	})
+	a, _ := pool.get()
+	pool.release(a)
+	assert(!pool.touch(a), t, "released value should be gone")
+	again, _ := pool.get()
+	assert(again == "a", t, "released value should be available again (got %v)", again)
+	assert(pool.order.Len() == 1 && len(pool.values) == 1, t, "pool should only keep live values")
+
+	s := newServer()
+	c1, _ := s.handshake()
+	s.disconnect(c1)
+	assert(!s.names.touch(c1), t, "client ID should be released on disconnect")
+}
+
+func TestPoolRetention(t *testing.T) {
+	var next int
+	pool := newUniqueStringPool(func() string {
+		next++
+		return strconv.Itoa(next)
+	})
+	pool.setRetention(10 * time.Millisecond)
+	a, _ := pool.get()
+	time.Sleep(20 * time.Millisecond)
+	pool.get() // sweeps the expired ones
+	assert(!pool.touch(a), t, "value should be auto-released after the retention time")
+
+	inst := New().SetIdRetention(time.Hour)
+	c1, _ := inst.handshake()
+	assert(inst.names.touch(c1), t, "value should be kept within the retention time")
+}
+
+func TestMessageTTL(t *testing.T) {
+	input := make(chan *Message)
+	options := defaultSessionOptions
+	options.ttl = 20 * time.Millisecond
+	ss := newSession("client", "", input, options, func(CloseReason, []*Message) {})
+	input <- &Message{channel: "/foo", data: json.RawMessage(`1`)}
+	time.Sleep(40 * time.Millisecond)
+	input <- &Message{channel: "/foo", data: json.RawMessage(`2`)}
+	ch, _, _ := ss.obtainChannel(false)
+	var received []string
+	for msg := range ch {
+		received = append(received, string(msg.data))
+	}
+	assert(len(received) == 1 && received[0] == "2", t, "expired message should be dropped (got %v)", received)
+}
+
+func TestChannelQoS(t *testing.T) {
+	input := make(chan *Message)
+	options := defaultSessionOptions
+	options.mailbox = 3
+	options.qos = newQosTable()
+	options.qos.set("/telemetry/**", AtMostOnce)
+	ss := newSession("client", "", input, options, func(CloseReason, []*Message) {})
+
+	// the AtMostOnce messages are not put back once failed
+	ch, _, _ := ss.obtainChannel(true)
+	input <- &Message{channel: "/telemetry/cpu", data: json.RawMessage(`0`)}
+	first := <-ch // the connect channel is unbuffered
+	input <- &Message{channel: "/chat", data: json.RawMessage(`"a"`)}
+	ss.fail([]*Message{first, <-ch})
+
+	// and they're dropped first once the mailbox is full
+	for i, channel := range []string{"/telemetry/cpu", "/chat", "/telemetry/mem"} {
+		input <- &Message{channel: channel, data: json.RawMessage(strconv.Itoa(i + 1))}
+	}
+	ch, _, _ = ss.obtainChannel(false)
+	var received []string
+	for msg := range ch {
+		received = append(received, msg.channel+":"+string(msg.data))
+	}
+	assert(strings.Join(received, ",") == `/chat:"a",/chat:2,/telemetry/mem:3`, t, "unexpected messages %v", received)
+}
+
+func TestFailedOrder(t *testing.T) {
+	input := make(chan *Message)
+	ss := newSession("client", "", input, defaultSessionOptions, func(CloseReason, []*Message) {})
+	for i := 1; i <= 5; i++ {
+		input <- &Message{channel: "/foo", data: json.RawMessage(strconv.Itoa(i))}
+	}
+
+	// the send fails in the middle of the batch, while another message
+	// is queued to the connect in the meantime
+	ch, _, _ := ss.obtainChannel(true)
+	var batch []*Message
+	for i := 0; i < 5; i++ {
+		batch = append(batch, <-ch)
+	}
+	input <- &Message{channel: "/foo", data: json.RawMessage(`6`)}
+	ss.fail(batch[2:])
+	_, ok := <-ch
+	assert(!ok, t, "unreceived message of the connect should be taken back")
+
+	ch, _, _ = ss.obtainChannel(false)
+	var received []string
+	for msg := range ch {
+		received = append(received, string(msg.data))
+	}
+	assert(strings.Join(received, ",") == "3,4,5,6", t, "failed messages should come out first in order (got %v)", received)
+}
+
+func TestSetChannelQoS(t *testing.T) {
+	inst := New().SetChannelQoS("/telemetry/**", AtMostOnce).SetChannelQoS("/debug", AtMostOnce)
+	clientId, _ := inst.handshake()
+	ss := inst.sessions[clientId]
+	assert(ss.options.qos.of("/telemetry/cpu") == AtMostOnce, t, "session should follow the instance QoS")
+	assert(ss.options.qos.of("/chat") == AtLeastOnce, t, "other channels should be AtLeastOnce")
+
+	inst.SetChannelQoS("/debug", AtLeastOnce)
+	assert(ss.options.qos.of("/debug") == AtLeastOnce, t, "QoS should be changed for the live sessions")
+	assert(ss.options.qos.of("/telemetry/mem") == AtMostOnce, t, "other patterns should be kept")
+}
+
+type sessionPolicy struct {
+	inst *Instance
+}
+
+func (p sessionPolicy) CanSubscribe(clientId, channel string) bool { return true }
+
+func (p sessionPolicy) CanPublish(clientId, channel string) bool {
+	ss, ok := p.inst.Session(clientId)
+	return ok && (channel == "/service/login" || ss.Get("user") == "admin")
+}
+
+func TestSessionAttributes(t *testing.T) {
+	inst := New()
+	inst.SetSecurityPolicy(sessionPolicy{inst})
+	inst.AddService("/service/login", func(session *Session, message *MetaMessage) {
+		var user string
+		json.Unmarshal(message.Data, &user)
+		session.Set("user", user)
+	})
+	clientId := handshake(t, inst)
+	_, resp := post(t, inst, `[{"channel":"/foo","clientId":"`+clientId+`","data":1}]`)
+	assert(len(resp) == 1 && !resp[0].Successful, t, "publish should be denied before login (got %+v)", resp)
+	post(t, inst, `[{"channel":"/service/login","clientId":"`+clientId+`","data":"admin"}]`)
+	inst.InvalidateAuth(clientId)
+	_, resp = post(t, inst, `[{"channel":"/foo","clientId":"`+clientId+`","data":1}]`)
+	assert(len(resp) == 1 && resp[0].Successful, t, "publish should be allowed after login (got %+v)", resp)
+
+	ss, _ := inst.Session(clientId)
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			ss.Set("n", i)
+			ss.Get("n")
+		}(i)
+	}
+	wg.Wait()
+	ss.Set("user", nil)
+	assert(ss.Get("user") == nil && ss.Get("unknown") == nil, t, "removed or unknown state should be nil")
+}
+
+func TestOnSessionClosed(t *testing.T) {
+	closed := make(chan CloseReason, 3)
+	inst := New().SetSessionTimeout(50 * time.Millisecond)
+	inst.OnSessionClosed(func(clientId string, reason CloseReason) {
+		ss, ok := inst.Session(clientId) // never called holding the lock
+		assert(ss == nil && !ok, t, "session should be gone")
+		closed <- reason
+	})
+	next := func() CloseReason {
+		select {
+		case reason := <-closed:
+			return reason
+		case <-time.After(time.Second):
+			t.Fatal("callback should be called")
+		}
+		return -1
+	}
+
+	handshake(t, inst)
+	assert(next() == TimedOut, t, "idle session should time out")
+	inst.SetSessionTimeout(time.Minute)
+	inst.Disconnect(handshake(t, inst))
+	assert(next() == Disconnected, t, "disconnected session should be reported")
+	handshake(t, inst)
+	inst.Shutdown(context.Background())
+	assert(next() == ShutDown, t, "session should be closed by shutdown")
+}
+
+func TestOnUndelivered(t *testing.T) {
+	undelivered := make(chan []*Message, 3)
+	inst := New().SetSessionTimeout(50 * time.Millisecond)
+	inst.OnUndelivered(func(clientId string, msgs []*Message) {
+		undelivered <- msgs
+	})
+	next := func() []*Message {
+		select {
+		case msgs := <-undelivered:
+			return msgs
+		case <-time.After(time.Second):
+			t.Fatal("callback should be called")
+		}
+		return nil
+	}
+	subscribe := func() string {
+		clientId := handshake(t, inst)
+		post(t, inst, `[{"channel":"/meta/subscribe","clientId":"`+clientId+`","subscription":"/foo"}]`)
+		return clientId
+	}
+
+	subscribe()
+	inst.Publish("/foo", "ping")
+	inst.Publish("/foo", "pong")
+	msgs := next()
+	assert(len(msgs) == 2 && msgs[0].Channel() == "/foo" && string(msgs[1].Data()) == `"pong"`, t,
+		"messages left in a timed out session should be reported (got %v)", msgs)
+
+	inst.SetSessionTimeout(time.Minute)
+	clientId := subscribe()
+	inst.Publish("/foo", "ping")
+	time.Sleep(10 * time.Millisecond) // until it's in the mailbox
+	inst.Disconnect(clientId)
+	msgs = next()
+	assert(len(msgs) == 1 && string(msgs[0].Data()) == `"ping"`, t, "messages of a kicked client should be reported (got %v)", msgs)
+
+	clientId = subscribe()
+	inst.Publish("/foo", "ping")
+	time.Sleep(10 * time.Millisecond)
+	_, resp := post(t, inst, `[{"channel":"/meta/disconnect","clientId":"`+clientId+`"}]`)
+	assert(len(resp) == 2, t, "messages should be returned on disconnect (got %v)", resp)
+	select {
+	case msgs = <-undelivered:
+		t.Errorf("messages returned on disconnect should not be reported (got %v)", msgs)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestOnSlowConsumer(t *testing.T) {
+	type report struct {
+		clientId string
+		depth    int
+	}
+	reports := make(chan report, 10)
+	inst := New().SetSlowConsumerMark(3).OnSlowConsumer(func(clientId string, depth int) {
+		reports <- report{clientId, depth}
+	})
+	clientId := handshake(t, inst)
+	post(t, inst, `[{"channel":"/meta/subscribe","clientId":"`+clientId+`","subscription":"/foo"}]`)
+	for i := 0; i < 3; i++ {
+		inst.Publish("/foo", i)
+	}
+	select {
+	case r := <-reports:
+		assert(r.clientId == clientId && r.depth == 3, t, "slow consumer should be reported (got %+v)", r)
+	case <-time.After(time.Second):
+		t.Fatal("callback should be called")
+	}
+
+	for i := 0; i < 10; i++ {
+		inst.Publish("/foo", i)
+	}
+	inst.Touch(clientId) // wait until the messages are saved
+	select {
+	case r := <-reports:
+		t.Fatalf("slow consumer should not be reported again so soon (got %+v)", r)
+	case <-time.After(20 * time.Millisecond):
+	}
+}
@@ -0,0 +1,187 @@
+package gocomet
+
+import (
+	"container/list"
+	"sync"
+	"sync/atomic"
+)
+
+// Maximum number of channels to keep statistics for. The least
+// recently used channels are dropped first.
+const MAX_CHANNEL_STATS = 1000
+
+/*
+The statistics of a channel. Publishes and deliveries are counted by
+the published channel, while subscribers are counted by the subscribed
+channel which may be a wildcard.
+*/
+type ChannelStat struct {
+	Publishes   int
+	Deliveries  int
+	Subscribers int
+}
+
+type channelStatEntry struct {
+	channel string
+	stat    ChannelStat
+}
+
+type channelStats struct {
+	sync.Locker
+	size     int
+	channels map[string]*list.Element
+	order    *list.List
+}
+
+func newChannelStats(size int) *channelStats {
+	return &channelStats{&sync.Mutex{}, size, make(map[string]*list.Element), list.New()}
+}
+
+/*
+Update the statistics of the channel. A missing channel is only added
+if create is true.
+*/
+func (stats *channelStats) update(channel string, create bool, f func(stat *ChannelStat)) {
+	stats.Lock()
+	defer stats.Unlock()
+
+	e, ok := stats.channels[channel]
+	if ok {
+		stats.order.MoveToBack(e)
+	} else if create {
+		e = stats.order.PushBack(&channelStatEntry{channel: channel})
+		stats.channels[channel] = e
+		for stats.order.Len() > stats.size {
+			front := stats.order.Front()
+			delete(stats.channels, front.Value.(*channelStatEntry).channel)
+			stats.order.Remove(front)
+		}
+	} else {
+		return
+	}
+	f(&e.Value.(*channelStatEntry).stat)
+}
+
+func (stats *channelStats) snapshot() map[string]ChannelStat {
+	stats.Lock()
+	defer stats.Unlock()
+
+	result := make(map[string]ChannelStat, len(stats.channels))
+	for channel, e := range stats.channels {
+		result[channel] = e.Value.(*channelStatEntry).stat
+	}
+	return result
+}
+
+/*
+Obtain the statistics of the recently active channels.
+*/
+func (c *Server) ChannelStats() map[string]ChannelStat {
+	return c.broker.local().stats.snapshot()
+}
+
+/*
+The delivery statistics of a client. Delivered counts the messages
+accepted by the client's buffer, while dropped counts those dropped
+because of a full buffer, an overflowing mailbox, or a client gone
+during the delivery.
+*/
+type ClientStat struct {
+	Delivered int
+	Dropped   int
+}
+
+type clientStats struct {
+	sync.Locker
+	clients map[string]*ClientStat
+}
+
+func newClientStats() *clientStats {
+	return &clientStats{&sync.Mutex{}, make(map[string]*ClientStat)}
+}
+
+func (stats *clientStats) add(clientId string) {
+	stats.Lock()
+	defer stats.Unlock()
+	if _, ok := stats.clients[clientId]; !ok {
+		stats.clients[clientId] = &ClientStat{}
+	}
+}
+
+/*
+Update the statistics of the client, which is ignored if the client
+has been removed.
+*/
+func (stats *clientStats) update(clientId string, f func(stat *ClientStat)) {
+	if stats == nil {
+		return
+	}
+	stats.Lock()
+	defer stats.Unlock()
+	if stat, ok := stats.clients[clientId]; ok {
+		f(stat)
+	}
+}
+
+func (stats *clientStats) get(clientId string) (stat ClientStat) {
+	stats.Lock()
+	defer stats.Unlock()
+	if s, ok := stats.clients[clientId]; ok {
+		stat = *s
+	}
+	return
+}
+
+func (stats *clientStats) remove(clientId string) {
+	stats.Lock()
+	defer stats.Unlock()
+	delete(stats.clients, clientId)
+}
+
+/*
+Obtain the delivery statistics of the client, to identify the flaky
+ones. It's reset once the client is gone.
+*/
+func (c *Server) ClientHealth(clientId string) ClientStat {
+	return c.broker.local().health.get(clientId)
+}
+
+/*
+The overall statistics of the server.
+*/
+type Stats struct {
+	Clients       int64 // connected clients
+	Handshakes    int64 // total handshakes
+	Subscriptions int64 // active subscriptions
+	Published     int64 // total messages published
+	Delivered     int64 // total messages delivered to the clients
+}
+
+/*
+The counters behind Stats, which are updated atomically so that the
+hot path isn't locked.
+*/
+type counters struct {
+	clients       int64
+	handshakes    int64
+	subscriptions int64
+	published     int64
+	delivered     int64
+}
+
+func (c *counters) snapshot() Stats {
+	return Stats{
+		Clients:       atomic.LoadInt64(&c.clients),
+		Handshakes:    atomic.LoadInt64(&c.handshakes),
+		Subscriptions: atomic.LoadInt64(&c.subscriptions),
+		Published:     atomic.LoadInt64(&c.published),
+		Delivered:     atomic.LoadInt64(&c.delivered),
+	}
+}
+
+/*
+Obtain the overall statistics, which is cheap enough to be polled.
+*/
+func (c *Server) Stats() Stats {
+	return c.broker.local().counters.snapshot()
+}
@@ -0,0 +1,70 @@
+package gocomet
+
+/*
+A span of a trace, e.g. wrapping an OpenTelemetry span. The trace ID is
+carried by the delivered messages in their extension like
+{"trace":{"id":"abc"}}, so that a publish can be correlated with all its
+deliveries, including those returned by the connects.
+*/
+type Span interface {
+	TraceId() string // empty if not traced
+	Child(name string) Span
+	SetTag(key string, value interface{})
+	End()
+}
+
+/*
+Start the spans of the message flow: "publish" once a message is
+published, a "broadcast" child of it for the fan-out, and a "deliver"
+grandchild per client tagged with the client ID.
+*/
+type Tracer interface {
+	StartSpan(name string) Span
+}
+
+type nopTracer struct{}
+
+func (nopTracer) StartSpan(name string) Span { return nopSpan{} }
+
+type nopSpan struct{}
+
+func (nopSpan) TraceId() string                      { return "" }
+func (nopSpan) Child(name string) Span               { return nopSpan{} }
+func (nopSpan) SetTag(key string, value interface{}) {}
+func (nopSpan) End()                                 {}
+
+type traceInfo struct {
+	Id string `json:"id"`
+}
+
+/*
+The extension of a delivered message carrying its trace ID, or nil if
+it's not traced.
+*/
+func traceExtension(traceId string) interface{} {
+	if traceId == "" {
+		return nil
+	}
+	return map[string]interface{}{"trace": &traceInfo{traceId}}
+}
+
+func (b *Broker) startSpan(name string) Span {
+	b.RLock()
+	tracer := b.tracer
+	b.RUnlock()
+	return tracer.StartSpan(name)
+}
+
+/*
+Trace the message flow by the tracer, which is disabled by default.
+*/
+func (inst *Instance) SetTracer(tracer Tracer) *Instance {
+	if tracer == nil {
+		tracer = nopTracer{}
+	}
+	b := inst.broker.local()
+	b.Lock()
+	defer b.Unlock()
+	b.tracer = tracer
+	return inst
+}
@@ -0,0 +1,102 @@
+package gocomet
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+type recordingTracer struct {
+	sync.Mutex
+	spans []*recordedSpan
+}
+
+type recordedSpan struct {
+	tracer *recordingTracer
+	name   string
+	trace  string
+	parent *recordedSpan
+	tags   map[string]interface{}
+	ended  bool
+}
+
+func (t *recordingTracer) start(name, trace string, parent *recordedSpan) Span {
+	t.Lock()
+	defer t.Unlock()
+	if parent == nil {
+		trace = fmt.Sprintf("trace-%d", len(t.spans))
+	}
+	s := &recordedSpan{tracer: t, name: name, trace: trace, parent: parent, tags: make(map[string]interface{})}
+	t.spans = append(t.spans, s)
+	return s
+}
+
+func (t *recordingTracer) StartSpan(name string) Span {
+	return t.start(name, "", nil)
+}
+
+func (t *recordingTracer) find(name string) (found []*recordedSpan) {
+	t.Lock()
+	defer t.Unlock()
+	for _, s := range t.spans {
+		if s.name == name {
+			found = append(found, s)
+		}
+	}
+	return
+}
+
+func (s *recordedSpan) TraceId() string        { return s.trace }
+func (s *recordedSpan) Child(name string) Span { return s.tracer.start(name, s.trace, s) }
+func (s *recordedSpan) End()                   { s.tracer.Lock(); s.ended = true; s.tracer.Unlock() }
+func (s *recordedSpan) SetTag(key string, value interface{}) {
+	s.tracer.Lock()
+	defer s.tracer.Unlock()
+	s.tags[key] = value
+}
+
+func TestTracing(t *testing.T) {
+	tracer := &recordingTracer{}
+	inst := New().SetTracer(tracer)
+	subscriber := handshake(t, inst)
+	post(t, inst, `[{"channel":"/meta/subscribe","clientId":"`+subscriber+`","subscription":"/foo"}]`)
+	publisher := handshake(t, inst)
+	post(t, inst, `[{"channel":"/foo","clientId":"`+publisher+`","data":"ping"}]`)
+
+	publishes := tracer.find("publish")
+	if len(publishes) != 1 {
+		t.Fatalf("expect one publish span (got %v)", len(publishes))
+	}
+	publish := publishes[0]
+	assert(publish.tags["clientId"] == publisher && publish.tags["channel"] == "/foo" && publish.ended, t,
+		"publish span should be tagged and ended (got %v)", publish.tags)
+	broadcasts := tracer.find("broadcast")
+	assert(len(broadcasts) == 1 && broadcasts[0].parent == publish, t, "broadcast should be a child of publish (got %v)", broadcasts)
+	delivers := tracer.find("deliver")
+	if len(delivers) != 1 {
+		t.Fatalf("expect one deliver span (got %v)", len(delivers))
+	}
+	assert(delivers[0].parent == broadcasts[0] && delivers[0].tags["clientId"] == subscriber, t,
+		"deliver should be a child of broadcast tagged with the subscriber (got %v)", delivers[0].tags)
+
+	_, resp := post(t, inst, `[{"channel":"/meta/connect","clientId":"`+subscriber+`","connectionType":"long-polling"}]`)
+	if len(resp) != 2 {
+		t.Fatalf("expect one event and one response (got %v)", resp)
+	}
+	ext, _ := resp[0].Extension.(map[string]interface{})
+	trace, _ := ext["trace"].(map[string]interface{})
+	assert(trace["id"] == publish.trace, t, "event should carry the trace ID (got %v)", resp[0].Extension)
+	assert(resp[1].Extension == nil, t, "connect response should carry no trace (got %v)", resp[1].Extension)
+}
+
+func TestTracingDisabled(t *testing.T) {
+	inst := New()
+	subscriber := handshake(t, inst)
+	post(t, inst, `[{"channel":"/meta/subscribe","clientId":"`+subscriber+`","subscription":"/foo"}]`)
+	inst.Publish("/foo", "ping")
+	_, resp := post(t, inst, `[{"channel":"/meta/connect","clientId":"`+subscriber+`","connectionType":"long-polling"}]`)
+	if len(resp) != 2 {
+		t.Fatalf("expect one event and one response (got %v)", resp)
+	}
+	assert(resp[0].Extension == nil, t, "untraced event should carry no extension (got %v)", resp[0].Extension)
+}
@@ -9,3 +9,65 @@ resources required for the cnnection.
 */
 type LongPolling struct {
 }
+
+// The connection types implemented by the package, all of which are
+// enabled by default.
+var knownConnectionTypes = []string{"long-polling"}
+
+/*
+Negotiate the enabled connection types with those supported by the
+client. A client telling none is assumed to support all of them.
+*/
+func negotiateConnectionTypes(enabled, supported []string) (types []string) {
+	if len(supported) == 0 {
+		return enabled
+	}
+	for _, t := range enabled {
+		if hasConnectionType(supported, t) {
+			types = append(types, t)
+		}
+	}
+	return
+}
+
+/*
+The first enabled connection type other than the failing one, or empty
+if there's none to fall back to.
+*/
+func fallbackConnectionType(enabled []string, failing string) string {
+	for _, t := range enabled {
+		if t != failing {
+			return t
+		}
+	}
+	return ""
+}
+
+func hasConnectionType(types []string, t string) bool {
+	for _, s := range types {
+		if s == t {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+Enable only the connection types, which are told to the clients on
+handshake. The transports of the others reject their requests. Those
+not implemented by the package are ignored.
+*/
+func (inst *Instance) SetConnectionTypes(types []string) *Instance {
+	var enabled []string
+	for _, t := range types {
+		if hasConnectionType(knownConnectionTypes, t) {
+			enabled = append(enabled, t)
+		} else {
+			inst.logger.Errorf("Unknown connection type: %v", t)
+		}
+	}
+	inst.Lock()
+	defer inst.Unlock()
+	inst.connectionTypes = enabled
+	return inst
+}